@@ -14,6 +14,12 @@ var (
 	configFile string
 	daemonize  bool
 	scan       bool
+	release    bool
+	dryRun     bool
+	asJSON     bool
+	pid        int
+	group      string
+	tree       bool
 
 	// BuildDate is the date project was build.  Injected from linker
 	BuildDate string
@@ -35,6 +41,14 @@ func assertUsage(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// assertGroupUsage is like assertUsage, for commands taking a group name
+func assertGroupUsage(cmd *cobra.Command, args []string) error {
+	if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+		return err
+	}
+	return assertUsage(cmd, nil)
+}
+
 func main() {
 	log.InitConsoleLogger()
 	root := &cobra.Command{
@@ -54,17 +68,87 @@ func main() {
 	run := &cobra.Command{
 		Use:        "run",
 		Short:      "Listen for rules defined in configuration and act accordlingly",
-		Run:        func(cmd *cobra.Command, args []string) { internal.Loop(configFile, daemonize, scan) },
+		Run:        func(cmd *cobra.Command, args []string) { internal.Loop(configFile, daemonize, scan, release, dryRun) },
 		SuggestFor: []string{"daemon"},
 	}
 	run.Flags().BoolVarP(&daemonize, "daemon", "d", false, "Fork to a daemonized process in background")
 	run.Flags().BoolVarP(&scan, "scan", "s", false, "Scan already active processes according to rules")
+	run.Flags().BoolVarP(&release, "release", "r", false, "On exit, move processes back to the control groups they were in")
+	run.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "Log what would be done on matches, instead of doing it")
 	quickRun := &cobra.Command{
 		Use:   "quick-run",
 		Short: "Scan currently running processes according to rules and exit",
-		Run:   func(cmd *cobra.Command, args []string) { internal.Scan(configFile) },
+		Run:   func(cmd *cobra.Command, args []string) { internal.Scan(configFile, dryRun) },
+	}
+	quickRun.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "Log what would be done on matches, instead of doing it")
+	reload := &cobra.Command{
+		Use:   "reload",
+		Short: "Make a running daemon reload its configuration",
+		Long:  "Make a running daemon reload its configuration, by sending it a SIGHUP signal",
+		Run:   func(cmd *cobra.Command, args []string) { internal.Reload() },
+	}
+	status := &cobra.Command{
+		Use:   "status",
+		Short: "Show fetter cgroups, their limits, usage and processes",
+		Run:   func(cmd *cobra.Command, args []string) { internal.Status(configFile, asJSON) },
+	}
+	status.Flags().BoolVarP(&asJSON, "json", "j", false, "Print status as JSON")
+	validate := &cobra.Command{
+		Use:   "validate",
+		Short: "Check configuration file, reporting every problem found",
+		// No root privileges needed
+		PersistentPreRunE: cobra.NoArgs,
+		Run:               func(cmd *cobra.Command, args []string) { internal.Validate(configFile) },
+	}
+	move := &cobra.Command{
+		Use:   "move",
+		Short: "Move a process to a fetter cgroup by hand",
+		Run:   func(cmd *cobra.Command, args []string) { internal.Move(configFile, pid, group, tree) },
+	}
+	move.Flags().IntVarP(&pid, "pid", "p", 0, "Pid of the process to move")
+	move.Flags().StringVarP(&group, "group", "g", "", "Group to move the process to")
+	move.Flags().BoolVarP(&tree, "tree", "t", false, "Move the descendants of the process too")
+	move.MarkFlagRequired("pid")
+	move.MarkFlagRequired("group")
+	releaseCmd := &cobra.Command{
+		Use:   "release",
+		Short: "Move a process out of fetter cgroups, back to where it was",
+		Run:   func(cmd *cobra.Command, args []string) { internal.Release(configFile, pid) },
+	}
+	releaseCmd.Flags().IntVarP(&pid, "pid", "p", 0, "Pid of the process to release")
+	releaseCmd.MarkFlagRequired("pid")
+	freeze := &cobra.Command{
+		Use:               "freeze GROUP",
+		Short:             "Freeze the processes in a fetter cgroup",
+		PersistentPreRunE: assertGroupUsage,
+		Run:               func(cmd *cobra.Command, args []string) { internal.Freeze(configFile, args[0], true) },
+	}
+	thaw := &cobra.Command{
+		Use:               "thaw GROUP",
+		Short:             "Resume the processes in a frozen fetter cgroup",
+		PersistentPreRunE: assertGroupUsage,
+		Run:               func(cmd *cobra.Command, args []string) { internal.Freeze(configFile, args[0], false) },
+	}
+	explain := &cobra.Command{
+		Use:   "explain [executable]",
+		Short: "Show which rules match an executable or a running process, and why",
+		// No root privileges needed
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if (len(args) == 1) == (pid != 0) {
+				return fmt.Errorf("either an executable or a pid is required")
+			}
+			return cobra.MaximumNArgs(1)(cmd, args)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			path := ""
+			if len(args) > 0 {
+				path = args[0]
+			}
+			internal.Explain(configFile, path, pid)
+		},
 	}
-	root.AddCommand(clean, run, quickRun)
+	explain.Flags().IntVarP(&pid, "pid", "p", 0, "Explain rules for the running process with this pid")
+	root.AddCommand(clean, run, quickRun, reload, status, validate, explain, move, releaseCmd, freeze, thaw)
 	if err := root.Execute(); err != nil {
 		os.Exit(2)
 	}
@@ -9,12 +9,15 @@ require (
 	github.com/go-ole/go-ole v1.2.5 // indirect
 	github.com/heetch/confita v0.10.0
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
-	github.com/opencontainers/runtime-spec v1.0.2
+	github.com/opencontainers/runtime-spec v1.1.0
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
 	github.com/sevlyar/go-daemon v0.1.5
 	github.com/shirou/gopsutil v3.21.5+incompatible
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/pflag v1.0.5
 	github.com/tklauser/go-sysconf v0.3.6 // indirect
 	go.uber.org/zap v1.10.0
+	golang.org/x/sys v0.0.0-20210316164454-77fc1eacc6aa
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
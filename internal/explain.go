@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/shirou/gopsutil/process"
+
+	"github.com/juan-leon/fetter/pkg/explain"
+	"github.com/juan-leon/fetter/pkg/filter"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+// Explain implements the explain subcommand: it prints which rules would
+// match the execution of path or, if pid is not zero, the running process
+// with that pid.
+func Explain(configFile string, path string, pid int) {
+	config := loadConfig(configFile)
+	var p *filter.Process
+	if pid != 0 {
+		proc, err := process.NewProcess(int32(pid))
+		if err != nil {
+			log.Console.Fatalf("Could not find process %d: %s", pid, err)
+		}
+		if path, err = proc.Exe(); err != nil {
+			log.Console.Fatalf("Could not read executable of process %d: %s", pid, err)
+		}
+		if p, err = filter.LoadProcess(pid); err != nil {
+			log.Console.Fatalf("Could not read details of process %d: %s", pid, err)
+		}
+	} else if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		// Fetter sees the executable the kernel runs, not the symlink
+		path = resolved
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	fmt.Printf("Rules for %s (%s mode):\n\n", path, config.Mode)
+	verdicts := explain.Rules(config, path, p)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tMATCH\tREASON")
+	for _, v := range verdicts {
+		match := "no"
+		if v.Matched {
+			match = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", v.Rule, match, v.Reason)
+	}
+	w.Flush()
+	fmt.Println()
+	printWinner(config, explain.Winner(verdicts))
+}
+
+func printWinner(config *settings.Settings, rule string) {
+	if rule == "" {
+		fmt.Println("No rule matches")
+		return
+	}
+	group, trigger := config.GetGroup(rule), config.GetTrigger(rule)
+	if config.Mode == settings.RunModeScanner {
+		trigger = ""
+	}
+	fmt.Printf("Rule %s wins:", rule)
+	if group != "" {
+		fmt.Printf(" move to group %s", group)
+		if config.GetScope(rule) == settings.ScopeTree {
+			fmt.Print(" (along with its process tree)")
+		}
+	}
+	if trigger != "" {
+		if group != "" {
+			fmt.Print(",")
+		}
+		fmt.Printf(" run trigger %s", trigger)
+	}
+	if !config.Enforced(rule) {
+		fmt.Print(" (not enforced: dry run)")
+	}
+	fmt.Println()
+}
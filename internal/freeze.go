@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/juan-leon/fetter/pkg/log"
+)
+
+// Freeze implements the freeze subcommand, and the thaw one when freeze is
+// false.  The resulting freezer state of the group is printed.
+func Freeze(configFile string, group string, freeze bool) {
+	config := loadConfig(configFile)
+	log.InitFileLogger(config.Logging)
+	groups := loadGroups(config)
+	change := groups.Thaw
+	if freeze {
+		change = groups.Freeze
+	}
+	if err := change(group); err != nil {
+		log.Console.Fatalf("Could not change freezer state of %s: %s", group, err)
+	}
+	frozen, err := groups.Frozen(group)
+	if err != nil {
+		log.Console.Fatalf("Could not read freezer state of %s: %s", group, err)
+	}
+	if frozen {
+		fmt.Printf("%s is frozen\n", group)
+	} else {
+		fmt.Printf("%s is thawed\n", group)
+	}
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"github.com/shirou/gopsutil/process"
+
+	"github.com/juan-leon/fetter/pkg/cgroups"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+// Move implements the move subcommand: it moves a process (and its
+// descendants, if tree is true) to a control group, by hand
+func Move(configFile string, pid int, group string, tree bool) {
+	config := loadConfig(configFile)
+	log.InitFileLogger(config.Logging)
+	assertPid(pid)
+	if err := config.AssertGroup(group); err != nil {
+		log.Console.Fatalf("Could not move process %d: %s", pid, err)
+	}
+	groups := loadGroups(config)
+	move := groups.Move
+	if tree {
+		move = groups.MoveTree
+	}
+	if err := move(pid, group); err != nil {
+		log.Console.Fatalf("Could not move process %d to %s: %s", pid, group, err)
+	}
+}
+
+// Release implements the release subcommand: it moves a process back to the
+// control group it was in before fetter moved it (or to the root one)
+func Release(configFile string, pid int) {
+	config := loadConfig(configFile)
+	log.InitFileLogger(config.Logging)
+	assertPid(pid)
+	if err := loadGroups(config).Release(pid); err != nil {
+		log.Console.Fatalf("Could not release process %d: %s", pid, err)
+	}
+}
+
+// loadGroups loads the control groups set up by the fetter process running,
+// leaving them as they are
+func loadGroups(config *settings.Settings) *cgroups.GroupHierarchy {
+	groups, err := cgroups.LoadGroupHierarchy(config)
+	if err != nil {
+		log.Console.Fatalf("Could not load control groups (is fetter running?): %s", err)
+	}
+	return groups
+}
+
+func assertPid(pid int) {
+	if exists, _ := process.PidExists(int32(pid)); !exists {
+		log.Console.Fatalf("No process with pid %d", pid)
+	}
+}
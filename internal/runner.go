@@ -1,30 +1,68 @@
 package internal
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sevlyar/go-daemon"
 
 	"github.com/juan-leon/fetter/pkg/audit"
 	"github.com/juan-leon/fetter/pkg/cgroups"
+	"github.com/juan-leon/fetter/pkg/connector"
+	"github.com/juan-leon/fetter/pkg/control"
+	"github.com/juan-leon/fetter/pkg/history"
 	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/metrics"
+	"github.com/juan-leon/fetter/pkg/policy"
 	"github.com/juan-leon/fetter/pkg/scanner"
 	"github.com/juan-leon/fetter/pkg/settings"
 	"github.com/juan-leon/fetter/pkg/triggers"
 )
 
-// Loop implements the run subcommand.  This command never returns, unless
-// daemonize is true (the parent process will return, but the child will enter
-// in same loop)
+const pidFile = "/run/fetter.pid"
+
+// How many matches are kept for being queried through the control socket
+const historySize = 100
+
+// How often instances of template groups are checked for being empty
+const collectInterval = time.Minute
+
+// reloader is implemented by those components that can apply a new
+// configuration without restarting
+type reloader interface {
+	Reload(config *settings.Settings)
+}
+
+// configReloader reloads the configuration file, applying it to components,
+// in order
+type configReloader struct {
+	mu         sync.Mutex
+	configFile string
+	config     *settings.Settings
+	components []reloader
+}
+
+// Loop implements the run subcommand.  This command returns when a SIGTERM or
+// SIGINT is received, or when daemonize is true (the parent process will
+// return, but the child will enter in same loop).  If release is true,
+// processes are released from control groups before returning.  If dryRun is
+// true, matches are logged but not acted on.
 func Loop(
 	configFile string,
 	daemonize bool,
 	scan bool,
+	release bool,
+	dryRun bool,
 ) {
 	config := loadConfig(configFile)
+	config.DryRun = dryRun
 	if daemonize {
 		cntxt := &daemon.Context{
-			PidFileName: "/run/fetter.pid",
+			PidFileName: pidFile,
 		}
 		child, err := cntxt.Reborn()
 		if err != nil {
@@ -37,28 +75,214 @@ func Loop(
 		defer cntxt.Release()
 	}
 	log.InitFileLogger(config.Logging)
-	log.Logger.Infof("Initializing Control Groups...")
-	groups := cgroups.NewGroupHierarchy(config)
-	if config.Mode == settings.RunModeScanner {
+	if dryRun {
+		log.Logger.Infof("Dry run: processes will not be moved, killed or triggered")
+	}
+	groups := newGroups(config)
+	runner := triggers.NewTriggerRunner(config)
+	matches := history.NewHistory(historySize)
+	cr := &configReloader{configFile: configFile, config: config}
+	cr.add(groups, runner)
+	ctx := cancelOnSignal()
+	go collectInstances(ctx, groups)
+	go applySchedules(ctx, groups)
+	go watchMemory(ctx, config, groups, runner)
+	policies := policy.NewPolicyEngine(config, groups)
+	cr.add(policies)
+	go policies.Loop(ctx)
+	srv := serveControl(config, groups, matches, cr)
+	metricsSrv := serveMetrics(config, groups)
+	switch config.Mode {
+	case settings.RunModeScanner:
 		log.Logger.Infof("Scanning active processes...")
-		s := scanner.NewProcessScanner(config, groups)
-		s.Loop()
-	} else {
+		s := scanner.NewProcessScanner(config, groups, matches)
+		cr.add(s)
+		cr.reloadOnSignal()
+		s.Loop(ctx)
+	case settings.RunModeProcConnector:
+		log.Logger.Infof("Listening for process events...")
+		c := connector.NewProcConnector(config, groups, runner, matches)
+		if c == nil {
+			log.Logger.Fatalf("Could not setup a kernel process connector listener")
+		}
+		if scan {
+			go scanLater(config, groups)
+		}
+		cr.add(c)
+		cr.reloadOnSignal()
+		c.Loop(ctx)
+	default:
 		log.Logger.Infof("Auditing system calls according to rules...")
-		s := audit.NewSysCallListener(config, groups, triggers.NewTriggerRunner(config))
+		s := audit.NewSysCallListener(config, groups, runner, matches)
 		if s == nil {
 			log.Logger.Fatalf("Could not setup a kernel syscall listener")
 		}
 		if scan {
-			go func() {
-				// The sleep here if to avoid (unlikely) race conditions between
-				// receiving audit events and process spawning
-				time.Sleep(time.Second)
-				log.Logger.Infof("Scanning already active processes...")
-				scanner.NewProcessScanner(config, groups).Scan()
-			}()
+			go scanLater(config, groups)
 		}
-		s.Loop()
+		cr.add(s)
+		cr.reloadOnSignal()
+		s.Loop(ctx)
+	}
+	if srv != nil {
+		srv.Close()
+	}
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+	if release && dryRun {
+		log.Logger.Infof("Dry run: processes are not released from Control Groups")
+	} else if release {
+		log.Logger.Infof("Releasing processes from Control Groups...")
+		groups.ReleaseAll()
+	}
+	log.Logger.Infof("Exiting")
+	log.Logger.Sync()
+}
+
+// serveControl starts serving the control socket, unless disabled
+func serveControl(config *settings.Settings, groups *cgroups.GroupHierarchy, matches *history.History, cr *configReloader) *control.Server {
+	if config.Control.Socket == "" {
+		return nil
+	}
+	srv := control.NewServer(config, groups, matches, cr.reload)
+	if srv == nil {
+		log.Logger.Warnf("Running without control socket")
+		return nil
+	}
+	cr.add(srv)
+	go srv.Serve()
+	return srv
+}
+
+// serveMetrics starts serving metrics, if configured
+func serveMetrics(config *settings.Settings, groups *cgroups.GroupHierarchy) *metrics.Server {
+	if config.Metrics.Address == "" {
+		return nil
+	}
+	srv := metrics.NewServer(config, groups.Collector())
+	if srv == nil {
+		log.Logger.Warnf("Running without metrics endpoint")
+		return nil
+	}
+	go srv.Serve()
+	return srv
+}
+
+// cancelOnSignal returns a context that is cancelled when a SIGTERM or SIGINT
+// is received.  A second signal makes the program exit right away.
+func cancelOnSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Logger.Infof("Received %s; shutting down...", sig)
+		cancel()
+		sig = <-signals
+		log.Logger.Warnf("Received %s again; exiting right away", sig)
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+func (cr *configReloader) add(components ...reloader) {
+	cr.mu.Lock()
+	cr.components = append(cr.components, components...)
+	cr.mu.Unlock()
+}
+
+// reload reloads configuration file, applying it to components.  On
+// configuration errors, current configuration is kept.
+func (cr *configReloader) reload() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	log.Logger.Infof("Reloading configuration...")
+	config, ignored, err := settings.Reload(cr.configFile, cr.config)
+	if err != nil {
+		log.Logger.Errorf("Could not reload config; keeping current one: %s", err)
+		return err
+	}
+	if len(ignored) > 0 {
+		log.Logger.Warnf("Changes in %s require a restart; ignoring them", ignored)
+	}
+	for _, c := range cr.components {
+		c.Reload(config)
+	}
+	cr.config = config
+	log.Logger.Infof("Configuration reloaded")
+	return nil
+}
+
+// reloadOnSignal reloads configuration file whenever a SIGHUP is received
+func (cr *configReloader) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			cr.reload()
+		}
+	}()
+}
+
+// Reload implements the reload subcommand
+func Reload() {
+	cntxt := &daemon.Context{
+		PidFileName: pidFile,
+	}
+	d, err := cntxt.Search()
+	if err != nil {
+		log.Console.Fatalf("Could not find a running daemon: %s", err)
+	}
+	if err := d.Signal(syscall.SIGHUP); err != nil {
+		log.Console.Fatalf("Could not signal daemon with pid %d: %s", d.Pid, err)
+	}
+	log.Console.Infof("Asked daemon with pid %d to reload its configuration", d.Pid)
+}
+
+func scanLater(config *settings.Settings, groups *cgroups.GroupHierarchy) {
+	// The sleep here if to avoid (unlikely) race conditions between receiving
+	// kernel events and process spawning
+	time.Sleep(time.Second)
+	log.Logger.Infof("Scanning already active processes...")
+	scanner.NewProcessScanner(config, groups, nil).Scan()
+}
+
+// collectInstances deletes empty instances of template groups every now and
+// then, until ctx is cancelled
+func collectInstances(ctx context.Context, groups *cgroups.GroupHierarchy) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(collectInterval):
+			groups.CollectInstances()
+		}
+	}
+}
+
+// applySchedules applies the schedules of groups at the start of every minute
+// (schedules go by minutes), until ctx is cancelled
+func applySchedules(ctx context.Context, groups *cgroups.GroupHierarchy) {
+	for {
+		now := time.Now()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+			groups.ApplySchedules()
+		}
+	}
+}
+
+// watchMemory watches memory events and pressure of control groups, running
+// the triggers configured for them (unless in dry run), until ctx is
+// cancelled
+func watchMemory(ctx context.Context, config *settings.Settings, groups *cgroups.GroupHierarchy, runner *triggers.TriggerRunner) {
+	if config.DryRun {
+		groups.WatchMemory(ctx, triggers.DryRun{})
+	} else {
+		groups.WatchMemory(ctx, runner)
 	}
 }
 
@@ -69,14 +293,30 @@ func Clean(configFile string) {
 	cgroups.DeleteGroupHierarchy(config)
 }
 
-// Scan implements the quick-run subcommand
-func Scan(configFile string) {
+// Scan implements the quick-run subcommand.  If dryRun is true, matches are
+// logged but not acted on.
+func Scan(configFile string, dryRun bool) {
 	config := loadConfig(configFile)
+	config.DryRun = dryRun
 	log.InitFileLogger(config.Logging)
-	log.Logger.Infof("Initializing Control Groups...")
-	groups := cgroups.NewGroupHierarchy(config)
+	groups := newGroups(config)
 	log.Logger.Infof("Scanning active processes...")
-	scanner.NewProcessScanner(config, groups).Scan()
+	scanner.NewProcessScanner(config, groups, nil).Scan()
+}
+
+// newGroups initializes the control groups, or just loads them as they are in
+// dry run
+func newGroups(config *settings.Settings) *cgroups.GroupHierarchy {
+	if !config.DryRun {
+		log.Logger.Infof("Initializing Control Groups...")
+		return cgroups.NewGroupHierarchy(config)
+	}
+	log.Logger.Infof("Dry run: loading Control Groups as they are")
+	groups, err := cgroups.LoadGroupHierarchy(config)
+	if err != nil {
+		log.Logger.Warnf("Control Groups are not set up; status and metrics will be empty")
+	}
+	return groups
 }
 
 func loadConfig(configFile string) (config *settings.Settings) {
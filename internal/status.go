@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+
+	"github.com/juan-leon/fetter/pkg/cgroups"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+// member is a process in a control group, as shown by the status subcommand
+type member struct {
+	Pid int    `json:"pid"`
+	Exe string `json:"exe,omitempty"`
+}
+
+// groupStatus is the status of a control group, as shown by the status
+// subcommand
+type groupStatus struct {
+	Limits  settings.Group `json:"limits"`
+	Usage   *cgroups.Usage `json:"usage,omitempty"`
+	Members []member       `json:"members"`
+}
+
+// Status implements the status subcommand
+func Status(configFile string, asJSON bool) {
+	config := loadConfig(configFile)
+	log.InitFileLogger(config.Logging)
+	status, err := cgroups.LoadStatus(config)
+	if err != nil {
+		log.Console.Fatalf("Could not load control groups (is fetter running?): %s", err)
+	}
+	groups := make(map[string]groupStatus)
+	for name, s := range status {
+		groups[name] = groupStatus{Limits: s.Limits, Usage: s.Usage, Members: members(s.Members)}
+	}
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(groups)
+		return
+	}
+	printStatus(groups)
+}
+
+func members(pids []int) []member {
+	members := make([]member, 0, len(pids))
+	for _, pid := range pids {
+		m := member{Pid: pid}
+		if p, err := process.NewProcess(int32(pid)); err == nil {
+			m.Exe, _ = p.Exe()
+		}
+		members = append(members, m)
+	}
+	return members
+}
+
+func printStatus(groups map[string]groupStatus) {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tLIMITS\tMEMORY\tCPU TIME\tPIDS\tFROZEN")
+	for _, name := range names {
+		g := groups[name]
+		memory, cpu, pids, frozen := "-", "-", "-", "-"
+		if u := g.Usage; u != nil {
+			memory = fmt.Sprintf("%dMB", u.Memory/1024/1024)
+			cpu = time.Duration(u.CPU).Round(time.Millisecond).String()
+			pids = fmt.Sprint(u.Pids)
+			frozen = fmt.Sprint(u.Frozen)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", name, formatLimits(g.Limits), memory, cpu, pids, frozen)
+		for _, m := range g.Members {
+			fmt.Fprintf(w, "  %d\t%s\t\t\t\t\n", m.Pid, m.Exe)
+		}
+	}
+	w.Flush()
+}
+
+func formatLimits(g settings.Group) string {
+	var limits []string
+	if g.RAM > 0 {
+		limits = append(limits, fmt.Sprintf("ram=%s", g.RAM))
+	}
+	for _, size := range []struct {
+		key  string
+		size settings.Size
+	}{{"ram_soft", g.RAMSoft}, {"ram_high", g.RAMHigh}, {"swap", g.Swap}} {
+		if size.size > 0 {
+			limits = append(limits, fmt.Sprintf("%s=%s", size.key, size.size))
+		}
+	}
+	if g.CPU > 0 {
+		limits = append(limits, fmt.Sprintf("cpu=%s", g.CPU))
+	}
+	if g.CPUWeight > 0 {
+		limits = append(limits, fmt.Sprintf("cpu_weight=%d", g.CPUWeight))
+	}
+	if g.CPUs != "" {
+		limits = append(limits, "cpus="+g.CPUs)
+	}
+	if g.Mems != "" {
+		limits = append(limits, "mems="+g.Mems)
+	}
+	if g.Pids > 0 {
+		limits = append(limits, fmt.Sprintf("pids=%d", g.Pids))
+	}
+	if g.IOWeight > 0 {
+		limits = append(limits, fmt.Sprintf("io_weight=%d", g.IOWeight))
+	}
+	devices := make([]string, 0, len(g.IO))
+	for device := range g.IO {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		limits = append(limits, "io="+device)
+	}
+	if g.OOMKillDisable {
+		limits = append(limits, "oom_kill_disable")
+	}
+	if g.OOMGroup {
+		limits = append(limits, "oom_group")
+	}
+	if g.Freeze {
+		limits = append(limits, "freeze")
+	}
+	if g.Template {
+		limits = append(limits, "template")
+	}
+	if len(limits) == 0 {
+		return "-"
+	}
+	return strings.Join(limits, ",")
+}
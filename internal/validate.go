@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+// Validate implements the validate subcommand.  It exits with non-zero status
+// if there are errors (warnings alone are fine).
+func Validate(configFile string) {
+	problems, err := settings.Validate(configFile)
+	if err != nil {
+		log.Console.Fatalf("Could not read config: %s", err)
+	}
+	errors := 0
+	for _, p := range problems {
+		if p.Line > 0 {
+			fmt.Printf("%s:%d:%d: %s\n", configFile, p.Line, p.Column, p)
+		} else {
+			fmt.Printf("%s: %s\n", configFile, p)
+		}
+		if !p.Warning {
+			errors++
+		}
+	}
+	if errors > 0 {
+		fmt.Printf("%d errors, %d warnings\n", errors, len(problems)-errors)
+		os.Exit(1)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%s is valid, with %d warnings\n", configFile, len(problems))
+		return
+	}
+	fmt.Printf("%s is valid\n", configFile)
+}
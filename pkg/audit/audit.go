@@ -1,10 +1,11 @@
 package audit
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -15,7 +16,13 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/juan-leon/fetter/pkg/cgroups"
+	"github.com/juan-leon/fetter/pkg/filter"
+	"github.com/juan-leon/fetter/pkg/history"
+	"github.com/juan-leon/fetter/pkg/ids"
 	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/match"
+	"github.com/juan-leon/fetter/pkg/metrics"
+	"github.com/juan-leon/fetter/pkg/pattern"
 	"github.com/juan-leon/fetter/pkg/settings"
 	"github.com/juan-leon/fetter/pkg/triggers"
 )
@@ -26,27 +33,46 @@ const (
 )
 
 const (
-	modeReuse    string = "reuse"
-	modeOverride string = "override"
-	modePreserve string = "preserve"
+	modeReuse    = settings.AuditModeReuse
+	modeOverride = settings.AuditModeOverride
+	modePreserve = settings.AuditModePreserve
 )
 
+// Events not completed by an EOE record in time are processed anyway
 const (
-	syscallRead    string = "read"
-	syscallExecute string = "execute"
-	syscallWrite   string = "write"
+	reassemblerSize    = 64
+	reassemblerTimeout = 2 * time.Second
+)
+
+const (
+	syscallRead    = settings.ActionRead
+	syscallExecute = settings.ActionExecute
+	syscallWrite   = settings.ActionWrite
 )
 
 // SysCallListener instances can declare and listen for audit events.
 type SysCallListener struct {
+	mu         sync.RWMutex
 	config     *settings.Settings
 	client     *libaudit.AuditClient
+	paths      map[string]pattern.Paths // by rule name
+	filters    filter.Filters
 	procMover  cgroups.ProcessMover
 	procRunner triggers.ProcessRunner
+	matches    *history.History
+	rulesMu    sync.Mutex        // serializes changes to audit rules
+	installed  map[string]string // audit rules added, mapped to their rule
+}
+
+// ruleClient is what changing audit rules needs from an audit client
+// (implemented by libaudit.AuditClient)
+type ruleClient interface {
+	AddRule(rule []byte) error
+	DeleteRule(rule []byte) error
 }
 
 // NewSysCallListener creates and initializes a SysCallListener instance
-func NewSysCallListener(config *settings.Settings, procMover cgroups.ProcessMover, procRunner triggers.ProcessRunner) *SysCallListener {
+func NewSysCallListener(config *settings.Settings, procMover cgroups.ProcessMover, procRunner triggers.ProcessRunner, matches *history.History) *SysCallListener {
 	if !assertAuditMode(config.Audit.Mode) {
 		log.Logger.Errorf("unknown config for audit.mode: %s", config.Audit.Mode)
 		return nil
@@ -60,22 +86,36 @@ func NewSysCallListener(config *settings.Settings, procMover cgroups.ProcessMove
 	return &SysCallListener{
 		client:     client,
 		config:     config,
+		paths:      rulePaths(config),
+		filters:    filter.NewFilters(config),
 		procMover:  procMover,
 		procRunner: procRunner,
+		matches:    matches,
+		installed:  make(map[string]string),
 	}
 }
 
-// Loop listen for audit events from kernel and act accordlingly.  This method never returns.
-func (scl *SysCallListener) Loop() {
-	defer closeAuditClient(scl.client)
+// Loop listen for audit events from kernel and act accordlingly, until ctx is
+// cancelled.  Then, unless in reuse audit mode, audit rules added by fetter
+// are deleted.
+func (scl *SysCallListener) Loop(ctx context.Context) {
 	scl.configure()
-	log.Logger.Debugw("Forever snooping syscalls")
-	scl.loop()
+	log.Logger.Debugw("Snooping syscalls until cancelled")
+	// Receiving is a blocking call that closing the client does not interrupt,
+	// so it is done in background.
+	go scl.loop(ctx)
+	<-ctx.Done()
+	if auditMode(scl.config) != modeReuse {
+		scl.deleteRules()
+	}
+	closeAuditClient(scl.client)
 }
 
 func (scl *SysCallListener) configure() {
-	if scl.config.Audit.Mode != modeReuse {
+	if auditMode(scl.config) != modeReuse {
 		scl.addRules()
+	} else if scl.config.DryRun {
+		log.Logger.Infof("Dry run: audit rules are not changed; reusing existing ones")
 	} else {
 		log.Logger.Infof("Reusing existing audit rules")
 	}
@@ -131,43 +171,238 @@ func (scl *SysCallListener) addRules() error {
 		log.Logger.Infof("Deleted %d pre-existing audit rules.", n)
 	}
 
+	scl.rulesMu.Lock()
+	defer scl.rulesMu.Unlock()
 	for name, r := range scl.config.Rules {
 		scl.addRule(name, r, client)
 	}
 	return nil
 }
 
-func (scl *SysCallListener) addRule(name string, r settings.Rule, client *libaudit.AuditClient) {
+func (scl *SysCallListener) addRule(name string, r settings.Rule, client ruleClient) {
 	if err := validateRule(r); err != nil {
 		log.Logger.Errorw("Failed to validate rule", "rule", r, "error", err.Error())
 		return
 	}
-	for _, path := range r.Paths {
-		asString := asAuditFmt(name, path, r.Action)
-		parsedRule, err := flags.Parse(asString)
-		if err != nil {
-			log.Logger.Errorw("Failed to parse rule", "rule", r, "error", err.Error())
+	for _, text := range ruleTexts(name, r) {
+		if err := addAuditRule(name, text, client); err != nil {
 			return
 		}
+		scl.installed[text] = name
+	}
+}
 
-		ruleData, err := rule.Build(parsedRule)
+// ruleTexts returns the audit rules (in auditctl format) for a rule.  Rules
+// with credential filters become syscall rules, so that the kernel does the
+// filtering; there is one audit rule per combination of user, group and login
+// uid, since fields of an audit rule must all match.
+func ruleTexts(name string, r settings.Rule) (texts []string) {
+	paths := watches(name, r)
+	if len(r.Users) == 0 && len(r.Groups) == 0 && len(r.ExcludeUsers) == 0 && len(r.Auid) == 0 {
+		for _, path := range paths {
+			texts = append(texts, asAuditFmt(name, path, r.Action))
+		}
+		return
+	}
+	users, errU := ids.UIDs(r.Users)
+	groups, errG := ids.GIDs(r.Groups)
+	excluded, errE := ids.UIDs(r.ExcludeUsers)
+	auids, errA := ids.UIDs(r.Auid)
+	for _, err := range []error{errU, errG, errE, errA} {
 		if err != nil {
-			log.Logger.Errorw("Failed to build rule", "rule", r, "error", err.Error())
-			return
+			log.Logger.Errorw("Failed to resolve credentials", "rule", name, "error", err.Error())
+			return nil
+		}
+	}
+	var excludes []string
+	for _, uid := range excluded {
+		excludes = append(excludes, fmt.Sprintf("-F uid!=%d", uid))
+	}
+	filters := []string{strings.Join(excludes, " ")}
+	filters = combine(filters, "uid", users)
+	filters = combine(filters, "gid", groups)
+	filters = combine(filters, "auid", auids)
+	for _, path := range paths {
+		for _, f := range filters {
+			texts = append(texts, asSyscallFmt(name, path, r.Action, f))
 		}
+	}
+	return
+}
 
-		err = client.AddRule([]byte(ruleData))
+// combine returns the result of adding to each of filters a field check for
+// each of values.  No values means no check at all.
+func combine(filters []string, field string, values []uint32) []string {
+	if len(values) == 0 {
+		return filters
+	}
+	result := make([]string, 0, len(filters)*len(values))
+	for _, f := range filters {
+		for _, v := range values {
+			result = append(result, strings.TrimSpace(fmt.Sprintf("%s -F %s=%d", f, field, v)))
+		}
+	}
+	return result
+}
+
+// watches returns the paths to watch for a rule.  Globs are expanded to the
+// paths existing right now (so a reload is needed for catching new ones), and
+// regular expressions are turned into the directory their matches are under.
+func watches(name string, r settings.Rule) (paths []string) {
+	for _, path := range r.Paths {
+		p, err := pattern.New(path)
 		if err != nil {
-			log.Logger.Errorw("Failed to add rule", "rule", r, "error", err.Error())
-			return
+			log.Logger.Errorw("Failed to parse path", "rule", name, "path", path, "error", err.Error())
+			continue
+		}
+		expanded, err := p.Watches()
+		if err != nil {
+			log.Logger.Errorw("Failed to expand path", "rule", name, "path", path, "error", err.Error())
+			continue
 		}
-		log.Logger.Debugw("Added path for rule", "path", path, "rule", r)
+		if len(expanded) == 0 {
+			log.Logger.Warnw("No file matches path", "rule", name, "path", path)
+		}
+		paths = append(paths, expanded...)
+	}
+	return
+}
+
+func addAuditRule(name, text string, client ruleClient) error {
+	ruleData, err := buildRule(text)
+	if err != nil {
+		log.Logger.Errorw("Failed to build rule", "rule", name, "audit-rule", text, "error", err.Error())
+		return err
+	}
+	if err := client.AddRule(ruleData); err != nil {
+		log.Logger.Errorw("Failed to add rule", "rule", name, "audit-rule", text, "error", err.Error())
+		return err
 	}
+	log.Logger.Debugw("Added audit rule", "rule", name, "audit-rule", text)
+	return nil
+}
+
+func deleteAuditRule(name, text string, client ruleClient) error {
+	ruleData, err := buildRule(text)
+	if err != nil {
+		log.Logger.Errorw("Failed to build rule", "rule", name, "audit-rule", text, "error", err.Error())
+		return err
+	}
+	if err := client.DeleteRule(ruleData); err != nil {
+		log.Logger.Warnw("Failed to delete rule", "rule", name, "audit-rule", text, "error", err.Error())
+		return err
+	}
+	log.Logger.Debugw("Deleted audit rule", "rule", name, "audit-rule", text)
+	return nil
+}
+
+// deleteRules deletes every audit rule tagged by fetter, leaving alone rules
+// added by others
+func (scl *SysCallListener) deleteRules() error {
+	client, err := libaudit.NewAuditClient(nil)
+	if err != nil {
+		log.Logger.Errorf("failed to create audit client: %s", err)
+		return err
+	}
+	defer closeAuditClient(client)
+	rules, err := client.GetRules()
+	if err != nil {
+		log.Logger.Errorf("Failed to get existing rules: %s", err)
+		return err
+	}
+	n := 0
+	for _, ruleData := range rules {
+		text, err := rule.ToCommandLine(rule.WireFormat(ruleData), false)
+		if err != nil || !isFetterRule(text) {
+			continue
+		}
+		if err := client.DeleteRule(ruleData); err != nil {
+			log.Logger.Warnw("Failed to delete rule", "audit-rule", text, "error", err.Error())
+			continue
+		}
+		n++
+	}
+	log.Logger.Infof("Deleted %d fetter audit rules.", n)
+	return nil
+}
+
+// auditRules returns the audit rules (in auditctl format) needed for the valid
+// rules of config, mapped to the name of the rule they belong to.
+func auditRules(config *settings.Settings) map[string]string {
+	result := make(map[string]string)
+	for name, r := range config.Rules {
+		if validateRule(r) != nil {
+			continue
+		}
+		for _, text := range ruleTexts(name, r) {
+			result[text] = name
+		}
+	}
+	return result
+}
+
+// Reload applies the rules of a new configuration.  Unless in reuse audit
+// mode, audit rules no longer needed are deleted and new ones are added (see
+// syncRules).  Audit rules that did not change are left alone, so there is no
+// window for events to go unnoticed.
+func (scl *SysCallListener) Reload(config *settings.Settings) {
+	paths, filters := rulePaths(config), filter.NewFilters(config)
+	scl.mu.Lock()
+	scl.config = config
+	scl.paths = paths
+	scl.filters = filters
+	scl.mu.Unlock()
+	if auditMode(config) == modeReuse {
+		return
+	}
+	client, err := libaudit.NewAuditClient(nil)
+	if err != nil {
+		log.Logger.Errorf("failed to create audit client: %s", err)
+		return
+	}
+	defer closeAuditClient(client)
+	scl.syncRules(config, client)
 }
 
-func (scl *SysCallListener) loop() {
+// syncRules brings the audit rules added so far in line with those config
+// needs: the ones no longer needed are deleted, and the missing ones are
+// added.  Globs are expanded again, so files matching them since the audit
+// rules were added are watched from now on, and files gone are no longer.
+func (scl *SysCallListener) syncRules(config *settings.Settings, client ruleClient) {
+	scl.rulesMu.Lock()
+	defer scl.rulesMu.Unlock()
+	needed := auditRules(config)
+	for text, name := range scl.installed {
+		if _, ok := needed[text]; ok {
+			continue
+		}
+		// Kept on failure, for trying again on next reload
+		if deleteAuditRule(name, text, client) == nil {
+			delete(scl.installed, text)
+		}
+	}
+	for text, name := range needed {
+		if _, ok := scl.installed[text]; ok {
+			continue
+		}
+		if addAuditRule(name, text, client) == nil {
+			scl.installed[text] = name
+		}
+	}
+}
+
+func (scl *SysCallListener) loop(ctx context.Context) {
+	reassembler, err := libaudit.NewReassembler(reassemblerSize, reassemblerTimeout, stream{scl})
+	if err != nil {
+		log.Logger.Fatalf("Could not create audit reassembler: %s", err)
+	}
+	defer reassembler.Close()
+	go maintain(ctx, reassembler)
 	for {
 		auditMsg, err := scl.client.Receive(false)
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			if errors.Cause(err) == syscall.EBADF {
 				log.Logger.Warn("Audit client has been closed")
@@ -176,55 +411,157 @@ func (scl *SysCallListener) loop() {
 			log.Logger.Warn("Error listening kernel events: %s", err)
 			continue
 		}
-		if auditMsg.Type != auparse.AUDIT_SYSCALL {
-			// We are interested in SYSCALL events only (as those include
-			// execution, read and write, and are triggered bebore process is
-			// ended).
+		if !correlated(auditMsg.Type) {
 			continue
 		}
-		log.Logger.Debugw("Received syscall event", "raw-syscall", string(auditMsg.Data))
+		if auditMsg.Type == auparse.AUDIT_SYSCALL {
+			log.Logger.Debugw("Received syscall event", "raw-syscall", string(auditMsg.Data))
+			metrics.AuditEvents.Inc()
+		}
+		if err := reassembler.Push(auditMsg.Type, auditMsg.Data); err != nil {
+			log.Logger.Errorw("Error parsing msg", "raw-msg", string(auditMsg.Data), "error", err)
+			metrics.ParseErrors.Inc()
+		}
+	}
+}
 
-		msg, err := auparse.Parse(auditMsg.Type, string(auditMsg.Data))
-		if err != nil {
-			log.Logger.Errorw("Error parsing msg", "raw-syscall", string(auditMsg.Data))
-			continue
+// correlated tells whether records of a type are part of the events fetter is
+// interested in: syscalls (execution, read and write, reported before the
+// process is ended) and the records that come along with them.
+func correlated(typ auparse.AuditMessageType) bool {
+	switch typ {
+	case auparse.AUDIT_SYSCALL, auparse.AUDIT_EXECVE, auparse.AUDIT_CWD,
+		auparse.AUDIT_PATH, auparse.AUDIT_PROCTITLE, auparse.AUDIT_EOE:
+		return true
+	default:
+		return false
+	}
+}
+
+// maintain makes the reassembler give up on incomplete events every now and
+// then, until ctx is cancelled
+func maintain(ctx context.Context, reassembler *libaudit.Reassembler) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reassemblerTimeout / 2):
+			if reassembler.Maintain() != nil {
+				return
+			}
 		}
-		scl.processMessage(msg)
 	}
 }
 
-func (scl *SysCallListener) processMessage(msg *auparse.AuditMessage) {
-	// For auparse, key is a tag and is not present in 'Data'
-	tags, err := msg.Tags()
+// stream receives the events put together by the reassembler
+type stream struct {
+	scl *SysCallListener
+}
+
+func (s stream) ReassemblyComplete(msgs []*auparse.AuditMessage) {
+	e, err := newEvent(msgs)
 	if err != nil {
-		log.Logger.Errorf("Could not parse tags from message: %s", err)
+		log.Logger.Debugw("Ignoring audit event", "error", err)
 		return
 	}
-	for _, tagValue := range tags {
-		if strings.HasPrefix(tagValue, cgPrefix) {
-			data, err := msg.Data()
-			if err != nil {
-				log.Logger.Errorf("Could not extract data from message: %s", err)
-				return
-			}
-			pid, err := strconv.Atoi(data["pid"])
-			if err != nil {
-				log.Logger.Fatalf("Got a non-numeric pid %s: %s", data["pid"], err)
-			}
-			scl.processMatch(pid, tagValue[len(cgPrefix):], &data)
+	s.scl.processEvent(e)
+}
+
+func (s stream) EventsLost(count int) {
+	log.Logger.Warnf("Lost %d audit events", count)
+	metrics.LostEvents.Add(float64(count))
+}
+
+func (scl *SysCallListener) processEvent(e *event) {
+	reported := e.rule()
+	if reported == "" {
+		return
+	}
+	for _, rule := range scl.candidates(reported, e) {
+		if scl.matchesFilters(rule, e) {
+			scl.processMatch(rule, e)
 			return
 		}
+		log.Logger.Debugw("Process does not match rule filters", "rule", rule, "pid", e.pid)
+	}
+}
+
+// candidates returns the rules an event can be about, in order.  The kernel
+// reports the key of the first audit rule matching only, so any rule with the
+// same action whose paths cover the event is a candidate.
+func (scl *SysCallListener) candidates(reported string, e *event) (rules []string) {
+	scl.mu.RLock()
+	defer scl.mu.RUnlock()
+	action := scl.config.Rules[reported].Action
+	for _, name := range scl.config.RuleNames() {
+		if scl.config.Rules[name].Action != action {
+			continue
+		}
+		if scl.covers(name, e, name == reported) {
+			rules = append(rules, name)
+		} else {
+			log.Logger.Debugw("Paths of rule do not cover event", "rule", name, "exe", e.exe(), "paths", e.paths)
+		}
+	}
+	return
+}
+
+func (scl *SysCallListener) processMatch(rule string, e *event) {
+	data := e.data()
+	scl.mu.RLock()
+	defer scl.mu.RUnlock()
+	match.Apply(scl.config, rule, e.pid, &data, scl.procMover, scl.procRunner, scl.matches)
+}
+
+// covers tells whether the paths of rule cover the file an event is about.
+// For the rule reported, the kernel tells already, unless it has regular
+// expressions: their watches cover whole directories.
+func (scl *SysCallListener) covers(rule string, e *event, reported bool) bool {
+	paths := scl.paths[rule]
+	regex := false
+	for _, p := range paths {
+		regex = regex || p.IsRegex()
+	}
+	if reported && !regex {
+		return true
+	}
+	for _, file := range e.files(scl.config.Rules[rule].Action) {
+		if _, ok := paths.Cover(file); ok {
+			return true
+		}
 	}
+	return false
 }
 
-func (scl *SysCallListener) processMatch(pid int, rule string, data *map[string]string) {
-	log.Logger.Infof("Match for rule %s in pid %d", rule, pid)
-	if group := scl.config.GetGroup(rule); group != "" {
-		scl.procMover.Move(pid, group)
+// rulePaths returns the paths of every rule of config, by rule name
+func rulePaths(config *settings.Settings) map[string]pattern.Paths {
+	paths := make(map[string]pattern.Paths)
+	for name, r := range config.Rules {
+		// Bad paths are reported when adding audit rules
+		paths[name], _ = pattern.NewPaths(r.Paths)
 	}
-	if trigger := scl.config.GetTrigger(rule); trigger != "" {
-		scl.procRunner.Run(trigger, data)
+	return paths
+}
+
+// matchesFilters tells whether the process causing an event meets the
+// conditions of rule besides paths.  For executions the details come with the
+// event; otherwise the command line is read from the process.
+func (scl *SysCallListener) matchesFilters(rule string, e *event) bool {
+	scl.mu.RLock()
+	defer scl.mu.RUnlock()
+	if len(e.args) == 0 {
+		return scl.filters.Match(rule, e.pid)
+	}
+	return scl.filters.MatchProcess(rule, e.process())
+}
+
+// auditMode returns the audit mode in effect for config.  In dry run, audit
+// rules are left as they are, like in reuse mode.
+func auditMode(config *settings.Settings) string {
+	if config.DryRun {
+		return modeReuse
 	}
+	return config.Audit.Mode
 }
 
 func assertAuditMode(mode string) bool {
@@ -237,15 +574,48 @@ func assertAuditMode(mode string) bool {
 	}
 }
 
-func asAuditFmt(name, path, ruleAction string) string {
-	action := "x"
+// permission returns the audit permission (as in -p flag) for a rule action
+func permission(ruleAction string) string {
 	switch ruleAction {
 	case syscallRead:
-		action = "r"
+		return "r"
 	case syscallWrite:
-		action = "w"
+		return "w"
+	default:
+		return "x"
+	}
+}
+
+func asAuditFmt(name, path, ruleAction string) string {
+	return fmt.Sprintf("-w %s -p %s -k %s%s", path, permission(ruleAction), cgPrefix, name)
+}
+
+// asSyscallFmt returns a syscall audit rule equivalent to the watch rule
+// asAuditFmt returns, plus some extra field checks
+func asSyscallFmt(name, path, ruleAction, fields string) string {
+	field := "path"
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		field = "dir"
+	}
+	return fmt.Sprintf("-a always,exit -F %s=%s -F perm=%s %s -k %s%s", field, path, permission(ruleAction), fields, cgPrefix, name)
+}
+
+func buildRule(text string) ([]byte, error) {
+	parsedRule, err := flags.Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	ruleData, err := rule.Build(parsedRule)
+	if err != nil {
+		return nil, err
 	}
-	return fmt.Sprintf("-w %s -p %s -k %s%s", path, action, cgPrefix, name)
+	return []byte(ruleData), nil
+}
+
+// isFetterRule tells whether an audit rule (in auditctl format) was added by
+// fetter, based on its key
+func isFetterRule(text string) bool {
+	return strings.Contains(text, "-k "+cgPrefix) || strings.Contains(text, "key="+cgPrefix)
 }
 
 func validateRule(r settings.Rule) error {
@@ -264,5 +634,14 @@ func validateRule(r settings.Rule) error {
 	default:
 		return fmt.Errorf("unknown action %s for rule", r.Action)
 	}
+	if r.Action != syscallExecute {
+		// Events for files read or written do not tell the file name, so
+		// those cannot be checked against regular expressions
+		for _, path := range r.Paths {
+			if strings.HasPrefix(path, pattern.RegexPrefix) {
+				return fmt.Errorf("regular expressions are supported for execute actions only")
+			}
+		}
+	}
 	return nil
 }
@@ -1,8 +1,13 @@
 package audit
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
+	"github.com/juan-leon/fetter/pkg/filter"
 	"github.com/juan-leon/fetter/pkg/log"
 	"github.com/juan-leon/fetter/pkg/settings"
 )
@@ -10,6 +15,7 @@ import (
 var rules = map[string]settings.Rule{
 	"r1": {Paths: []string{"none"}, Action: "execute", Trigger: "t1"},
 	"r2": {Paths: []string{"none"}, Action: "read", Group: "g1"},
+	"r3": {Paths: []string{"none"}, Action: "execute", Group: "g1", Scope: "tree"},
 }
 var config = &settings.Settings{
 	Rules: rules,
@@ -17,17 +23,29 @@ var config = &settings.Settings{
 }
 
 type mock struct {
-	moved bool
-	ran   bool
+	moved     bool
+	movedTree bool
+	group     string
+	ran       bool
+	data      map[string]string
 }
 
 func (m *mock) Move(pid int, cgroup string) error {
 	m.moved = true
+	m.group = cgroup
+	return nil
+}
+
+func (m *mock) MoveTree(pid int, cgroup string) error {
+	m.movedTree = true
 	return nil
 }
 
 func (m *mock) Run(name string, data *map[string]string) error {
 	m.ran = true
+	if data != nil {
+		m.data = *data
+	}
 	return nil
 }
 
@@ -56,6 +74,12 @@ func TestValidateRule(t *testing.T) {
 	if validateRule(settings.Rule{Paths: []string{"foo"}, Action: syscallExecute, Group: "foo"}) != nil {
 		t.Error("Rule should pass validation")
 	}
+	if validateRule(settings.Rule{Paths: []string{"re:^/foo/.*"}, Action: syscallRead, Group: "foo"}) == nil {
+		t.Error("Rule should fail validation")
+	}
+	if validateRule(settings.Rule{Paths: []string{"re:^/foo/.*"}, Action: syscallExecute, Group: "foo"}) != nil {
+		t.Error("Rule should pass validation")
+	}
 }
 
 func TestRuleFormat(t *testing.T) {
@@ -76,6 +100,206 @@ func TestRuleFormat(t *testing.T) {
 	}
 }
 
+func TestAuditRules(t *testing.T) {
+	config := &settings.Settings{Rules: map[string]settings.Rule{
+		"r1": {Paths: []string{"/a", "/b"}, Action: "execute", Group: "g1"},
+		"r2": {Paths: []string{"/c"}, Action: "read", Trigger: "t1"},
+		"r3": {Paths: []string{"/d"}, Action: "bad", Trigger: "t1"},
+	}}
+	expected := map[string]string{
+		"-w /a -p x -k fetter_r1": "r1",
+		"-w /b -p x -k fetter_r1": "r1",
+		"-w /c -p r -k fetter_r2": "r2",
+	}
+	if result := auditRules(config); !reflect.DeepEqual(result, expected) {
+		t.Error("Audit rules should be", expected, "instead of", result)
+	}
+}
+
+func TestAuditRulesWithPatterns(t *testing.T) {
+	log.InitLoggerForTests()
+	dir, err := ioutil.TempDir("", "fetter")
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to create dir", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, version := range []string{"1.0", "2.0"} {
+		if err := os.MkdirAll(filepath.Join(dir, version, "bin"), 0755); err != nil {
+			t.Fatal("Test cannot continue; failed to create dir", err)
+		}
+	}
+	config := &settings.Settings{Rules: map[string]settings.Rule{
+		"r1": {Paths: []string{filepath.Join(dir, "*", "bin")}, Action: "execute", Group: "g1"},
+		"r2": {Paths: []string{"re:^/home/[^/]+/\\.cargo/bin/"}, Action: "execute", Group: "g1"},
+		"r3": {Paths: []string{"re:.*java"}, Action: "execute", Group: "g1"},
+	}}
+	expected := map[string]string{
+		"-w " + filepath.Join(dir, "1.0", "bin") + " -p x -k fetter_r1": "r1",
+		"-w " + filepath.Join(dir, "2.0", "bin") + " -p x -k fetter_r1": "r1",
+		"-w /home -p x -k fetter_r2":                                    "r2",
+	}
+	if result := auditRules(config); !reflect.DeepEqual(result, expected) {
+		t.Error("Audit rules should be", expected, "instead of", result)
+	}
+}
+
+// fakeClient counts the audit rules added and deleted
+type fakeClient struct {
+	added, deleted int
+}
+
+func (f *fakeClient) AddRule(rule []byte) error {
+	f.added++
+	return nil
+}
+
+func (f *fakeClient) DeleteRule(rule []byte) error {
+	f.deleted++
+	return nil
+}
+
+func TestSyncRules(t *testing.T) {
+	log.InitLoggerForTests()
+	dir, err := ioutil.TempDir("", "fetter")
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to create dir", err)
+	}
+	defer os.RemoveAll(dir)
+	watch := func(version string) string {
+		return "-w " + filepath.Join(dir, version, "bin") + " -p x -k fetter_r1"
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "1.0", "bin"), 0755); err != nil {
+		t.Fatal("Test cannot continue; failed to create dir", err)
+	}
+	config := &settings.Settings{Rules: map[string]settings.Rule{
+		"r1": {Paths: []string{filepath.Join(dir, "*", "bin")}, Action: "execute", Group: "g1"},
+	}}
+	scl := SysCallListener{installed: make(map[string]string)}
+	client := &fakeClient{}
+	scl.syncRules(config, client)
+	if !reflect.DeepEqual(scl.installed, map[string]string{watch("1.0"): "r1"}) || client.added != 1 {
+		t.Fatal("Audit rule should have been added", scl.installed)
+	}
+	// Same configuration, but the glob matches other files now
+	if err := os.MkdirAll(filepath.Join(dir, "2.0", "bin"), 0755); err != nil {
+		t.Fatal("Test cannot continue; failed to create dir", err)
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "1.0")); err != nil {
+		t.Fatal("Test cannot continue; failed to remove dir", err)
+	}
+	scl.syncRules(config, client)
+	if !reflect.DeepEqual(scl.installed, map[string]string{watch("2.0"): "r1"}) || client.added != 2 || client.deleted != 1 {
+		t.Error("Audit rules should follow the glob", scl.installed, client)
+	}
+	scl.syncRules(config, client)
+	if client.added != 2 || client.deleted != 1 {
+		t.Error("Audit rules should be left alone", client)
+	}
+}
+
+func TestAuditRulesWithCredentials(t *testing.T) {
+	log.InitLoggerForTests()
+	config := &settings.Settings{Rules: map[string]settings.Rule{
+		"r1": {Paths: []string{"/a"}, Action: "execute", Group: "g1", Users: []string{"root", "1000"}, Auid: []string{"1000"}},
+		"r2": {Paths: []string{"/tmp"}, Action: "read", Trigger: "t1", ExcludeUsers: []string{"0"}, Groups: []string{"0"}},
+		"r3": {Paths: []string{"/b"}, Action: "execute", Group: "g1", Users: []string{"no-such-user"}},
+	}}
+	expected := map[string]string{
+		"-a always,exit -F path=/a -F perm=x -F uid=0 -F auid=1000 -k fetter_r1":    "r1",
+		"-a always,exit -F path=/a -F perm=x -F uid=1000 -F auid=1000 -k fetter_r1": "r1",
+		"-a always,exit -F dir=/tmp -F perm=r -F uid!=0 -F gid=0 -k fetter_r2":      "r2",
+	}
+	result := auditRules(config)
+	if !reflect.DeepEqual(result, expected) {
+		t.Error("Audit rules should be", expected, "instead of", result)
+	}
+	for text := range result {
+		if _, err := buildRule(text); err != nil {
+			t.Error("Audit rule should build", text, err)
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	scl := SysCallListener{config: &settings.Settings{Rules: map[string]settings.Rule{
+		"r1": {Paths: []string{"/usr/bin/make"}, Action: "execute", Group: "g1"},
+		"r2": {Paths: []string{"re:^/home/[^/]+/\\.cargo/bin/"}, Action: "execute", Group: "g1"},
+		"r3": {Paths: []string{"re:^/home/[^/]+/\\.cargo/bin/", "/usr/bin/make", "/opt/ide/"}, Action: "execute", Group: "g1"},
+	}}}
+	scl.paths = rulePaths(scl.config)
+	exec := func(exe string) *event {
+		return &event{syscall: map[string]string{"exe": exe}, paths: []string{exe}}
+	}
+	if !scl.covers("r1", exec("/bin/bash"), true) {
+		t.Error("Rules with no regular expressions should not be filtered")
+	}
+	if scl.covers("r1", exec("/bin/bash"), false) {
+		t.Error("Rules not reported should be filtered")
+	}
+	if !scl.covers("r2", exec("/home/user/.cargo/bin/rustc"), true) {
+		t.Error("Executable should match the regular expression")
+	}
+	if scl.covers("r2", exec("/home/user/bin/rustc"), true) {
+		t.Error("Executable should not match the regular expression")
+	}
+	// Regular expressions along with other paths
+	for _, exe := range []string{"/home/user/.cargo/bin/rustc", "/usr/bin/make", "/opt/ide/bin/ide"} {
+		if !scl.covers("r3", exec(exe), true) {
+			t.Error("Executable should be covered", exe)
+		}
+	}
+	if scl.covers("r3", exec("/home/user/bin/rustc"), true) {
+		t.Error("Executable should not be covered")
+	}
+	script := &event{syscall: map[string]string{"exe": "/usr/bin/bash"}, paths: []string{"/home/user/.cargo/bin/build.sh", "/usr/bin/bash"}}
+	if !scl.covers("r2", script, true) {
+		t.Error("Scripts should be covered by their path")
+	}
+}
+
+func TestProcessEvent(t *testing.T) {
+	log.InitLoggerForTests()
+	m := &mock{}
+	scl := SysCallListener{
+		config: &settings.Settings{Rules: map[string]settings.Rule{
+			"r1": {Paths: []string{"/usr/bin/make"}, Action: "execute", Group: "g1", Users: []string{"root"}},
+			"r2": {Paths: []string{"/usr/bin/"}, Action: "read", Group: "g2"},
+			"r3": {Paths: []string{"/usr/bin/make"}, Action: "execute", Group: "g3", Cmdline: []string{"test"}},
+			"r4": {Paths: []string{"/usr/bin/make"}, Action: "execute", Group: "g4", Cmdline: []string{"install"}},
+		}},
+		procMover:  m,
+		procRunner: m,
+	}
+	scl.paths, scl.filters = rulePaths(scl.config), filter.NewFilters(scl.config)
+	e := &event{
+		pid:     1,
+		syscall: map[string]string{"exe": "/usr/bin/make", "uid": "1000", "gid": "1000"},
+		tags:    []string{"fetter_r1"},
+		args:    []string{"make", "install"},
+		paths:   []string{"/usr/bin/make"},
+	}
+	// The kernel reports the first rule only, but others can match
+	scl.processEvent(e)
+	if m.group != "g4" {
+		t.Error("Process should have been moved by r4 instead of", m.group)
+	}
+	m.moved, m.group = false, ""
+	e.args = []string{"make", "all"}
+	scl.processEvent(e)
+	if m.moved {
+		t.Error("No rule should have matched", m.group)
+	}
+}
+
+func TestIsFetterRule(t *testing.T) {
+	if !isFetterRule(asAuditFmt("danger", "/foo", syscallExecute)) {
+		t.Error("Rule should be considered as added by fetter")
+	}
+	if isFetterRule("-w /foo -p x -k sudo_log") {
+		t.Error("Rule should not be considered as added by fetter")
+	}
+}
+
 func TestFakeRule(t *testing.T) {
 	log.InitLoggerForTests()
 	m := &mock{}
@@ -85,7 +309,7 @@ func TestFakeRule(t *testing.T) {
 		procMover:  m,
 		procRunner: m,
 	}
-	scl.processMatch(1, "fake-rule", nil)
+	scl.processMatch("fake-rule", &event{pid: 1})
 	if m.moved {
 		t.Error("No process should be moved here")
 	}
@@ -103,7 +327,7 @@ func TestTrigger(t *testing.T) {
 		procMover:  m,
 		procRunner: m,
 	}
-	scl.processMatch(1, "r1", nil)
+	scl.processMatch("r1", &event{pid: 1})
 	if m.moved {
 		t.Error("No process should be moved here")
 	}
@@ -121,7 +345,7 @@ func TestMove(t *testing.T) {
 		procMover:  m,
 		procRunner: m,
 	}
-	scl.processMatch(1, "r2", nil)
+	scl.processMatch("r2", &event{pid: 1})
 	if !m.moved {
 		t.Error("process should have been moved")
 	}
@@ -130,10 +354,44 @@ func TestMove(t *testing.T) {
 	}
 }
 
+func TestMoveTree(t *testing.T) {
+	log.InitLoggerForTests()
+	m := &mock{}
+	scl := SysCallListener{
+		client:     nil,
+		config:     config,
+		procMover:  m,
+		procRunner: m,
+	}
+	scl.processMatch("r3", &event{pid: 1})
+	if !m.movedTree {
+		t.Error("process tree should have been moved")
+	}
+	if m.moved {
+		t.Error("process should have been moved along its tree")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	log.InitLoggerForTests()
+	m := &mock{}
+	scl := SysCallListener{
+		config:     &settings.Settings{Rules: rules, DryRun: true},
+		procMover:  m,
+		procRunner: m,
+	}
+	for rule := range rules {
+		scl.processMatch(rule, &event{pid: 1})
+	}
+	if m.moved || m.movedTree || m.ran {
+		t.Error("Nothing should be done in dry run")
+	}
+}
+
 func TestBuildWithBadModeShouldReturnNil(t *testing.T) {
 	log.InitLoggerForTests()
 	m := &mock{}
-	scl := NewSysCallListener(config, m, m)
+	scl := NewSysCallListener(config, m, m, nil)
 	if scl != nil {
 		t.Error("No SysCallListener should be created here")
 	}
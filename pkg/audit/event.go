@@ -0,0 +1,205 @@
+package audit
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/go-libaudit/v2/auparse"
+
+	"github.com/juan-leon/fetter/pkg/filter"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+// event is an audit event, correlated from the records the kernel sends for
+// it (SYSCALL, EXECVE, CWD, PATH, etc.), that share a sequence number
+type event struct {
+	pid     int
+	syscall map[string]string // fields of the SYSCALL record
+	tags    []string          // keys of the audit rules that matched
+	args    []string          // from the EXECVE record (execute actions only)
+	cwd     string
+	paths   []string // from the PATH records, resolved against cwd
+}
+
+// newEvent correlates the records of an audit event.  It fails for events
+// without a SYSCALL record (like configuration changes).
+func newEvent(msgs []*auparse.AuditMessage) (*event, error) {
+	e := &event{}
+	execve := make(map[string]string)
+	for _, msg := range msgs {
+		switch msg.RecordType {
+		case auparse.AUDIT_EOE:
+			continue
+		case auparse.AUDIT_EXECVE:
+			execveFields(msg.RawData, execve)
+			continue
+		}
+		data, err := msg.Data()
+		if err != nil {
+			return nil, fmt.Errorf("could not extract data from %s record: %w", msg.RecordType, err)
+		}
+		switch msg.RecordType {
+		case auparse.AUDIT_SYSCALL:
+			e.syscall = data
+			// For auparse, key is a tag and is not present in 'Data'
+			if e.tags, err = msg.Tags(); err != nil {
+				return nil, fmt.Errorf("could not parse tags from message: %w", err)
+			}
+		case auparse.AUDIT_CWD:
+			e.cwd = data["cwd"]
+		case auparse.AUDIT_PATH:
+			if name := data["name"]; name != "" {
+				e.paths = append(e.paths, name)
+			}
+		}
+	}
+	if e.syscall == nil {
+		return nil, fmt.Errorf("no syscall record in event")
+	}
+	e.args = execveArgs(execve)
+	pid, err := strconv.Atoi(e.syscall["pid"])
+	if err != nil {
+		return nil, fmt.Errorf("got a non-numeric pid %s: %w", e.syscall["pid"], err)
+	}
+	e.pid = pid
+	for i, path := range e.paths {
+		if !filepath.IsAbs(path) && e.cwd != "" {
+			e.paths[i] = filepath.Join(e.cwd, path)
+		}
+	}
+	return e, nil
+}
+
+// execveField matches the fields of EXECVE records: argc, arguments (like a0)
+// and chunks of long arguments (like a1_len and a1[0]).  Values are either
+// quoted or hex encoded.
+var execveField = regexp.MustCompile(`(?:^| )(argc|a[0-9]+(?:_len|\[[0-9]+\])?)=("[^"]*"|[^ ]*)`)
+
+// execveFields adds the fields of an EXECVE record to fields, with arguments
+// decoded.  auparse cannot make sense of long command lines: they take several
+// records (only the first one with argc), and long arguments come in chunks
+// (like a1_len=20000 a1[0]=... a1[1]=...), maybe spread over records too.
+func execveFields(raw string, fields map[string]string) {
+	if i := strings.Index(raw, "): "); i >= 0 {
+		raw = raw[i+3:]
+	}
+	for _, match := range execveField.FindAllStringSubmatch(raw, -1) {
+		key, value := match[1], match[2]
+		switch {
+		case strings.HasPrefix(value, `"`):
+			value = strings.Trim(value, `"`)
+		case key != "argc" && !strings.HasSuffix(key, "_len"):
+			if decoded, err := hex.DecodeString(value); err == nil {
+				value = string(decoded)
+			}
+		}
+		fields[key] = value
+	}
+}
+
+// execveArgs returns the arguments in the fields of EXECVE records (as added
+// by execveFields), joining the chunks of long ones.  Arguments missing (as it
+// happens when records are lost) and the ones after them are left out.
+func execveArgs(fields map[string]string) []string {
+	argc, err := strconv.Atoi(fields["argc"])
+	if err != nil {
+		return nil
+	}
+	args := make([]string, 0, argc)
+	for i := 0; i < argc; i++ {
+		key := "a" + strconv.Itoa(i)
+		if arg, ok := fields[key]; ok {
+			args = append(args, arg)
+			continue
+		}
+		var arg strings.Builder
+		chunks := 0
+		for ; ; chunks++ {
+			chunk, ok := fields[fmt.Sprintf("%s[%d]", key, chunks)]
+			if !ok {
+				break
+			}
+			arg.WriteString(chunk)
+		}
+		if chunks == 0 {
+			break
+		}
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+// rule returns the name of the fetter rule the kernel reported the event for,
+// if any.  Only the key of the first audit rule matching is reported, so other
+// rules can be about the event too.
+func (e *event) rule() string {
+	for _, tag := range e.tags {
+		if strings.HasPrefix(tag, cgPrefix) {
+			return tag[len(cgPrefix):]
+		}
+	}
+	return ""
+}
+
+// exe returns the executable of the process causing the event
+func (e *event) exe() string {
+	return e.syscall["exe"]
+}
+
+// files returns the files the event can be about, for an action, to match them
+// against the paths of rules: those in the PATH records and, for executions,
+// the executable (that has symbolic links resolved, unlike the former).
+func (e *event) files(action string) []string {
+	if action != settings.ActionExecute {
+		return e.paths
+	}
+	return append([]string{e.exe()}, e.paths...)
+}
+
+// process returns the details of the process causing the event, as needed by
+// rule filters.  Unlike reading them from /proc, there is no race with the
+// process exiting.  Without an EXECVE record (for read and write actions), the
+// command line is not known.
+func (e *event) process() *filter.Process {
+	return &filter.Process{
+		Pid:     e.pid,
+		Cmdline: strings.Join(e.args, " "),
+		UID:     parseID(e.syscall["uid"]),
+		GID:     parseID(e.syscall["gid"]),
+		Auid:    parseID(e.syscall["auid"]),
+	}
+}
+
+// parseID parses an id field of an audit record.  auparse turns unset ids (like
+// the login uid of daemons) into "unset".
+func parseID(text string) uint32 {
+	id, err := strconv.ParseUint(text, 10, 32)
+	if err != nil {
+		return filter.UnsetLoginUID
+	}
+	return uint32(id)
+}
+
+// data returns the data of the event that triggers get, as environment
+// variables: the fields of the SYSCALL record, plus the command line (argv),
+// the working directory (cwd) and the path the event is about (path).
+func (e *event) data() map[string]string {
+	data := make(map[string]string, len(e.syscall)+3)
+	for k, v := range e.syscall {
+		data[k] = v
+	}
+	if len(e.args) > 0 {
+		data["argv"] = strings.Join(e.args, " ")
+	}
+	if e.cwd != "" {
+		data["cwd"] = e.cwd
+	}
+	if len(e.paths) > 0 {
+		data["path"] = e.paths[0]
+	}
+	return data
+}
@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/elastic/go-libaudit/v2"
+	"github.com/elastic/go-libaudit/v2/auparse"
+
+	"github.com/juan-leon/fetter/pkg/filter"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+const execution = `type=SYSCALL msg=audit(1600000000.123:42): arch=c000003e syscall=59 success=yes exit=0 a0=55d a1=55e a2=55f a3=0 items=2 ppid=100 pid=200 auid=1000 uid=1001 gid=1002 euid=1001 suid=1001 fsuid=1001 egid=1002 sgid=1002 fsgid=1002 tty=pts0 ses=3 comm="make" exe="/usr/bin/make" key="fetter_r1"
+type=EXECVE msg=audit(1600000000.123:42): argc=3 a0="make" a1="-j" a2="all"
+type=CWD msg=audit(1600000000.123:42): cwd="/home/alice/src"
+type=PATH msg=audit(1600000000.123:42): item=0 name="/usr/bin/make" inode=1 dev=08:01 mode=0100755 ouid=0 ogid=0 rdev=00:00 nametype=NORMAL
+type=PATH msg=audit(1600000000.123:42): item=1 name="/lib64/ld-linux-x86-64.so.2" inode=2 dev=08:01 mode=0100755 ouid=0 ogid=0 rdev=00:00 nametype=NORMAL
+type=EOE msg=audit(1600000000.123:42):`
+
+const reading = `type=SYSCALL msg=audit(1600000000.456:43): arch=c000003e syscall=257 success=yes exit=3 a0=ffffff9c a1=55d a2=0 a3=0 items=1 ppid=100 pid=201 auid=4294967295 uid=0 gid=0 euid=0 suid=0 fsuid=0 egid=0 sgid=0 fsgid=0 tty=(none) ses=4294967295 comm="cat" exe="/usr/bin/cat" key="fetter_r2"
+type=CWD msg=audit(1600000000.456:43): cwd="/home/alice"
+type=PATH msg=audit(1600000000.456:43): item=0 name="notes.txt" inode=3 dev=08:01 mode=0100644 ouid=1000 ogid=1000 rdev=00:00 nametype=NORMAL
+type=EOE msg=audit(1600000000.456:43):`
+
+const longExecution = `type=SYSCALL msg=audit(1600000000.789:44): arch=c000003e syscall=59 success=yes exit=0 a0=55d a1=55e a2=55f a3=0 items=1 ppid=100 pid=202 auid=1000 uid=1001 gid=1002 euid=1001 suid=1001 fsuid=1001 egid=1002 sgid=1002 fsgid=1002 tty=pts0 ses=3 comm="make" exe="/usr/bin/make" key="fetter_r1"
+type=EXECVE msg=audit(1600000000.789:44): argc=4 a0="make" a1_len=12 a1[0]="CFLAGS="
+type=EXECVE msg=audit(1600000000.789:44): a1[1]=2D4F32202D67 a2="all" a3=6120622063
+type=PATH msg=audit(1600000000.789:44): item=0 name="/usr/bin/make" inode=1 dev=08:01 mode=0100755 ouid=0 ogid=0 rdev=00:00 nametype=NORMAL
+type=EOE msg=audit(1600000000.789:44):`
+
+func parseRecords(t *testing.T, text string) (msgs []*auparse.AuditMessage) {
+	for _, line := range strings.Split(text, "\n") {
+		msg, err := auparse.ParseLogLine(line)
+		if err != nil {
+			t.Fatal("Test cannot continue; failed to parse record", line, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+func TestExecutionEvent(t *testing.T) {
+	e, err := newEvent(parseRecords(t, execution))
+	if err != nil {
+		t.Fatal("Could not correlate records", err)
+	}
+	if e.pid != 200 || e.rule() != "r1" || e.exe() != "/usr/bin/make" || e.cwd != "/home/alice/src" {
+		t.Error("Bad event", e)
+	}
+	if !reflect.DeepEqual(e.args, []string{"make", "-j", "all"}) {
+		t.Error("Bad arguments", e.args)
+	}
+	expected := filter.Process{Pid: 200, Cmdline: "make -j all", UID: 1001, GID: 1002, Auid: 1000}
+	if p := e.process(); *p != expected {
+		t.Error("Bad process", p)
+	}
+	data := e.data()
+	for k, v := range map[string]string{
+		"argv": "make -j all",
+		"cwd":  "/home/alice/src",
+		"path": "/usr/bin/make",
+		"tty":  "pts0",
+		"uid":  "1001",
+	} {
+		if data[k] != v {
+			t.Error("Bad value for", k, data[k])
+		}
+	}
+}
+
+func TestLongExecutionEvent(t *testing.T) {
+	e, err := newEvent(parseRecords(t, longExecution))
+	if err != nil {
+		t.Fatal("Could not correlate records", err)
+	}
+	if expected := []string{"make", "CFLAGS=-O2 -g", "all", "a b c"}; !reflect.DeepEqual(e.args, expected) {
+		t.Error("Arguments should be joined across chunks and records", e.args)
+	}
+	lost := strings.Replace(longExecution, " a2=\"all\"", "", 1)
+	if e, err = newEvent(parseRecords(t, lost)); err != nil || len(e.args) != 2 {
+		t.Error("Arguments should stop at the first missing one", e, err)
+	}
+}
+
+func TestReadEvent(t *testing.T) {
+	e, err := newEvent(parseRecords(t, reading))
+	if err != nil {
+		t.Fatal("Could not correlate records", err)
+	}
+	if e.rule() != "r2" || len(e.args) != 0 {
+		t.Error("Bad event", e)
+	}
+	if !reflect.DeepEqual(e.paths, []string{"/home/alice/notes.txt"}) {
+		t.Error("Relative paths should be resolved", e.paths)
+	}
+	if p := e.process(); p.Auid != filter.UnsetLoginUID {
+		t.Error("Login uid should be unset", p.Auid)
+	}
+	if _, ok := e.data()["argv"]; ok {
+		t.Error("There should be no command line")
+	}
+}
+
+func TestEventWithoutSyscall(t *testing.T) {
+	if _, err := newEvent(parseRecords(t, strings.Split(execution, "\n")[2])); err == nil {
+		t.Error("Events without a syscall record should fail")
+	}
+}
+
+func TestReassembly(t *testing.T) {
+	log.InitLoggerForTests()
+	m := &mock{}
+	scl := &SysCallListener{
+		config: &settings.Settings{Rules: map[string]settings.Rule{
+			"r1": {Paths: []string{"/usr/bin/make"}, Action: "execute", Trigger: "t1", Cmdline: []string{"-j"}},
+		}},
+		procMover:  m,
+		procRunner: m,
+	}
+	scl.filters = filter.NewFilters(scl.config)
+	reassembler, err := libaudit.NewReassembler(reassemblerSize, reassemblerTimeout, stream{scl})
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to create reassembler", err)
+	}
+	// Records of both events interleaved
+	records := append(parseRecords(t, reading)[:2], parseRecords(t, execution)...)
+	for _, msg := range records {
+		reassembler.PushMessage(msg)
+	}
+	reassembler.Close()
+	if !m.ran || m.data["argv"] != "make -j all" {
+		t.Error("Trigger should have run with the command line", m.data)
+	}
+}
@@ -1,61 +1,111 @@
 package cgroups
 
 import (
+	"errors"
 	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"syscall"
-
-	"github.com/containerd/cgroups"
+	"time"
 
 	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/metrics"
 	"github.com/juan-leon/fetter/pkg/settings"
 )
 
-const kill = "KILL" // pseudo group for killing proceses outright
-
-// GroupHierarchy represents a V1 control group hierarchy
+// GroupHierarchy represents a control group hierarchy.  Both V1 and unified V2
+// hierarchies are supported; the one mounted in the system is detected.
 type GroupHierarchy struct {
-	name      string
-	main      cgroups.Cgroup
-	subgroups map[string]cgroups.Cgroup
+	main      controlGroup
+	mu        sync.RWMutex
+	subgroups map[string]controlGroup
+	groups    map[string]settings.Group // as applied, by the schedule of each
+	instances map[string]controlGroup   // of template groups, like browsers/alice
+	origins   *originStore              // where moved processes were before
+	// Groups as configured, and the window of their schedules applied (-1
+	// for none)
+	configured map[string]settings.Group
+	windows    map[string]int
+	// Loaded as it was (see LoadGroupHierarchy), rather than set up
+	loaded bool
+	name   string
 }
 
 // NewGroupHierarchy creates and initializes a GroupHierarchy struct
 func NewGroupHierarchy(config *settings.Settings) *GroupHierarchy {
-	main, err := cgroups.New(
-		cgroups.V1,
-		cgroups.StaticPath(config.Name),
-		emptySpec(),
-	)
+	main, err := newControlGroup(config.Name)
 	if err != nil {
 		log.Logger.Fatalf("Could not create base cgroup with name %s: %s", config.Name, err)
 		return nil
 	}
 	gh := GroupHierarchy{
-		name:      config.Name,
-		main:      main,
-		subgroups: make(map[string]cgroups.Cgroup),
+		main:       main,
+		subgroups:  make(map[string]controlGroup),
+		groups:     make(map[string]settings.Group),
+		instances:  make(map[string]controlGroup),
+		configured: make(map[string]settings.Group),
+		windows:    make(map[string]int),
+		origins:    newOriginStore(config.Name),
+		name:       config.Name,
 	}
-	for name, g := range config.Groups {
+	gh.origins.prune()
+	now := time.Now()
+	for name, configured := range config.Groups {
+		g, window := gh.configure(name, configured, now)
 		gh.addSubGroup(name, g)
+		gh.windows[name] = window
 	}
 	return &gh
 }
 
-// DeleteGroupHierarchy deletes a V1 control group hierarchy.  Processes in
+// LoadGroupHierarchy loads the control groups configured as they are in the
+// system, without creating them or applying their limits, and keeps them that
+// way: the hierarchy does not change its groups on reloads and schedules.  It
+// is meant for dry runs, and for acting on the groups of another fetter
+// process.  Groups missing are left out; if the base group is, the hierarchy
+// returned is empty, along with the error.
+func LoadGroupHierarchy(config *settings.Settings) (*GroupHierarchy, error) {
+	gh := GroupHierarchy{
+		subgroups:  make(map[string]controlGroup),
+		groups:     make(map[string]settings.Group),
+		instances:  make(map[string]controlGroup),
+		configured: make(map[string]settings.Group),
+		windows:    make(map[string]int),
+		origins:    newOriginStore(config.Name),
+		loaded:     true,
+		name:       config.Name,
+	}
+	main, err := loadControlGroup(config.Name)
+	if err != nil {
+		log.Logger.Warnf("Could not load base cgroup with name %s: %s", config.Name, err)
+		return &gh, err
+	}
+	gh.main = main
+	now := time.Now()
+	for name, configured := range config.Groups {
+		subgroup, err := loadControlGroup(filepath.Join(config.Name, name))
+		if err != nil {
+			log.Logger.Warnf("Could not load subgroup with name %s: %s", name, err)
+			continue
+		}
+		g, window := gh.configure(name, configured, now)
+		gh.subgroups[name] = subgroup
+		gh.groups[name] = g
+		gh.windows[name] = window
+	}
+	return &gh, nil
+}
+
+// DeleteGroupHierarchy deletes a control group hierarchy.  Processes in
 // to-be-deleted control groups will be moved to root control groups.
 func DeleteGroupHierarchy(config *settings.Settings) error {
-	main, err := cgroups.Load(
-		cgroups.V1,
-		cgroups.StaticPath(config.Name),
-	)
+	main, err := loadControlGroup(config.Name)
 	if err != nil {
 		log.Logger.Errorf("Could not load base cgroup with name %s: %s", config.Name, err)
 		return err
 	}
-	root, err := cgroups.Load(
-		cgroups.V1,
-		cgroups.StaticPath(""),
-	)
+	root, err := loadControlGroup("")
 	if err != nil {
 		log.Logger.Errorf("Could not load root cgroup: %s", err)
 	} else {
@@ -72,40 +122,297 @@ func DeleteGroupHierarchy(config *settings.Settings) error {
 }
 
 // Move a process, identified byt its pid, to a control group, identified by its
-// name
+// name.  For template groups, the name includes the key of the instance (like
+// browsers/{user}), which is created if needed.
 func (gh *GroupHierarchy) Move(pid int, cgroup string) error {
-	if cgroup == kill {
+	if cgroup == settings.Kill {
 		log.Logger.Infof("Killing process %d", pid)
+		// Read before killing, while the process is still there
+		from, _ := gh.origins.group(pid)
 		if err := syscall.Kill(pid, 9); err != nil {
 			log.Logger.Warnf("Could not kill process: %s", err)
 			return err
 		}
+		// Labelled by the group the process was killed from, so that kills
+		// down the escalation steps of a rule can be told apart
+		metrics.Kills.WithLabelValues(from).Inc()
+		if from != "" && !unified() {
+			// Frozen processes do not die until thawed in V1 hierarchies
+			gh.mu.Lock()
+			defer gh.mu.Unlock()
+			gh.release(pid)
+		}
 		return nil
 	}
 	log.Logger.Infof("Adding process %d to cgroup %s", pid, cgroup)
-	if subgroup, ok := gh.subgroups[cgroup]; ok {
-		if err := subgroup.Add(cgroups.Process{Pid: pid}); err != nil {
-			log.Logger.Warnw("Could not add process to subgroup", "name", cgroup, "pid", pid)
+	origin, err := gh.add(pid, cgroup)
+	if err != nil {
+		return err
+	}
+	// Only once moved, and without the hierarchy locked, since it means
+	// writing to disk
+	gh.recordOrigin(pid, origin)
+	return nil
+}
+
+// add adds a process to a control group, and returns the origin of the process
+// to record, if any.
+func (gh *GroupHierarchy) add(pid int, cgroup string) ([]byte, error) {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	group, _ := settings.SplitGroup(cgroup)
+	if _, ok := gh.subgroups[group]; !ok {
+		log.Logger.Warnw("Did not find subgroup", "name", cgroup, "pid", pid)
+		return nil, nil
+	}
+	subgroup, name, err := gh.lookup(cgroup, pid, true)
+	if err != nil {
+		log.Logger.Warnw("Could not find instance of subgroup", "name", cgroup, "pid", pid, "error", err)
+		return nil, err
+	}
+	origin, err := gh.origins.current(pid)
+	if err != nil {
+		log.Logger.Debugw("Could not read current cgroup of process", "pid", pid, "error", err)
+	}
+	if err := subgroup.Add(pid); err != nil {
+		log.Logger.Warnw("Could not add process to subgroup", "name", name, "pid", pid)
+		return nil, err
+	}
+	// Labelled by configured group, since instances could be many
+	metrics.Moves.WithLabelValues(group).Inc()
+	return origin, nil
+}
+
+// Release moves a process, identified by its pid, back to the control group it
+// was in before fetter moved it, or to the root control group if that is not
+// known.  Processes not in the hierarchy are left alone.
+func (gh *GroupHierarchy) Release(pid int) error {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	moved, err := gh.origins.moved(pid)
+	if err != nil {
+		log.Logger.Warnw("Could not find current cgroup of process", "pid", pid, "error", err)
+		return err
+	}
+	if !moved {
+		return fmt.Errorf("process %d is not in a fetter cgroup", pid)
+	}
+	return gh.release(pid)
+}
+
+// ReleaseAll moves every process in the hierarchy back to the control group it
+// was in before fetter moved it, or to the root control group if that is not
+// known.  Groups are thawed first, so that processes keep running.
+func (gh *GroupHierarchy) ReleaseAll() {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	for _, instance := range gh.instances {
+		instance.Thaw()
+	}
+	for name, subgroup := range gh.subgroups {
+		subgroup.Thaw()
+		pids, err := subgroup.Processes()
+		if err != nil {
+			log.Logger.Errorf("Could not list processes of %s: %s", name, err)
+			continue
+		}
+		for _, pid := range pids {
+			gh.release(pid)
+		}
+	}
+}
+
+// Holds tells whether a process, identified by its pid, is in a control group
+// of the hierarchy already (moved there by a rule, by hand or down the
+// escalation steps of a rule)
+func (gh *GroupHierarchy) Holds(pid int) bool {
+	moved, err := gh.origins.moved(pid)
+	return err == nil && moved
+}
+
+// Freeze freezes all processes in a control group, identified by its name
+func (gh *GroupHierarchy) Freeze(cgroup string) error {
+	gh.mu.RLock()
+	defer gh.mu.RUnlock()
+	subgroup, _, err := gh.lookup(cgroup, 0, false)
+	if err != nil {
+		return err
+	}
+	log.Logger.Infof("Freezing cgroup %s", cgroup)
+	if err := subgroup.Freeze(); err != nil {
+		log.Logger.Errorf("Could not freeze %s: %s", cgroup, err)
+		return err
+	}
+	return nil
+}
+
+// Thaw resumes all processes in a control group, identified by its name
+func (gh *GroupHierarchy) Thaw(cgroup string) error {
+	gh.mu.RLock()
+	defer gh.mu.RUnlock()
+	subgroup, _, err := gh.lookup(cgroup, 0, false)
+	if err != nil {
+		return err
+	}
+	log.Logger.Infof("Thawing cgroup %s", cgroup)
+	if err := subgroup.Thaw(); err != nil {
+		log.Logger.Errorf("Could not thaw %s: %s", cgroup, err)
+		return err
+	}
+	return nil
+}
+
+// Frozen tells whether the processes in a control group, identified by its
+// name, are frozen
+func (gh *GroupHierarchy) Frozen(cgroup string) (bool, error) {
+	gh.mu.RLock()
+	defer gh.mu.RUnlock()
+	subgroup, _, err := gh.lookup(cgroup, 0, false)
+	if err != nil {
+		return false, err
+	}
+	usage, err := subgroup.Usage()
+	if err != nil {
+		log.Logger.Errorf("Could not read freezer state of %s: %s", cgroup, err)
+		return false, err
+	}
+	return usage.Frozen, nil
+}
+
+func (gh *GroupHierarchy) release(pid int) error {
+	origin, err := gh.origins.load(pid)
+	if err != nil {
+		log.Logger.Debugw("Could not load former cgroup of process", "pid", pid, "error", err)
+	}
+	if origin == nil {
+		if origin, err = loadControlGroup(""); err != nil {
+			log.Logger.Errorf("Could not load root cgroup: %s", err)
 			return err
 		}
-	} else {
-		log.Logger.Warnw("Did not find subgroup", "name", cgroup, "pid", pid)
+	}
+	gh.origins.forget(pid)
+	log.Logger.Infof("Releasing process %d", pid)
+	if err := origin.Add(pid); errors.Is(err, syscall.ESRCH) {
+		log.Logger.Debugw("Process gone while being released", "pid", pid)
+	} else if err != nil {
+		log.Logger.Warnw("Could not release process", "pid", pid, "error", err)
+		return err
 	}
 	return nil
 }
 
+// recordOrigin takes note of the control group a process was in before being
+// moved, as read before moving it
+func (gh *GroupHierarchy) recordOrigin(pid int, origin []byte) {
+	if err := gh.origins.save(pid, origin); err != nil {
+		log.Logger.Debugw("Could not record former cgroup of process", "pid", pid, "error", err)
+	}
+}
+
+// Reload applies the groups of a new configuration: limits of groups already
+// present are updated in place (keeping their processes), new groups are
+// created, and groups no longer configured are deleted, after releasing their
+// processes.
+func (gh *GroupHierarchy) Reload(config *settings.Settings) {
+	if gh.loaded {
+		log.Logger.Infof("Control groups loaded as they were; not changing them")
+		return
+	}
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	now := time.Now()
+	for name, configured := range config.Groups {
+		g, window := gh.configure(name, configured, now)
+		var err error
+		if old, ok := gh.groups[name]; !ok {
+			err = gh.addSubGroup(name, g)
+		} else if old.Template != g.Template {
+			// Limits move between the group and its instances; starting
+			// afresh is simpler
+			gh.deleteSubGroup(name)
+			err = gh.addSubGroup(name, g)
+		} else if !reflect.DeepEqual(old, g) {
+			err = gh.updateSubGroup(name, old, g)
+		}
+		if err != nil {
+			// The window is left as it was, so that schedules retry it
+			log.Logger.Warnf("Could not apply new limits of group %s: %s", name, err)
+			continue
+		}
+		gh.windows[name] = window
+	}
+	for name := range gh.groups {
+		if _, ok := config.Groups[name]; !ok {
+			gh.deleteSubGroup(name)
+			delete(gh.configured, name)
+			delete(gh.windows, name)
+		}
+	}
+}
+
+// ApplySchedules updates in place the limits of the groups whose schedules
+// moved into (or out of) a time window
+func (gh *GroupHierarchy) ApplySchedules() {
+	gh.applySchedules(time.Now())
+}
+
+func (gh *GroupHierarchy) applySchedules(now time.Time) {
+	if gh.loaded {
+		return
+	}
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	for name, configured := range gh.configured {
+		old, ok := gh.groups[name]
+		if len(configured.Schedule) == 0 || !ok {
+			continue
+		}
+		g, window := configured.At(now)
+		current, ok := gh.windows[name]
+		if ok && window == current {
+			continue
+		}
+		if window >= 0 {
+			log.Logger.Infow("Group entering schedule window", "name", name, "window", configured.Schedule[window].String())
+		} else if ok && current < len(configured.Schedule) {
+			log.Logger.Infow("Group leaving schedule window", "name", name, "window", configured.Schedule[current].String())
+		}
+		if !reflect.DeepEqual(old, g) {
+			if err := gh.updateSubGroup(name, old, g); err != nil {
+				// Tried again on next schedule check
+				log.Logger.Warnf("Could not apply schedule of group %s: %s", name, err)
+				continue
+			}
+		}
+		gh.windows[name] = window
+	}
+}
+
+// configure takes note of a group as configured, and returns it as it is at
+// now, by its schedule
+func (gh *GroupHierarchy) configure(name string, configured settings.Group, now time.Time) (settings.Group, int) {
+	gh.configured[name] = configured
+	return configured.At(now)
+}
+
 func (gh *GroupHierarchy) addSubGroup(name string, g settings.Group) error {
 	if name == "" {
 		err := fmt.Errorf("could not create subgroup with empty name")
 		log.Logger.Errorf("%s", err)
 		return err
 	}
-	subgroup, err := gh.main.New(name, createSpec(name, &g))
+	spec := createSpec(name, &g)
+	if g.Template {
+		// Limits are for the instances
+		spec = emptySpec()
+	}
+	subgroup, err := gh.main.New(name, spec)
 	if err != nil {
 		log.Logger.Errorf("Could not create subgroup with name %s: %s", name, err)
 		return err
 	}
 	gh.subgroups[name] = subgroup
+	gh.groups[name] = g
 	if g.Freeze {
 		if err := subgroup.Freeze(); err != nil {
 			log.Logger.Errorf("Could not freeze %s: %s", name, err)
@@ -115,3 +422,59 @@ func (gh *GroupHierarchy) addSubGroup(name string, g settings.Group) error {
 	log.Logger.Debugw("Added subgroup", "name", name, "subgroup", g)
 	return nil
 }
+
+func (gh *GroupHierarchy) updateSubGroup(name string, old, g settings.Group) error {
+	subgroup := gh.subgroups[name]
+	updated := []controlGroup{subgroup}
+	if g.Template {
+		updated = updated[:0]
+		for _, instance := range gh.instancesOf(name) {
+			updated = append(updated, gh.instances[instance])
+		}
+	}
+	for _, cg := range updated {
+		if err := cg.Update(updateSpec(name, &old, &g)); err != nil {
+			log.Logger.Errorf("Could not update subgroup with name %s: %s", name, err)
+			return err
+		}
+	}
+	gh.groups[name] = g
+	if g.Freeze != old.Freeze {
+		var err error
+		if g.Freeze {
+			err = subgroup.Freeze()
+		} else {
+			err = subgroup.Thaw()
+		}
+		if err != nil {
+			log.Logger.Errorf("Could not change freezer state of %s: %s", name, err)
+			return err
+		}
+	}
+	log.Logger.Infow("Updated subgroup", "name", name, "subgroup", g)
+	return nil
+}
+
+func (gh *GroupHierarchy) deleteSubGroup(name string) error {
+	for _, instance := range gh.instancesOf(name) {
+		gh.deleteInstance(instance)
+	}
+	subgroup := gh.subgroups[name]
+	delete(gh.subgroups, name)
+	delete(gh.groups, name)
+	// Thawing first, so that processes keep running after leaving
+	subgroup.Thaw()
+	pids, err := subgroup.Processes()
+	if err != nil {
+		log.Logger.Errorf("Could not list processes of %s: %s", name, err)
+	}
+	for _, pid := range pids {
+		gh.release(pid)
+	}
+	if err := subgroup.Delete(); err != nil {
+		log.Logger.Errorf("Could not delete subgroup with name %s: %s", name, err)
+		return err
+	}
+	log.Logger.Infow("Deleted subgroup", "name", name)
+	return nil
+}
@@ -0,0 +1,334 @@
+package cgroups
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"testing"
+	"time"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+func TestMoveToUnknownGroup(t *testing.T) {
+	log.InitLoggerForTests()
+	origins, cleanup := testOrigins(t, "fetter")
+	defer cleanup()
+	gh := GroupHierarchy{
+		subgroups: make(map[string]controlGroup),
+		origins:   origins,
+	}
+	if err := gh.Move(os.Getpid(), "nothing"); err != nil {
+		t.Error("Moving to an unknown group is not an error", err)
+	}
+	if _, ok := origins.path(os.Getpid()); ok {
+		t.Error("Origin should not be recorded")
+	}
+}
+
+func TestMoveRecordsOrigin(t *testing.T) {
+	log.InitLoggerForTests()
+	origins, cleanup := testOrigins(t, "fetter")
+	defer cleanup()
+	gh := GroupHierarchy{
+		subgroups: map[string]controlGroup{
+			"broken": &fakeGroup{addErr: fmt.Errorf("no way")},
+			"g1":     &fakeGroup{},
+		},
+		origins: origins,
+	}
+	if err := gh.Move(os.Getpid(), "broken"); err == nil {
+		t.Error("Moving should have failed")
+	}
+	if _, ok := origins.path(os.Getpid()); ok {
+		t.Error("Origin should not be recorded if moving failed")
+	}
+	if err := gh.Move(os.Getpid(), "g1"); err != nil {
+		t.Error("Moving should have worked", err)
+	}
+	if _, ok := origins.path(os.Getpid()); !ok {
+		t.Error("Origin should be recorded once moved")
+	}
+}
+
+func TestFreezeUnknownGroup(t *testing.T) {
+	log.InitLoggerForTests()
+	gh := GroupHierarchy{subgroups: make(map[string]controlGroup)}
+	if err := gh.Freeze("nothing"); err == nil {
+		t.Error("Freezing an unknown group should fail")
+	}
+	if err := gh.Thaw("nothing"); err == nil {
+		t.Error("Thawing an unknown group should fail")
+	}
+	if _, err := gh.Frozen("nothing"); err == nil {
+		t.Error("Freezer state of an unknown group should fail")
+	}
+}
+
+func TestUpdateWithoutIO(t *testing.T) {
+	log.InitLoggerForTests()
+	old := settings.Group{RAM: 100 * settings.Megabyte}
+	gh := GroupHierarchy{
+		subgroups: map[string]controlGroup{"g1": &fakeGroup{noIO: true}},
+		groups:    map[string]settings.Group{"g1": old},
+	}
+	g := settings.Group{RAM: 200 * settings.Megabyte}
+	if err := gh.updateSubGroup("g1", old, g); err != nil || gh.groups["g1"].RAM != g.RAM {
+		t.Error("Groups without I/O settings should be updated", err)
+	}
+}
+
+// fakeGroup is a controlGroup that lives in memory only
+type fakeGroup struct {
+	pids      []int
+	frozen    bool
+	events    MemoryEvents
+	pressure  *Pressure
+	spec      *specs.LinuxResources // last update
+	addErr    error                 // what adding processes fails with
+	noIO      bool                  // whether I/O weights are unsupported
+	updateErr error                 // what updates fail with
+}
+
+func (f *fakeGroup) New(name string, spec *specs.LinuxResources) (controlGroup, error) {
+	return &fakeGroup{}, nil
+}
+
+func (f *fakeGroup) Add(pid int) error {
+	if f.addErr != nil {
+		return f.addErr
+	}
+	f.pids = append(f.pids, pid)
+	return nil
+}
+
+func (f *fakeGroup) Update(spec *specs.LinuxResources) error {
+	if f.updateErr != nil {
+		return f.updateErr
+	}
+	if f.noIO && spec.BlockIO != nil && spec.BlockIO.Weight != nil {
+		return fmt.Errorf("no I/O weight support")
+	}
+	f.spec = spec
+	return nil
+}
+
+func (f *fakeGroup) Processes() ([]int, error) {
+	return f.pids, nil
+}
+
+func (f *fakeGroup) MoveTo(destination controlGroup) error {
+	for _, pid := range f.pids {
+		destination.Add(pid)
+	}
+	f.pids = nil
+	return nil
+}
+
+func (f *fakeGroup) Usage() (*Usage, error) {
+	return &Usage{Pids: uint64(len(f.pids)), Frozen: f.frozen}, nil
+}
+
+func (f *fakeGroup) MemoryEvents() (*MemoryEvents, error) {
+	return &f.events, nil
+}
+
+func (f *fakeGroup) MemoryPressure() (*Pressure, error) {
+	return f.pressure, nil
+}
+
+func (f *fakeGroup) WatchMemory() (*os.File, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (f *fakeGroup) Freeze() error {
+	f.frozen = true
+	return nil
+}
+
+func (f *fakeGroup) Thaw() error {
+	f.frozen = false
+	return nil
+}
+
+func (f *fakeGroup) Delete() error {
+	return nil
+}
+
+func TestStatus(t *testing.T) {
+	log.InitLoggerForTests()
+	gh := GroupHierarchy{
+		subgroups: map[string]controlGroup{"g1": &fakeGroup{pids: []int{1, 2}}},
+		groups:    map[string]settings.Group{"g1": {RAM: 100}},
+	}
+	if err := gh.Freeze("g1"); err != nil {
+		t.Error("Could not freeze group", err)
+	}
+	status := gh.Status()["g1"]
+	if status.Limits.RAM != 100 || len(status.Members) != 2 {
+		t.Error("Bad status", status)
+	}
+	if status.Usage == nil || status.Usage.Pids != 2 || !status.Usage.Frozen {
+		t.Error("Bad usage", status.Usage)
+	}
+	if frozen, err := gh.Frozen("g1"); err != nil || !frozen {
+		t.Error("Group should be frozen", err)
+	}
+	if err := gh.Thaw("g1"); err != nil {
+		t.Error("Could not thaw group", err)
+	}
+	if frozen, err := gh.Frozen("g1"); err != nil || frozen {
+		t.Error("Group should be thawed", err)
+	}
+}
+
+func TestTemplateGroup(t *testing.T) {
+	log.InitLoggerForTests()
+	origins, cleanup := testOrigins(t, "fetter")
+	defer cleanup()
+	gh := GroupHierarchy{
+		subgroups: map[string]controlGroup{"g1": &fakeGroup{}, "g2": &fakeGroup{}},
+		groups:    map[string]settings.Group{"g1": {RAM: 100, Template: true}, "g2": {}},
+		instances: make(map[string]controlGroup),
+		origins:   origins,
+	}
+	pid := os.Getpid()
+	name := fmt.Sprintf("g1/%d-%d", os.Getuid(), pid)
+	if err := gh.Move(pid, "g1/{uid}-{pid}"); err != nil {
+		t.Fatal("Could not move to template group", err)
+	}
+	status, ok := gh.Status()[name]
+	if !ok || status.Limits.RAM != 100 || len(status.Members) != 1 {
+		t.Error("Bad status of instance", gh.Status())
+	}
+	for _, bad := range []string{"g1", "g1/{rule}", "g2/{uid}"} {
+		if err := gh.Move(pid, bad); err == nil {
+			t.Error("Moving should fail for", bad)
+		}
+	}
+	if err := gh.Freeze(name); err != nil {
+		t.Error("Could not freeze instance", err)
+	}
+	if err := gh.Freeze("g1"); err != nil {
+		t.Error("Could not freeze template group", err)
+	}
+	gh.CollectInstances()
+	if _, ok := gh.instances[name]; !ok {
+		t.Error("Instance with processes should not be collected")
+	}
+	gh.instances[name].(*fakeGroup).pids = nil
+	gh.CollectInstances()
+	if _, ok := gh.instances[name]; ok {
+		t.Error("Empty instance should be collected")
+	}
+	// Loaded hierarchies leave creating instances to the fetter running
+	gh.loaded, gh.name = true, "fetter-testing-no-such-group"
+	if err := gh.Move(pid, "g1/{uid}-{pid}"); err == nil || len(gh.instances) != 0 {
+		t.Error("Instances should not be created in loaded hierarchies", gh.instances)
+	}
+}
+
+func TestApplySchedules(t *testing.T) {
+	log.InitLoggerForTests()
+	weekdays, _ := settings.ParseWeekdays("mon-fri")
+	configured := settings.Group{Pids: 10, Schedule: []settings.Window{
+		{Days: weekdays, From: 9 * 60, To: 18 * 60, Limits: settings.Group{RAM: 100 * settings.Megabyte, Freeze: true}},
+	}}
+	subgroup := &fakeGroup{}
+	gh := GroupHierarchy{
+		subgroups:  map[string]controlGroup{"g1": subgroup},
+		groups:     map[string]settings.Group{"g1": configured},
+		configured: map[string]settings.Group{"g1": configured},
+		windows:    map[string]int{"g1": -1},
+	}
+	// 2024-01-05 is a Friday
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 1, 5, hour, minute, 0, 0, time.Local)
+	}
+	gh.applySchedules(at(8, 59))
+	if subgroup.spec != nil {
+		t.Error("Limits should not change before the window")
+	}
+	gh.applySchedules(at(9, 0))
+	if subgroup.spec == nil || *subgroup.spec.Memory.Limit != int64(100*settings.Megabyte) || subgroup.spec.Pids.Limit != -1 {
+		t.Fatal("Limits of the window should be applied", subgroup.spec)
+	}
+	if status := gh.Status()["g1"]; status.Limits.RAM != 100*settings.Megabyte || !subgroup.frozen {
+		t.Error("Status should show limits of the window", status.Limits)
+	}
+	subgroup.spec = nil
+	gh.applySchedules(at(12, 0))
+	if subgroup.spec != nil {
+		t.Error("Limits should not change within the window")
+	}
+	gh.applySchedules(at(18, 0))
+	if subgroup.spec == nil || *subgroup.spec.Memory.Limit != -1 || subgroup.spec.Pids.Limit != 10 || subgroup.frozen {
+		t.Error("Limits of the group should be back", subgroup.spec)
+	}
+	if gh.windows["g1"] != -1 || gh.Status()["g1"].Limits.RAM != 0 {
+		t.Error("Window should be left", gh.windows)
+	}
+	// Loaded hierarchies are left as they are
+	subgroup.spec = nil
+	gh.loaded = true
+	gh.applySchedules(at(9, 0))
+	gh.Reload(&settings.Settings{})
+	if subgroup.spec != nil || subgroup.frozen || len(gh.subgroups) != 1 {
+		t.Error("Loaded groups should not change", subgroup.spec)
+	}
+}
+
+func TestApplySchedulesRetry(t *testing.T) {
+	log.InitLoggerForTests()
+	configured := settings.Group{Schedule: []settings.Window{{Limits: settings.Group{RAM: 100 * settings.Megabyte}}}}
+	subgroup := &fakeGroup{updateErr: fmt.Errorf("busy")}
+	gh := GroupHierarchy{
+		subgroups:  map[string]controlGroup{"g1": subgroup},
+		groups:     map[string]settings.Group{"g1": {}},
+		configured: map[string]settings.Group{"g1": configured, "g2": configured},
+		windows:    map[string]int{"g1": -1},
+	}
+	gh.ApplySchedules()
+	if gh.windows["g1"] != -1 || gh.groups["g1"].RAM != 0 {
+		t.Error("Window should not be entered if limits are not applied", gh.windows)
+	}
+	subgroup.updateErr = nil
+	gh.ApplySchedules()
+	if gh.windows["g1"] != 0 || gh.groups["g1"].RAM != 100*settings.Megabyte {
+		t.Error("Window should be entered on next try", gh.windows)
+	}
+	if _, ok := gh.windows["g2"]; ok {
+		t.Error("Groups not set up should be left alone", gh.windows)
+	}
+}
+
+func TestExpandKey(t *testing.T) {
+	pid := os.Getpid()
+	key, err := expandKey("{uid}-{pid}", pid)
+	if err != nil || key != fmt.Sprintf("%d-%d", os.Getuid(), pid) {
+		t.Error("Bad key", key, err)
+	}
+	if u, err := user.Current(); err == nil {
+		if key, err := expandKey("{user}", pid); err != nil || key != u.Username {
+			t.Error("Bad key", key, err)
+		}
+	}
+	if _, err := expandKey("{rule}", pid); err == nil {
+		t.Error("Rule placeholder should not be expanded")
+	}
+}
+
+func TestCollector(t *testing.T) {
+	log.InitLoggerForTests()
+	gh := GroupHierarchy{
+		subgroups: map[string]controlGroup{"g1": &fakeGroup{pids: []int{1}}, "g2": &fakeGroup{}},
+		groups:    map[string]settings.Group{"g1": {}, "g2": {}},
+	}
+	if count := testutil.CollectAndCount(gh.Collector()); count != 10 {
+		t.Error("Bad number of metrics collected", count)
+	}
+}
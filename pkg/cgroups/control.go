@@ -0,0 +1,73 @@
+package cgroups
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/cgroups"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// controlGroup abstracts the operations fetter needs from a single control
+// group, so that GroupHierarchy does not care about the hierarchy (V1 or
+// unified V2) mounted in the system.
+type controlGroup interface {
+	// New creates a control group under the calling one
+	New(name string, spec *specs.LinuxResources) (controlGroup, error)
+	// Add adds a process to the control group
+	Add(pid int) error
+	// Update applies spec to the control group, keeping its processes
+	Update(spec *specs.LinuxResources) error
+	// Processes returns the pids of the processes in the control group (and
+	// its children)
+	Processes() ([]int, error)
+	// MoveTo moves all the processes in the control group (and its children)
+	// to destination
+	MoveTo(destination controlGroup) error
+	// Usage returns the resources used by the processes in the control group
+	Usage() (*Usage, error)
+	// MemoryEvents returns the memory events (like OOM kills) counted in the
+	// control group since it was created
+	MemoryEvents() (*MemoryEvents, error)
+	// MemoryPressure returns the memory pressure of the control group, or nil
+	// if the kernel does not track it
+	MemoryPressure() (*Pressure, error)
+	// WatchMemory returns a file that becomes readable whenever there may be
+	// new memory events
+	WatchMemory() (*os.File, error)
+	// Freeze freezes all processes inside the control group
+	Freeze() error
+	// Thaw resumes all processes inside the control group
+	Thaw() error
+	// Delete removes the control group (and its children)
+	Delete() error
+}
+
+// unified tells whether the system is using cgroup v2 unified hierarchy only.
+// Hybrid systems (v1 controllers with a v2 mount for systemd) are managed as
+// V1, since that is where the controllers are.
+func unified() bool {
+	return cgroups.Mode() == cgroups.Unified
+}
+
+// newControlGroup creates (or reuses, if already there) a top level control
+// group named name.
+func newControlGroup(name string) (controlGroup, error) {
+	if unified() {
+		return newV2Group(name)
+	}
+	return newV1Group(name)
+}
+
+// loadControlGroup loads an already existing top level control group.  An
+// empty name stands for the root control group.
+func loadControlGroup(name string) (controlGroup, error) {
+	if unified() {
+		// Loading a v2 group does not check it is there
+		if _, err := os.Stat(filepath.Join(unifiedMountpoint, name)); err != nil {
+			return nil, err
+		}
+		return loadV2Group(name)
+	}
+	return loadV1Group(name)
+}
@@ -0,0 +1,336 @@
+package cgroups
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/metrics"
+	"github.com/juan-leon/fetter/pkg/settings"
+	"github.com/juan-leon/fetter/pkg/triggers"
+)
+
+// How often memory pressure is checked.  Memory events are checked too, in
+// case a notification was missed, and control groups created since are
+// watched.
+const pressureInterval = 10 * time.Second
+
+// How long after a notification control groups are checked again: V1
+// hierarchies notify OOM events before the OOM killer is done (and has counted
+// its kills).
+const recheckDelay = 500 * time.Millisecond
+
+// MemoryEvents holds the memory events of a control group, as counted by the
+// kernel since the control group was created.  V1 hierarchies count only OOM
+// kills and max (as the times the limit was hit, from memory.failcnt; close
+// to, but not quite, the V2 event).
+type MemoryEvents struct {
+	High    uint64 `json:"high"`     // times it was throttled for going over ram_high
+	Max     uint64 `json:"max"`      // times it was about to go over ram
+	OOM     uint64 `json:"oom"`      // times the OOM killer was invoked
+	OOMKill uint64 `json:"oom_kill"` // processes killed by the OOM killer
+	// Processes wait for memory, as the OOM killer is disabled (V1 only)
+	UnderOOM bool `json:"under_oom"`
+}
+
+// Pressure holds the %-age of time that some (or all) processes of a control
+// group were stalled waiting for memory, averaged over the last 10, 60 and 300
+// seconds
+type Pressure struct {
+	SomeAvg10  float64 `json:"some_avg10"`
+	SomeAvg60  float64 `json:"some_avg60"`
+	SomeAvg300 float64 `json:"some_avg300"`
+	FullAvg10  float64 `json:"full_avg10"`
+	FullAvg60  float64 `json:"full_avg60"`
+	FullAvg300 float64 `json:"full_avg300"`
+}
+
+// Memory events, as labelled in metrics
+var memoryEventNames = []string{"high", "max", "oom", "oom_kill", "pressure"}
+
+// memoryWatch is what is known about the memory of a watched control group
+type memoryWatch struct {
+	file     *os.File // nil if notifications are not available
+	events   MemoryEvents
+	pressure *Pressure
+	pressed  bool // pressure was over the threshold last time
+}
+
+// WatchMemory watches the memory events and pressure of the control groups in
+// the hierarchy until ctx is cancelled.  OOM events, and pressure going over
+// the threshold of a group, are logged, counted in metrics and reported to the
+// triggers configured for the group, run through runner.
+func (gh *GroupHierarchy) WatchMemory(ctx context.Context, runner triggers.ProcessRunner) {
+	watches := make(map[string]*memoryWatch)
+	wakeups, rechecks := make(chan string), make(chan string)
+	defer func() {
+		for _, w := range watches {
+			w.close()
+		}
+	}()
+	ticker := time.NewTicker(pressureInterval)
+	defer ticker.Stop()
+	for {
+		gh.syncWatches(ctx, watches, wakeups)
+		select {
+		case <-ctx.Done():
+			return
+		case name := <-wakeups:
+			if w, ok := watches[name]; ok {
+				gh.checkMemory(name, w, runner, false)
+				time.AfterFunc(recheckDelay, func() {
+					select {
+					case rechecks <- name:
+					case <-ctx.Done():
+					}
+				})
+			}
+		case name := <-rechecks:
+			if w, ok := watches[name]; ok {
+				gh.checkMemory(name, w, runner, false)
+			}
+		case <-ticker.C:
+			for name, w := range watches {
+				gh.checkMemory(name, w, runner, true)
+			}
+		}
+	}
+}
+
+// syncWatches starts watching the control groups not watched yet, and stops
+// watching those gone.  Template groups are not watched, but their instances
+// are.
+func (gh *GroupHierarchy) syncWatches(ctx context.Context, watches map[string]*memoryWatch, wakeups chan<- string) {
+	gh.mu.RLock()
+	defer gh.mu.RUnlock()
+	current := make(map[string]controlGroup)
+	for name, subgroup := range gh.subgroups {
+		if !gh.groups[name].Template {
+			current[name] = subgroup
+		}
+	}
+	for name, instance := range gh.instances {
+		current[name] = instance
+	}
+	for name, w := range watches {
+		if _, ok := current[name]; !ok {
+			w.close()
+			delete(watches, name)
+		}
+	}
+	for name, cg := range current {
+		if _, ok := watches[name]; ok {
+			continue
+		}
+		w := &memoryWatch{}
+		if events, err := cg.MemoryEvents(); err == nil {
+			w.events = *events
+		} else {
+			log.Logger.Debugf("Could not read memory events of %s: %s", name, err)
+		}
+		file, err := cg.WatchMemory()
+		if err != nil {
+			log.Logger.Debugf("Could not watch memory events of %s: %s", name, err)
+		} else {
+			w.file = file
+			go waitMemory(ctx, name, file, wakeups)
+		}
+		watches[name] = w
+	}
+}
+
+// waitMemory sends name to wakeups whenever file becomes readable, until file
+// is closed or ctx is cancelled
+func waitMemory(ctx context.Context, name string, file *os.File, wakeups chan<- string) {
+	buf := make([]byte, 4096)
+	for {
+		if _, err := file.Read(buf); err != nil {
+			return
+		}
+		select {
+		case wakeups <- name:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkMemory compares the memory events of a control group with those seen
+// before, and its memory pressure (if withPressure is true) with the threshold
+// of the group
+func (gh *GroupHierarchy) checkMemory(name string, w *memoryWatch, runner triggers.ProcessRunner, withPressure bool) {
+	gh.mu.RLock()
+	group, _ := settings.SplitGroup(name)
+	g := gh.groups[group]
+	cg, ok := gh.subgroups[name]
+	if !ok {
+		cg, ok = gh.instances[name]
+	}
+	gh.mu.RUnlock()
+	if !ok {
+		return
+	}
+	events, err := cg.MemoryEvents()
+	if err != nil {
+		log.Logger.Debugf("Could not read memory events of %s: %s", name, err)
+		return
+	}
+	if withPressure {
+		if w.pressure, err = cg.MemoryPressure(); err != nil {
+			log.Logger.Debugf("Could not read memory pressure of %s: %s", name, err)
+		}
+	}
+	oom := w.count(name, events)
+	if oom {
+		log.Logger.Warnw("Out of memory", "group", name, "oom", events.OOM, "oom_kill", events.OOMKill, "under_oom", events.UnderOOM)
+		if g.OOMTrigger != "" {
+			runner.Run(g.OOMTrigger, w.data(name, "oom"))
+		}
+	}
+	if w.pressure == nil || !withPressure {
+		return
+	}
+	pressed := w.pressure.SomeAvg10 >= g.GetPressureThreshold()
+	if pressed && !w.pressed {
+		log.Logger.Warnw("Memory pressure over threshold", "group", name, "some_avg10", w.pressure.SomeAvg10, "full_avg10", w.pressure.FullAvg10)
+		metrics.MemoryEvents.WithLabelValues(name, "pressure").Inc()
+		if g.PressureTrigger != "" {
+			runner.Run(g.PressureTrigger, w.data(name, "pressure"))
+		}
+	} else if !pressed && w.pressed {
+		log.Logger.Infow("Memory pressure back under threshold", "group", name, "some_avg10", w.pressure.SomeAvg10)
+	}
+	w.pressed = pressed
+}
+
+// count counts in metrics the events since last time, labelled by the name of
+// the control group (like the usage of groups), and tells whether there was an
+// OOM event: the OOM killer was invoked, or processes started waiting for
+// memory
+func (w *memoryWatch) count(name string, events *MemoryEvents) (oom bool) {
+	for _, counter := range []struct {
+		event       string
+		now, before uint64
+	}{
+		{"high", events.High, w.events.High},
+		{"max", events.Max, w.events.Max},
+		{"oom", events.OOM, w.events.OOM},
+		{"oom_kill", events.OOMKill, w.events.OOMKill},
+	} {
+		if counter.now > counter.before {
+			metrics.MemoryEvents.WithLabelValues(name, counter.event).Add(float64(counter.now - counter.before))
+		}
+	}
+	oom = events.OOM > w.events.OOM || events.OOMKill > w.events.OOMKill || (events.UnderOOM && !w.events.UnderOOM)
+	if events.High > w.events.High {
+		log.Logger.Debugw("Memory over ram_high", "group", name, "high", events.High)
+	}
+	w.events = *events
+	return
+}
+
+// data returns the data for the triggers of a control group (that get it in
+// their environment, like FETTER_GROUP)
+func (w *memoryWatch) data(name, event string) *map[string]string {
+	data := map[string]string{
+		"group":    name,
+		"event":    event,
+		"oom":      strconv.FormatUint(w.events.OOM, 10),
+		"oom_kill": strconv.FormatUint(w.events.OOMKill, 10),
+	}
+	if p := w.pressure; p != nil {
+		for key, value := range map[string]float64{
+			"some_avg10": p.SomeAvg10, "some_avg60": p.SomeAvg60, "some_avg300": p.SomeAvg300,
+			"full_avg10": p.FullAvg10, "full_avg60": p.FullAvg60, "full_avg300": p.FullAvg300,
+		} {
+			data["pressure_"+key] = strconv.FormatFloat(value, 'f', 2, 64)
+		}
+	}
+	return &data
+}
+
+func (w *memoryWatch) close() {
+	if w.file != nil {
+		w.file.Close()
+	}
+}
+
+// pollable makes a file out of a file descriptor (like an eventfd), in non
+// blocking mode so that closing the file ends pending reads
+func pollable(fd int, name string) (*os.File, error) {
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// parseCounters parses lines of keys and counters, like those of memory.events
+func parseCounters(data string) (map[string]uint64, error) {
+	counters := make(map[string]uint64)
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid counter: %q", line)
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid counter: %q", line)
+		}
+		counters[fields[0]] = n
+	}
+	return counters, nil
+}
+
+// parsePressure parses pressure stall information, like that of
+// memory.pressure:
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func parsePressure(data string) (*Pressure, error) {
+	p := &Pressure{}
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var averages [3]*float64
+		switch fields[0] {
+		case "some":
+			averages = [3]*float64{&p.SomeAvg10, &p.SomeAvg60, &p.SomeAvg300}
+		case "full":
+			averages = [3]*float64{&p.FullAvg10, &p.FullAvg60, &p.FullAvg300}
+		default:
+			return nil, fmt.Errorf("invalid pressure: %q", line)
+		}
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid pressure: %q", line)
+			}
+			var target *float64
+			switch parts[0] {
+			case "avg10":
+				target = averages[0]
+			case "avg60":
+				target = averages[1]
+			case "avg300":
+				target = averages[2]
+			default:
+				continue
+			}
+			value, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pressure: %q", line)
+			}
+			*target = value
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,103 @@
+package cgroups
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/metrics"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+func TestParseCounters(t *testing.T) {
+	counters, err := parseCounters("low 0\nhigh 3\nmax 12\noom 1\noom_kill 1\n")
+	expected := map[string]uint64{"low": 0, "high": 3, "max": 12, "oom": 1, "oom_kill": 1}
+	if err != nil || !reflect.DeepEqual(counters, expected) {
+		t.Error("Bad counters", counters, err)
+	}
+	if _, err := parseCounters("oom one"); err == nil {
+		t.Error("Should fail to parse bad counters")
+	}
+}
+
+func TestParsePressure(t *testing.T) {
+	p, err := parsePressure("some avg10=1.50 avg60=0.75 avg300=0.10 total=12345\nfull avg10=0.50 avg60=0.25 avg300=0.00 total=678\n")
+	expected := &Pressure{1.5, 0.75, 0.1, 0.5, 0.25, 0}
+	if err != nil || !reflect.DeepEqual(p, expected) {
+		t.Error("Bad pressure", p, err)
+	}
+	for _, data := range []string{"some avg10", "some avg10=high", "partial avg10=1.00"} {
+		if _, err := parsePressure(data); err == nil {
+			t.Error("Should fail to parse", data)
+		}
+	}
+}
+
+// fakeRunner is a ProcessRunner that records the triggers run
+type fakeRunner struct {
+	runs []map[string]string
+}
+
+func (f *fakeRunner) Run(name string, data *map[string]string) error {
+	run := map[string]string{"trigger": name}
+	for k, v := range *data {
+		run[k] = v
+	}
+	f.runs = append(f.runs, run)
+	return nil
+}
+
+func TestCheckMemory(t *testing.T) {
+	log.InitLoggerForTests()
+	g1 := &fakeGroup{}
+	gh := GroupHierarchy{
+		subgroups: map[string]controlGroup{"g1": g1},
+		groups:    map[string]settings.Group{"g1": {OOMTrigger: "oom", PressureTrigger: "pressure", PressureThreshold: 20}},
+	}
+	runner := &fakeRunner{}
+	w := &memoryWatch{}
+	gh.checkMemory("g1", w, runner, true)
+	if len(runner.runs) != 0 {
+		t.Error("Nothing should have been triggered", runner.runs)
+	}
+	kills := testutil.ToFloat64(metrics.MemoryEvents.WithLabelValues("g1", "oom_kill"))
+	g1.events = MemoryEvents{Max: 4, OOM: 1, OOMKill: 2}
+	g1.pressure = &Pressure{SomeAvg10: 25, FullAvg10: 5}
+	gh.checkMemory("g1", w, runner, false)
+	if len(runner.runs) != 1 || runner.runs[0]["trigger"] != "oom" || runner.runs[0]["oom_kill"] != "2" || runner.runs[0]["group"] != "g1" {
+		t.Error("OOM trigger should have run", runner.runs)
+	}
+	if count := testutil.ToFloat64(metrics.MemoryEvents.WithLabelValues("g1", "oom_kill")); count != kills+2 {
+		t.Error("OOM kills should be counted", count)
+	}
+	gh.checkMemory("g1", w, runner, true)
+	if len(runner.runs) != 2 || runner.runs[1]["trigger"] != "pressure" || runner.runs[1]["pressure_some_avg10"] != "25.00" {
+		t.Error("Pressure trigger should have run", runner.runs)
+	}
+	gh.checkMemory("g1", w, runner, true)
+	if len(runner.runs) != 2 {
+		t.Error("Pressure trigger should run once while over threshold", runner.runs)
+	}
+	g1.pressure.SomeAvg10 = 10
+	gh.checkMemory("g1", w, runner, true)
+	g1.pressure.SomeAvg10 = 30
+	gh.checkMemory("g1", w, runner, true)
+	if len(runner.runs) != 3 {
+		t.Error("Pressure trigger should run again after going under threshold", runner.runs)
+	}
+	// Instances are counted on their own, like in the usage of groups
+	instance := &fakeGroup{events: MemoryEvents{OOMKill: 1}}
+	gh.subgroups["browsers"] = &fakeGroup{}
+	gh.groups["browsers"] = settings.Group{Template: true}
+	gh.instances = map[string]controlGroup{"browsers/alice": instance}
+	gh.checkMemory("browsers/alice", &memoryWatch{}, runner, true)
+	if count := testutil.ToFloat64(metrics.MemoryEvents.WithLabelValues("browsers/alice", "oom_kill")); count != 1 {
+		t.Error("OOM kills of instances should be counted by instance", count)
+	}
+	gh.deleteInstance("browsers/alice")
+	if count := testutil.ToFloat64(metrics.MemoryEvents.WithLabelValues("browsers/alice", "oom_kill")); count != 0 {
+		t.Error("Events of deleted instances should be gone", count)
+	}
+}
@@ -0,0 +1,81 @@
+package cgroups
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	memoryDesc = prometheus.NewDesc(
+		"fetter_group_memory_bytes",
+		"Memory used by the processes in a control group.",
+		[]string{"group"}, nil,
+	)
+	cpuDesc = prometheus.NewDesc(
+		"fetter_group_cpu_seconds_total",
+		"CPU time used by the processes in a control group.",
+		[]string{"group"}, nil,
+	)
+	throttledDesc = prometheus.NewDesc(
+		"fetter_group_cpu_throttled_periods_total",
+		"Periods the processes in a control group were throttled for exceeding their CPU limit.",
+		[]string{"group"}, nil,
+	)
+	pidsDesc = prometheus.NewDesc(
+		"fetter_group_pids",
+		"Processes (and threads) in a control group.",
+		[]string{"group"}, nil,
+	)
+	pressureDesc = prometheus.NewDesc(
+		"fetter_group_memory_pressure",
+		"Share of time (in %) some or all processes in a control group were stalled waiting for memory, over the last 10 seconds.",
+		[]string{"group", "kind"}, nil,
+	)
+	frozenDesc = prometheus.NewDesc(
+		"fetter_group_frozen",
+		"Whether a control group is frozen.",
+		[]string{"group"}, nil,
+	)
+)
+
+// groupCollector exposes the usage of resources of the control groups in a
+// hierarchy as metrics, read from control group stats on every scrape
+type groupCollector struct {
+	gh *GroupHierarchy
+}
+
+// Collector returns a prometheus collector for the usage of resources of the
+// control groups in the hierarchy
+func (gh *GroupHierarchy) Collector() prometheus.Collector {
+	return groupCollector{gh: gh}
+}
+
+func (c groupCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- memoryDesc
+	ch <- cpuDesc
+	ch <- throttledDesc
+	ch <- pidsDesc
+	ch <- pressureDesc
+	ch <- frozenDesc
+}
+
+func (c groupCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, status := range c.gh.Status() {
+		usage := status.Usage
+		if usage == nil {
+			continue
+		}
+		frozen := 0.0
+		if usage.Frozen {
+			frozen = 1
+		}
+		ch <- prometheus.MustNewConstMetric(memoryDesc, prometheus.GaugeValue, float64(usage.Memory), name)
+		ch <- prometheus.MustNewConstMetric(cpuDesc, prometheus.CounterValue, float64(usage.CPU)/1e9, name)
+		ch <- prometheus.MustNewConstMetric(throttledDesc, prometheus.CounterValue, float64(usage.Throttled), name)
+		ch <- prometheus.MustNewConstMetric(pidsDesc, prometheus.GaugeValue, float64(usage.Pids), name)
+		if p := usage.MemoryPressure; p != nil {
+			ch <- prometheus.MustNewConstMetric(pressureDesc, prometheus.GaugeValue, p.SomeAvg10, name, "some")
+			ch <- prometheus.MustNewConstMetric(pressureDesc, prometheus.GaugeValue, p.FullAvg10, name, "full")
+		}
+		ch <- prometheus.MustNewConstMetric(frozenDesc, prometheus.GaugeValue, frozen, name)
+	}
+}
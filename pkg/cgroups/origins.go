@@ -0,0 +1,226 @@
+package cgroups
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/cgroups"
+	"github.com/shirou/gopsutil/process"
+)
+
+// Where the origins of moved processes are recorded, under a directory named
+// after the hierarchy
+const originsDir = "/run/fetter"
+
+// How often (in number of processes moved) the origins of moved processes are
+// checked for processes no longer running.
+const originsPruneSize = 1024
+
+// originStore records the control groups moved processes were in before, so
+// that they can be moved back, even by another fetter process (like the
+// release subcommand).  There is a file per process, named after its pid and
+// holding a copy of /proc/<pid>/cgroup at the time it was moved.
+type originStore struct {
+	mu        sync.Mutex // for saving, that is done without the hierarchy locked
+	dir       string
+	hierarchy string // path of the hierarchy, like "/fetter"
+	saved     int    // since last pruning
+}
+
+func newOriginStore(name string) *originStore {
+	return &originStore{
+		dir:       filepath.Join(originsDir, name, "origins"),
+		hierarchy: filepath.Join("/", name),
+	}
+}
+
+// record takes note of the control group a process is in, unless it was noted
+// already or it is in the hierarchy (so moves between fetter groups do not
+// count).
+func (s *originStore) record(pid int) error {
+	origin, err := s.current(pid)
+	if err != nil {
+		return err
+	}
+	return s.save(pid, origin)
+}
+
+// current returns what record would take note of for a process (a copy of its
+// /proc/<pid>/cgroup), or nil if there is nothing to note.  Along with save,
+// it allows reading the origin before a process is moved, but saving it only
+// once moved.
+func (s *originStore) current(pid int) ([]byte, error) {
+	if _, ok := s.path(pid); ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil, err
+	}
+	paths, err := parseGroupPaths(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if s.inside(paths) {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// save takes note of the origin of a process, as returned by current
+func (s *originStore) save(pid int, origin []byte) error {
+	if origin == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.saved++; s.saved == originsPruneSize {
+		s.prune()
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.file(pid), origin, 0600)
+}
+
+// moved tells whether a process is in the hierarchy
+func (s *originStore) moved(pid int) (bool, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return false, err
+	}
+	paths, err := parseGroupPaths(string(data))
+	if err != nil {
+		return false, err
+	}
+	return s.inside(paths), nil
+}
+
+// group returns the configured group a process is in (for instances of
+// template groups, the template), or "" if it is not in the hierarchy
+func (s *originStore) group(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	paths, err := parseGroupPaths(string(data))
+	if err != nil {
+		return "", err
+	}
+	return s.groupOf(paths), nil
+}
+
+// groupOf returns the configured group for paths, as parsed by
+// parseGroupPaths, or "" if they are not in the hierarchy
+func (s *originStore) groupOf(paths map[string]string) string {
+	if !s.inside(paths) {
+		return ""
+	}
+	rel := strings.TrimPrefix(mainPath(paths), s.hierarchy+"/")
+	return strings.SplitN(rel, "/", 2)[0]
+}
+
+// inside tells whether paths, as parsed by parseGroupPaths, are in the
+// hierarchy
+func (s *originStore) inside(paths map[string]string) bool {
+	return strings.HasPrefix(mainPath(paths)+"/", s.hierarchy+"/")
+}
+
+// load returns the control group a process was in before being moved, or nil
+// if that is not known
+func (s *originStore) load(pid int) (controlGroup, error) {
+	file, ok := s.path(pid)
+	if !ok {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := parseGroupPaths(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if unified() {
+		return loadV2Group(mainPath(paths))
+	}
+	return loadV1SavedGroup(paths)
+}
+
+// forget removes the record of a process
+func (s *originStore) forget(pid int) {
+	os.Remove(s.file(pid))
+}
+
+// prune forgets about processes that are gone
+func (s *originStore) prune() {
+	s.saved = 0
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if pid, err := strconv.Atoi(f.Name()); err == nil {
+			if _, ok := s.path(pid); !ok {
+				s.forget(pid)
+			}
+		}
+	}
+}
+
+func (s *originStore) file(pid int) string {
+	return filepath.Join(s.dir, strconv.Itoa(pid))
+}
+
+// path returns the file recording the origin of a process, if there is one
+// and it is not stale: a record older than the process belongs to a previous
+// process with the same pid.  Creation times of processes are not that
+// precise, hence the margin.
+func (s *originStore) path(pid int) (string, bool) {
+	file := s.file(pid)
+	info, err := os.Stat(file)
+	if err != nil {
+		return file, false
+	}
+	p, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return file, false
+	}
+	created, err := p.CreateTime()
+	if err != nil {
+		return file, false
+	}
+	return file, info.ModTime().After(time.Unix(0, created*int64(time.Millisecond)).Add(-2 * time.Second))
+}
+
+// parseGroupPaths parses the contents of a /proc/<pid>/cgroup file into the
+// paths of the process control groups, indexed by subsystem.  The path in the
+// unified hierarchy, if any, is indexed by an empty string.
+func parseGroupPaths(data string) (map[string]string, error) {
+	paths := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("invalid cgroup entry: %q", line)
+		}
+		for _, subsystem := range strings.Split(parts[1], ",") {
+			paths[subsystem] = parts[2]
+		}
+	}
+	return paths, nil
+}
+
+// mainPath returns, among paths, the one fetter relies on: the unified one, or
+// the freezer one in V1 hierarchies
+func mainPath(paths map[string]string) string {
+	if unified() {
+		return paths[""]
+	}
+	return paths[string(cgroups.Freezer)]
+}
@@ -0,0 +1,149 @@
+package cgroups
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testOrigins creates an originStore for hierarchy name in a temporary
+// directory, and a function for removing it
+func testOrigins(t *testing.T, name string) (*originStore, func()) {
+	dir, err := ioutil.TempDir("", "fetter")
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to create dir", err)
+	}
+	origins := newOriginStore(name)
+	origins.dir = dir
+	return origins, func() { os.RemoveAll(dir) }
+}
+
+func TestRecordOrigin(t *testing.T) {
+	origins, cleanup := testOrigins(t, "fetter")
+	defer cleanup()
+	pid := os.Getpid()
+	if err := origins.record(pid); err != nil {
+		t.Fatal("Could not record origin", err)
+	}
+	file, ok := origins.path(pid)
+	if !ok {
+		t.Fatal("Origin should be recorded")
+	}
+	expected, _ := ioutil.ReadFile("/proc/self/cgroup")
+	if data, _ := ioutil.ReadFile(file); !reflect.DeepEqual(data, expected) {
+		t.Error("Bad origin recorded", string(data))
+	}
+	if moved, err := origins.moved(pid); err != nil || moved {
+		t.Error("Process should not be in the hierarchy", err)
+	}
+	origins.forget(pid)
+	if _, ok := origins.path(pid); ok {
+		t.Error("Origin should be forgotten")
+	}
+}
+
+func TestRecordOriginInHierarchy(t *testing.T) {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to read cgroup", err)
+	}
+	paths, err := parseGroupPaths(string(data))
+	if err != nil {
+		t.Fatal("Could not parse cgroup", err)
+	}
+	// As if the hierarchy was the control group the test runs in
+	origins, cleanup := testOrigins(t, mainPath(paths))
+	defer cleanup()
+	if err := origins.record(os.Getpid()); err != nil {
+		t.Fatal("Could not record origin", err)
+	}
+	if _, ok := origins.path(os.Getpid()); ok {
+		t.Error("Origin should not be recorded for processes in the hierarchy")
+	}
+	if moved, err := origins.moved(os.Getpid()); err != nil || !moved {
+		t.Error("Process should be in the hierarchy", err)
+	}
+}
+
+func TestGroupOf(t *testing.T) {
+	origins, cleanup := testOrigins(t, "fetter")
+	defer cleanup()
+	for path, expected := range map[string]string{
+		"/fetter/slow":         "slow",
+		"/fetter/tight/alice":  "tight",
+		"/fetter":              "",
+		"/fetterless/slow":     "",
+		"/user.slice/fetter/x": "",
+	} {
+		paths, err := parseGroupPaths(fmt.Sprintf("0::%s\n1:freezer:%s\n", path, path))
+		if err != nil {
+			t.Fatal("Could not parse cgroup", err)
+		}
+		if group := origins.groupOf(paths); group != expected {
+			t.Errorf("Bad group for %s: %q", path, group)
+		}
+	}
+	if group, err := origins.group(os.Getpid()); err != nil || group != "" {
+		t.Error("Process should not be in a group", group, err)
+	}
+}
+
+func TestStaleOrigin(t *testing.T) {
+	origins, cleanup := testOrigins(t, "fetter")
+	defer cleanup()
+	pid := os.Getpid()
+	if err := ioutil.WriteFile(origins.file(pid), []byte("0::/\n"), 0600); err != nil {
+		t.Fatal("Test cannot continue; failed to write file", err)
+	}
+	old := time.Now().Add(-time.Hour * 24 * 365 * 10)
+	if err := os.Chtimes(origins.file(pid), old, old); err != nil {
+		t.Fatal("Test cannot continue; failed to change times", err)
+	}
+	if _, ok := origins.path(pid); ok {
+		t.Error("Origin older than the process should be stale")
+	}
+}
+
+func TestPruneOrigins(t *testing.T) {
+	origins, cleanup := testOrigins(t, "fetter")
+	defer cleanup()
+	cmd := exec.Command("/bin/true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal("Test cannot continue; failed to run command", err)
+	}
+	for _, pid := range []int{os.Getpid(), cmd.Process.Pid} {
+		if err := ioutil.WriteFile(origins.file(pid), []byte("0::/\n"), 0600); err != nil {
+			t.Fatal("Test cannot continue; failed to write file", err)
+		}
+	}
+	origins.prune()
+	if _, err := os.Stat(origins.file(os.Getpid())); err != nil {
+		t.Error("Running process should not be pruned")
+	}
+	if _, err := os.Stat(origins.file(cmd.Process.Pid)); err == nil {
+		t.Error("Finished process should be pruned")
+	}
+}
+
+func TestParseGroupPaths(t *testing.T) {
+	paths, err := parseGroupPaths("12:cpu,cpuacct:/user.slice\n1:name=systemd:/user.slice/session-1.scope\n0::/init.scope\n")
+	if err != nil {
+		t.Fatal("Could not parse cgroup", err)
+	}
+	expected := map[string]string{
+		"cpu":          "/user.slice",
+		"cpuacct":      "/user.slice",
+		"name=systemd": "/user.slice/session-1.scope",
+		"":             "/init.scope",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Error("Bad paths", paths)
+	}
+	if _, err := parseGroupPaths("garbage"); err == nil {
+		t.Error("Parsing garbage should fail")
+	}
+}
@@ -1,10 +1,14 @@
 package cgroups
 
 import (
-	"runtime"
+	"math"
+	"sort"
+	"strconv"
 
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 
+	"github.com/juan-leon/fetter/pkg/cpuset"
+	"github.com/juan-leon/fetter/pkg/devices"
 	"github.com/juan-leon/fetter/pkg/log"
 	"github.com/juan-leon/fetter/pkg/settings"
 )
@@ -14,41 +18,241 @@ func emptySpec() *specs.LinuxResources {
 }
 
 var period = uint64(1000000)
-var numCPUs = runtime.NumCPU()
 
 func createSpec(name string, g *settings.Group) (spec *specs.LinuxResources) {
 	spec = emptySpec()
-	if g.CPU > 0 {
-		spec.CPU = specCPU(g.CPU)
+	if g.CPU > 0 || g.CPUWeight > 0 || g.CPUs != "" || g.Mems != "" {
+		spec.CPU = specCPU(g)
 	}
-	if g.RAM > 0 {
-		spec.Memory = specRAM(g.RAM)
+	if g.RAM > 0 || g.RAMSoft > 0 || g.Swap > 0 || g.OOMKillDisable {
+		spec.Memory = specRAM(g)
+	}
+	if g.RAMHigh > 0 {
+		setUnified(spec, "memory.high", strconv.FormatInt(int64(g.RAMHigh), 10))
+	}
+	if g.OOMGroup {
+		setUnified(spec, "memory.oom.group", "1")
 	}
 	if g.Pids > 0 {
-		spec.Pids = specPids(g.Pids)
+		spec.Pids = specPids(int64(g.Pids))
+	}
+	if g.IOWeight > 0 || len(g.IO) > 0 {
+		spec.BlockIO = specIO(name, g.IOWeight, g.IO, false)
 	}
 	log.Logger.Debugw("CGroup spec created", "cgroup", name, "spec", spec)
 	return
 }
 
-func specCPU(cpu int) (spec *specs.LinuxCPU) {
-	quota := int64(uint64(cpu) * period * uint64(numCPUs) / 100)
+// updateSpec is like createSpec, but limits not configured are explicitly set
+// as unlimited, so that they are lifted when updating a control group that had
+// them (as configured in old).
+func updateSpec(name string, old, g *settings.Group) (spec *specs.LinuxResources) {
+	spec = createSpec(name, g)
+	if spec.CPU == nil {
+		spec.CPU = &specs.LinuxCPU{}
+	}
+	if spec.CPU.Quota == nil {
+		quota := int64(-1)
+		spec.CPU.Quota, spec.CPU.Period = &quota, &period
+	}
+	if spec.CPU.Shares == nil {
+		shares := sharesScale.def
+		spec.CPU.Shares = &shares
+	}
+	// Only groups that were pinned are unpinned, to all online CPUs (or memory
+	// nodes): the rest are left alone, as they may be confined by their
+	// parents
+	if old.CPUs != "" && g.CPUs == "" {
+		spec.CPU.Cpus, _ = cpuset.OnlineCPUs()
+	}
+	if old.Mems != "" && g.Mems == "" {
+		spec.CPU.Mems, _ = cpuset.OnlineMems()
+	}
+	if spec.Memory == nil {
+		spec.Memory = &specs.LinuxMemory{}
+	}
+	unlimited := int64(-1)
+	if spec.Memory.Limit == nil {
+		spec.Memory.Limit = &unlimited
+	}
+	// As with pinning, the rest of memory settings are reset only if they
+	// were there, since some are not supported everywhere
+	if old.RAMSoft > 0 && g.RAMSoft == 0 {
+		spec.Memory.Reservation = &unlimited
+	}
+	if old.Swap > 0 && g.Swap == 0 {
+		spec.Memory.Swap = &unlimited
+	}
+	if old.OOMKillDisable && !g.OOMKillDisable {
+		enabled := false
+		spec.Memory.DisableOOMKiller = &enabled
+	}
+	if old.RAMHigh > 0 && g.RAMHigh == 0 {
+		setUnified(spec, "memory.high", "max")
+	}
+	if old.OOMGroup && !g.OOMGroup {
+		setUnified(spec, "memory.oom.group", "0")
+	}
+	if spec.Pids == nil {
+		spec.Pids = specPids(-1)
+	}
+	// The weight is reset only when no longer configured: groups without I/O
+	// settings are left alone, since I/O weights are often unsupported
+	weight := g.IOWeight
+	if old.IOWeight > 0 && weight == 0 {
+		weight = defaultWeight
+	}
+	// Devices no longer limited are kept, with zero (no limit) rates
+	limits := make(map[string]settings.IOLimit)
+	for device := range old.IO {
+		limits[device] = settings.IOLimit{}
+	}
+	for device, limit := range g.IO {
+		limits[device] = limit
+	}
+	if weight > 0 || len(limits) > 0 {
+		spec.BlockIO = specIO(name, weight, limits, true)
+	}
+	return
+}
+
+func specCPU(g *settings.Group) (spec *specs.LinuxCPU) {
 	spec = &specs.LinuxCPU{
-		Quota:  &quota,
-		Period: &period,
+		Cpus: g.CPUs,
+		Mems: g.Mems,
+	}
+	if g.CPU > 0 {
+		quota := int64(math.Round(float64(g.CPU) * float64(period)))
+		spec.Quota, spec.Period = &quota, &period
+	}
+	if g.CPUWeight > 0 {
+		shares := sharesScale.fromV2(g.CPUWeight)
+		spec.Shares = &shares
 	}
 	return
 }
 
-func specRAM(ram int64) (spec *specs.LinuxMemory) {
-	bytes := ram * 1024 * 1024
-	spec = &specs.LinuxMemory{
-		Limit: &bytes,
+// specRAM translates the memory settings of a group.  Swap is in the terms of
+// V1 hierarchies (memory plus swap), that the runtime spec uses; v2Values
+// translates it.
+func specRAM(g *settings.Group) (spec *specs.LinuxMemory) {
+	spec = &specs.LinuxMemory{}
+	if g.RAM > 0 {
+		limit := int64(g.RAM)
+		spec.Limit = &limit
+		if g.Swap > 0 {
+			swap := int64(g.RAM + g.Swap)
+			spec.Swap = &swap
+		}
+	}
+	if g.RAMSoft > 0 {
+		reservation := int64(g.RAMSoft)
+		spec.Reservation = &reservation
+	}
+	if g.OOMKillDisable {
+		disabled := true
+		spec.DisableOOMKiller = &disabled
 	}
 	return
 }
 
+// setUnified sets a value of an interface file of the unified hierarchy with
+// no counterpart in the runtime spec
+func setUnified(spec *specs.LinuxResources, key, value string) {
+	if spec.Unified == nil {
+		spec.Unified = make(map[string]string)
+	}
+	spec.Unified[key] = value
+}
+
 func specPids(pids int64) (spec *specs.LinuxPids) {
 	spec = &specs.LinuxPids{Limit: pids}
 	return
 }
+
+// Weight (for CPU or disk I/O) of groups with none configured
+const defaultWeight = 100
+
+// weightScale is a scale of weights of V1 hierarchies.  Weights in the scale of
+// the unified hierarchy (1 to 10000, 100 by default) map to it piecewise
+// linearly, so that the default weight stays the default.
+type weightScale struct {
+	min, def, max uint64
+}
+
+// Scale of cpu.shares, that the runtime spec uses
+var sharesScale = weightScale{2, 1024, 262144}
+
+// fromV2 translates a weight in the scale of the unified hierarchy
+func (s weightScale) fromV2(weight uint64) uint64 {
+	if weight > settings.MaxWeight {
+		weight = settings.MaxWeight
+	}
+	if weight <= defaultWeight {
+		return s.min + divRound((weight-1)*(s.def-s.min), defaultWeight-1)
+	}
+	return s.def + divRound((weight-defaultWeight)*(s.max-s.def), settings.MaxWeight-defaultWeight)
+}
+
+// toV2 translates a weight into the scale of the unified hierarchy.  It undoes
+// fromV2 for scales wider than the one of the unified hierarchy.
+func (s weightScale) toV2(value uint64) uint64 {
+	if value < s.min {
+		value = s.min
+	} else if value > s.max {
+		value = s.max
+	}
+	if value <= s.def {
+		return 1 + divRound((value-s.min)*(defaultWeight-1), s.def-s.min)
+	}
+	return defaultWeight + divRound((value-s.def)*(settings.MaxWeight-defaultWeight), s.max-s.def)
+}
+
+func divRound(a, b uint64) uint64 {
+	return (a + b/2) / b
+}
+
+// specIO translates the I/O settings of a group.  Rates not configured are
+// left out, unless lift is true: then they are set to zero, which lifts any
+// limit in place.  Beware that the weight is in the scale of the unified
+// hierarchy (1 to 10000), not in the one of V1 hierarchies that the runtime
+// spec uses; v1Group translates it.
+func specIO(name string, weight uint16, limits map[string]settings.IOLimit, lift bool) (spec *specs.LinuxBlockIO) {
+	spec = &specs.LinuxBlockIO{}
+	if weight > 0 {
+		spec.Weight = &weight
+	}
+	for _, device := range sortedDevices(limits) {
+		major, minor, err := devices.Numbers(device)
+		if err != nil {
+			log.Logger.Warnf("Ignoring I/O limits of %s: %s", name, err)
+			continue
+		}
+		limit := limits[device]
+		for _, rate := range []struct {
+			value uint64
+			list  *[]specs.LinuxThrottleDevice
+		}{
+			{uint64(limit.ReadBps), &spec.ThrottleReadBpsDevice},
+			{uint64(limit.WriteBps), &spec.ThrottleWriteBpsDevice},
+			{uint64(limit.ReadIOPS), &spec.ThrottleReadIOPSDevice},
+			{uint64(limit.WriteIOPS), &spec.ThrottleWriteIOPSDevice},
+		} {
+			if rate.value > 0 || lift {
+				t := specs.LinuxThrottleDevice{Rate: rate.value}
+				t.Major, t.Minor = major, minor
+				*rate.list = append(*rate.list, t)
+			}
+		}
+	}
+	return
+}
+
+func sortedDevices(limits map[string]settings.IOLimit) []string {
+	names := make([]string, 0, len(limits))
+	for device := range limits {
+		names = append(names, device)
+	}
+	sort.Strings(names)
+	return names
+}
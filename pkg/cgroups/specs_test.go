@@ -1,11 +1,16 @@
 package cgroups
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 
+	"github.com/juan-leon/fetter/pkg/devices"
 	"github.com/juan-leon/fetter/pkg/log"
 	"github.com/juan-leon/fetter/pkg/settings"
 )
@@ -20,7 +25,7 @@ func TestEmptySpec(t *testing.T) {
 
 func TestFullSpec(t *testing.T) {
 	log.InitLoggerForTests()
-	spec := createSpec("foo", &settings.Group{CPU: 20, RAM: 4, Pids: 789})
+	spec := createSpec("foo", &settings.Group{CPU: 2, RAM: 4 * settings.Megabyte, Pids: 789})
 	expected := &specs.LinuxPids{Limit: 789}
 	if !reflect.DeepEqual(spec.Pids, expected) {
 		t.Error("Pid spec", spec.Pids, "should be", expected)
@@ -31,7 +36,193 @@ func TestFullSpec(t *testing.T) {
 	if *spec.CPU.Period != uint64(1000000) {
 		t.Error("Bad cpu period")
 	}
-	if *spec.CPU.Quota != int64(200000*numCPUs) {
+	if *spec.CPU.Quota != 2000000 {
 		t.Error("Bad cpu quota")
 	}
 }
+
+func TestSpecForUnifiedHierarchy(t *testing.T) {
+	log.InitLoggerForTests()
+	values := v2Values(createSpec("foo", &settings.Group{CPU: 0.5, RAM: 4 * settings.Megabyte, Pids: 789}))
+	expected := map[string]string{
+		"cpu.max":    "500000 1000000",
+		"memory.max": "4194304",
+		"pids.max":   "789",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Error("Values", values, "should be", expected)
+	}
+	if controllers := v2Controllers(values); !reflect.DeepEqual(controllers, []string{"cpu", "memory", "pids"}) {
+		t.Error("Bad controllers", controllers)
+	}
+	if values := v2Values(createSpec("foo", &settings.Group{})); len(values) != 0 {
+		t.Error("Values should be empty", values)
+	}
+}
+
+func TestUpdateSpec(t *testing.T) {
+	log.InitLoggerForTests()
+	values := v2Values(updateSpec("foo", &settings.Group{}, &settings.Group{RAM: 4 * settings.Megabyte}))
+	expected := map[string]string{
+		"cpu.max":    "max 1000000",
+		"cpu.weight": "100",
+		"memory.max": "4194304",
+		"pids.max":   "max",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Error("Values", values, "should be", expected)
+	}
+	values = v2Values(updateSpec("foo", &settings.Group{IOWeight: 500}, &settings.Group{}))
+	if values["io.weight"] != "default 100" {
+		t.Error("I/O weight should be reset", values)
+	}
+	spec := updateSpec("foo", &settings.Group{}, &settings.Group{CPU: 0.2})
+	if *spec.Memory.Limit != -1 || spec.Pids.Limit != -1 {
+		t.Error("Memory and pids should be unlimited", spec)
+	}
+	if *spec.CPU.Quota != 200000 {
+		t.Error("Bad cpu quota")
+	}
+}
+
+func TestCPUSpec(t *testing.T) {
+	log.InitLoggerForTests()
+	g := &settings.Group{CPUWeight: 50, CPUs: "0", Mems: "0"}
+	spec := createSpec("foo", g)
+	if spec.CPU.Quota != nil || *spec.CPU.Shares != sharesScale.fromV2(50) {
+		t.Error("Bad cpu spec", spec.CPU)
+	}
+	expected := map[string]string{
+		"cpu.weight":  "50",
+		"cpuset.cpus": "0",
+		"cpuset.mems": "0",
+	}
+	values := v2Values(spec)
+	if !reflect.DeepEqual(values, expected) {
+		t.Error("Values", values, "should be", expected)
+	}
+	if controllers := v2Controllers(values); !reflect.DeepEqual(controllers, []string{"cpu", "cpuset"}) {
+		t.Error("Bad controllers", controllers)
+	}
+	spec = updateSpec("foo", g, &settings.Group{})
+	if *spec.CPU.Shares != 1024 || spec.CPU.Cpus == "" || spec.CPU.Mems == "" {
+		t.Error("Pinning should be lifted", spec.CPU)
+	}
+	spec = updateSpec("foo", &settings.Group{}, &settings.Group{})
+	if spec.CPU.Cpus != "" || spec.CPU.Mems != "" {
+		t.Error("Groups not pinned should be left alone", spec.CPU)
+	}
+}
+
+func TestMemorySpec(t *testing.T) {
+	log.InitLoggerForTests()
+	g := &settings.Group{
+		RAM:      1 * settings.Gigabyte,
+		RAMSoft:  256 * settings.Megabyte,
+		RAMHigh:  768 * settings.Megabyte,
+		Swap:     512 * settings.Megabyte,
+		OOMGroup: true,
+	}
+	spec := createSpec("foo", g)
+	if *spec.Memory.Swap != int64(1536*settings.Megabyte) || spec.Memory.DisableOOMKiller != nil {
+		t.Error("Bad memory spec", spec.Memory)
+	}
+	expected := map[string]string{
+		"memory.max":       "1073741824",
+		"memory.low":       "268435456",
+		"memory.high":      "805306368",
+		"memory.swap.max":  "536870912",
+		"memory.oom.group": "1",
+	}
+	if values := v2Values(spec); !reflect.DeepEqual(values, expected) {
+		t.Error("Values", values, "should be", expected)
+	}
+	values := v2Values(updateSpec("foo", g, &settings.Group{}))
+	for key, value := range map[string]string{
+		"memory.max":       "max",
+		"memory.low":       "0",
+		"memory.high":      "max",
+		"memory.swap.max":  "max",
+		"memory.oom.group": "0",
+	} {
+		if values[key] != value {
+			t.Error("Memory limits should be lifted", key, values[key])
+		}
+	}
+	spec = updateSpec("foo", &settings.Group{OOMKillDisable: true}, &settings.Group{})
+	if *spec.Memory.DisableOOMKiller || spec.Memory.Swap != nil || spec.Unified != nil {
+		t.Error("Only the OOM killer should be enabled back", spec.Memory)
+	}
+}
+
+// blockDevice returns the path of a block device of the system, and its
+// numbers, skipping the test if there is none
+func blockDevice(t *testing.T) (string, string) {
+	files, err := ioutil.ReadDir("/dev")
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to read /dev", err)
+	}
+	for _, f := range files {
+		if f.Mode()&os.ModeDevice != 0 && f.Mode()&os.ModeCharDevice == 0 {
+			path := filepath.Join("/dev", f.Name())
+			major, minor, err := devices.Numbers(path)
+			if err != nil {
+				t.Fatal("Test cannot continue; failed to read numbers of", path, err)
+			}
+			return path, fmt.Sprintf("%d:%d", major, minor)
+		}
+	}
+	t.Skip("No block device found")
+	return "", ""
+}
+
+func TestIOSpec(t *testing.T) {
+	log.InitLoggerForTests()
+	device, numbers := blockDevice(t)
+	g := &settings.Group{
+		IOWeight: 50,
+		IO: map[string]settings.IOLimit{
+			device:            {ReadBps: 1048576, WriteIOPS: 100},
+			"/dev/null":       {ReadBps: 1},
+			"/no/such/device": {ReadBps: 1},
+		},
+	}
+	spec := createSpec("foo", g)
+	if *spec.BlockIO.Weight != 50 || len(spec.BlockIO.ThrottleReadBpsDevice) != 1 || len(spec.BlockIO.ThrottleWriteBpsDevice) != 0 {
+		t.Error("Bad I/O spec", spec.BlockIO)
+	}
+	expected := map[string]string{
+		"io.weight": "default 50",
+		"io.max":    numbers + " rbps=1048576 wiops=100",
+	}
+	if values := v2Values(spec); !reflect.DeepEqual(values, expected) {
+		t.Error("Values", values, "should be", expected)
+	}
+	values := v2Values(updateSpec("foo", g, &settings.Group{}))
+	if values["io.weight"] != "default 100" || values["io.max"] != numbers+" rbps=max wbps=max riops=max wiops=max" {
+		t.Error("I/O limits should be lifted", values)
+	}
+	if spec, weight := withoutIOWeight(spec); spec.BlockIO.Weight != nil || *weight != 50 {
+		t.Error("Weight should be taken out of spec")
+	}
+	if spec.BlockIO.Weight == nil {
+		t.Error("Original spec should be kept")
+	}
+}
+
+func TestWeightScale(t *testing.T) {
+	scale := weightScale{10, 500, 1000}
+	for weight, expected := range map[uint64]uint64{1: 10, 100: 500, 10000: 1000, 5050: 750, 20000: 1000} {
+		if value := scale.fromV2(weight); value != expected {
+			t.Error("Bad weight for", weight, value)
+		}
+	}
+	for weight := uint64(1); weight <= settings.MaxWeight; weight++ {
+		if value := sharesScale.toV2(sharesScale.fromV2(weight)); value != weight {
+			t.Error("Bad shares for", weight, value)
+		}
+	}
+	if sharesScale.fromV2(100) != 1024 || sharesScale.toV2(1) != 1 || sharesScale.toV2(1<<20) != 10000 {
+		t.Error("Bad shares scale")
+	}
+}
@@ -0,0 +1,82 @@
+package cgroups
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+// Usage holds the resources used by the processes in a control group, as the
+// kernel accounts them
+type Usage struct {
+	Memory    uint64 `json:"memory"`    // in bytes
+	CPU       uint64 `json:"cpu"`       // in nanoseconds
+	Throttled uint64 `json:"throttled"` // number of periods CPU was throttled
+	Pids      uint64 `json:"pids"`
+	Frozen    bool   `json:"frozen"`
+	// Only where the kernel tracks it
+	MemoryPressure *Pressure `json:"memory_pressure,omitempty"`
+}
+
+// GroupStatus holds the state of a control group of the hierarchy: its
+// configured limits, what it is using and its processes.
+type GroupStatus struct {
+	Limits  settings.Group `json:"limits"`
+	Usage   *Usage         `json:"usage,omitempty"`
+	Members []int          `json:"members"`
+}
+
+// Status returns the status of every control group in the hierarchy, indexed by
+// group name
+func (gh *GroupHierarchy) Status() map[string]GroupStatus {
+	gh.mu.RLock()
+	defer gh.mu.RUnlock()
+	status := make(map[string]GroupStatus)
+	for name, subgroup := range gh.subgroups {
+		status[name] = groupStatus(name, gh.groups[name], subgroup)
+	}
+	for name, instance := range gh.instances {
+		group, _ := settings.SplitGroup(name)
+		status[name] = groupStatus(name, gh.groups[group], instance)
+	}
+	return status
+}
+
+// LoadStatus returns the status of the control groups configured, indexed by
+// group name, loading them from the system.  It is meant for inspecting the
+// groups created by another fetter process.  Instances of template groups are
+// not listed; the status of their template covers them all.
+func LoadStatus(config *settings.Settings) (map[string]GroupStatus, error) {
+	if _, err := loadControlGroup(config.Name); err != nil {
+		log.Logger.Errorf("Could not load base cgroup with name %s: %s", config.Name, err)
+		return nil, err
+	}
+	status := make(map[string]GroupStatus)
+	now := time.Now()
+	for name, configured := range config.Groups {
+		// Limits as applied now, by the schedule of the group
+		g, _ := configured.At(now)
+		subgroup, err := loadControlGroup(filepath.Join(config.Name, name))
+		if err != nil {
+			log.Logger.Warnf("Could not load subgroup with name %s: %s", name, err)
+			status[name] = GroupStatus{Limits: g}
+			continue
+		}
+		status[name] = groupStatus(name, g, subgroup)
+	}
+	return status, nil
+}
+
+func groupStatus(name string, g settings.Group, subgroup controlGroup) GroupStatus {
+	status := GroupStatus{Limits: g}
+	var err error
+	if status.Usage, err = subgroup.Usage(); err != nil {
+		log.Logger.Warnf("Could not read usage of %s: %s", name, err)
+	}
+	if status.Members, err = subgroup.Processes(); err != nil {
+		log.Logger.Warnf("Could not list processes of %s: %s", name, err)
+	}
+	return status
+}
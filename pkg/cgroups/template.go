@@ -0,0 +1,151 @@
+package cgroups
+
+import (
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/process"
+
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/metrics"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+// lookup returns the control group named name: either a configured group or
+// an instance of a template group (like browsers/alice).  Instances are
+// created on demand (with the limits of their template) when create is true,
+// except in loaded hierarchies, and placeholders in their keys are expanded
+// for process pid.  The name of
+// the control group is returned too.
+func (gh *GroupHierarchy) lookup(name string, pid int, create bool) (controlGroup, string, error) {
+	group, key := settings.SplitGroup(name)
+	subgroup, ok := gh.subgroups[group]
+	if !ok {
+		return nil, name, fmt.Errorf("unknown group: %s", group)
+	}
+	g := gh.groups[group]
+	if key == "" {
+		// A template group itself can be looked up (for freezing all its
+		// instances at once, for instance), but processes go to instances
+		if g.Template && create {
+			return nil, name, fmt.Errorf("template group %s needs a key", group)
+		}
+		return subgroup, name, nil
+	}
+	if !g.Template {
+		return nil, name, fmt.Errorf("group %s is not a template", group)
+	}
+	if create {
+		var err error
+		if key, err = expandKey(key, pid); err != nil {
+			return nil, name, err
+		}
+		name = group + "/" + key
+	}
+	if instance, ok := gh.instances[name]; ok {
+		return instance, name, nil
+	}
+	if gh.loaded {
+		// Instances are created (and deleted, and kept up to date) by the
+		// fetter process running, so loaded hierarchies only find them in the
+		// system
+		instance, err := loadControlGroup(filepath.Join(gh.name, name))
+		if err != nil {
+			return nil, name, fmt.Errorf("unknown group: %s (instances are created by fetter when running)", name)
+		}
+		return instance, name, nil
+	}
+	if !create {
+		return nil, name, fmt.Errorf("unknown group: %s", name)
+	}
+	instance, err := subgroup.New(key, createSpec(name, &g))
+	if err != nil {
+		log.Logger.Errorf("Could not create instance with name %s: %s", name, err)
+		return nil, name, err
+	}
+	gh.instances[name] = instance
+	log.Logger.Infow("Added instance of template group", "name", name)
+	return instance, name, nil
+}
+
+// expandKey replaces the placeholders in the key of a template group by the
+// values for process pid.  The rule placeholder is expected to be expanded
+// already, since processes do not know about rules.
+func expandKey(key string, pid int) (string, error) {
+	if strings.Contains(key, settings.KeyUID) || strings.Contains(key, settings.KeyUser) {
+		p, err := process.NewProcess(int32(pid))
+		if err != nil {
+			return "", err
+		}
+		uids, err := p.Uids()
+		if err != nil || len(uids) == 0 {
+			return "", fmt.Errorf("could not read uid of process %d: %v", pid, err)
+		}
+		uid := strconv.Itoa(int(uids[0]))
+		login := uid
+		if u, err := user.LookupId(uid); err == nil {
+			login = u.Username
+		}
+		key = strings.ReplaceAll(key, settings.KeyUID, uid)
+		key = strings.ReplaceAll(key, settings.KeyUser, login)
+	}
+	key = strings.ReplaceAll(key, settings.KeyPid, strconv.Itoa(pid))
+	if strings.ContainsAny(key, "{}/") || key == "" || key == "." || key == ".." {
+		return "", fmt.Errorf("cannot expand key %s", key)
+	}
+	return key, nil
+}
+
+// CollectInstances deletes the instances of template groups that have no
+// processes left
+func (gh *GroupHierarchy) CollectInstances() {
+	if gh.loaded {
+		return
+	}
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	for name, instance := range gh.instances {
+		pids, err := instance.Processes()
+		if err != nil || len(pids) > 0 {
+			continue
+		}
+		gh.deleteInstance(name)
+	}
+}
+
+func (gh *GroupHierarchy) deleteInstance(name string) error {
+	instance := gh.instances[name]
+	delete(gh.instances, name)
+	instance.Thaw()
+	pids, err := instance.Processes()
+	if err != nil {
+		log.Logger.Errorf("Could not list processes of %s: %s", name, err)
+	}
+	for _, pid := range pids {
+		gh.release(pid)
+	}
+	if err := instance.Delete(); err != nil {
+		log.Logger.Errorf("Could not delete instance with name %s: %s", name, err)
+		return err
+	}
+	// Instances come and go (like those for every pid), and so do their
+	// series
+	for _, event := range memoryEventNames {
+		metrics.MemoryEvents.DeleteLabelValues(name, event)
+	}
+	log.Logger.Infow("Deleted instance of template group", "name", name)
+	return nil
+}
+
+// instancesOf returns the names of the instances of a template group
+func (gh *GroupHierarchy) instancesOf(group string) (names []string) {
+	for name := range gh.instances {
+		if strings.HasPrefix(name, group+"/") {
+			names = append(names, name)
+		}
+	}
+	return
+}
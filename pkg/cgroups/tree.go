@@ -0,0 +1,83 @@
+package cgroups
+
+import (
+	"github.com/shirou/gopsutil/process"
+
+	"github.com/juan-leon/fetter/pkg/log"
+)
+
+// Passes over the process table MoveTree makes at most, so that a process
+// forking endlessly cannot keep it busy forever
+const maxTreePasses = 10
+
+// MoveTree moves a process, identified by its pid, and all its descendants to
+// a control group, identified by its name.  The process is moved before
+// looking for its children: from that moment on, any child it forks is born in
+// the control group already.  Descendants are moved top-down for same reason.
+// Descendants not moved yet can fork meanwhile, so the process table is read
+// again until no new descendants show up.
+func (gh *GroupHierarchy) MoveTree(pid int, cgroup string) error {
+	if err := gh.Move(pid, cgroup); err != nil {
+		return err
+	}
+	moved := map[int]bool{pid: true}
+	for pass := 0; pass < maxTreePasses; pass++ {
+		children, err := childrenMap()
+		if err != nil {
+			log.Logger.Warnf("Could not find descendants of process %d: %s", pid, err)
+			return err
+		}
+		found := false
+		for _, child := range Descendants(pid, children) {
+			if moved[child] {
+				continue
+			}
+			// Errors are logged by Move, and typically are about short
+			// lived processes, so we keep going.
+			gh.Move(child, cgroup)
+			moved[child], found = true, true
+		}
+		if !found {
+			return nil
+		}
+	}
+	log.Logger.Warnf("Descendants of process %d keep showing up; some may be left out of cgroup %s", pid, cgroup)
+	return nil
+}
+
+// childrenMap returns the pids of the children of every running process,
+// indexed by parent pid.
+func childrenMap() (map[int][]int, error) {
+	processes, err := process.Processes()
+	if err != nil {
+		return nil, err
+	}
+	return ChildrenMap(processes), nil
+}
+
+// ChildrenMap returns the pids of the children of every process in processes,
+// indexed by parent pid.
+func ChildrenMap(processes []*process.Process) map[int][]int {
+	children := make(map[int][]int)
+	for _, p := range processes {
+		ppid, err := p.Ppid()
+		if err != nil {
+			continue
+		}
+		children[int(ppid)] = append(children[int(ppid)], int(p.Pid))
+	}
+	return children
+}
+
+// Descendants returns the descendants of pid, parents always before their
+// children.
+func Descendants(pid int, children map[int][]int) (result []int) {
+	pending := children[pid]
+	for len(pending) > 0 {
+		next := pending[0]
+		pending = pending[1:]
+		result = append(result, next)
+		pending = append(pending, children[next]...)
+	}
+	return
+}
@@ -0,0 +1,42 @@
+package cgroups
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestDescendants(t *testing.T) {
+	children := map[int][]int{
+		1: {2, 3},
+		2: {4},
+		4: {5, 6},
+		7: {8},
+	}
+	expected := []int{2, 3, 4, 5, 6}
+	if result := Descendants(1, children); !reflect.DeepEqual(result, expected) {
+		t.Error("Descendants should be", expected, "instead of", result)
+	}
+	if result := Descendants(9, children); len(result) != 0 {
+		t.Error("Process 9 has no descendants", result)
+	}
+}
+
+func TestChildrenMap(t *testing.T) {
+	cmd := exec.Command("/bin/sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatal("Test cannot continue; failed to spawn child", err)
+	}
+	defer cmd.Process.Kill()
+	children, err := childrenMap()
+	if err != nil {
+		t.Fatal("Could not build children map", err)
+	}
+	for _, child := range children[os.Getpid()] {
+		if child == cmd.Process.Pid {
+			return
+		}
+	}
+	t.Error("Child", cmd.Process.Pid, "not found among", children[os.Getpid()])
+}
@@ -1,9 +1,36 @@
 package cgroups
 
+import (
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
 // ProcessMover objects implement the ability to move processes into process
 // control groups.
 type ProcessMover interface {
 	// Move a process, identified byt its pid, to a control group, identified by
 	// its name
 	Move(pid int, cgroup string) error
+	// MoveTree moves a process, identified byt its pid, and all its
+	// descendants to a control group, identified by its name
+	MoveTree(pid int, cgroup string) error
+}
+
+// DryRun is a ProcessMover that only logs what it would do
+type DryRun struct{}
+
+// Move logs that a process would be moved (or killed)
+func (DryRun) Move(pid int, cgroup string) error {
+	if cgroup == settings.Kill {
+		log.Logger.Infof("Dry run: would kill process %d", pid)
+	} else {
+		log.Logger.Infof("Dry run: would add process %d to cgroup %s", pid, cgroup)
+	}
+	return nil
+}
+
+// MoveTree logs that a process and its descendants would be moved
+func (DryRun) MoveTree(pid int, cgroup string) error {
+	log.Logger.Infof("Dry run: would add process %d and its descendants to cgroup %s", pid, cgroup)
+	return nil
 }
@@ -0,0 +1,275 @@
+package cgroups
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/cgroups"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/juan-leon/fetter/pkg/log"
+)
+
+// v1Group is a control group living in a V1 hierarchy
+type v1Group struct {
+	cg   cgroups.Cgroup
+	path string // path relative to every subsystem, like "/fetter/browsers"
+}
+
+// pather is implemented by those containerd subsystems that are mounted in
+// their own directory
+type pather interface {
+	Path(path string) string
+}
+
+func newV1Group(name string) (*v1Group, error) {
+	cg, err := cgroups.New(cgroups.V1, cgroups.StaticPath(name), emptySpec())
+	if err != nil {
+		return nil, err
+	}
+	return &v1Group{cg: cg, path: filepath.Join("/", name)}, nil
+}
+
+func loadV1Group(name string) (*v1Group, error) {
+	cg, err := cgroups.Load(cgroups.V1, cgroups.StaticPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return &v1Group{cg: cg, path: filepath.Join("/", name)}, nil
+}
+
+// loadV1SavedGroup loads the control groups at paths, indexed by subsystem, as
+// read from a /proc/<pid>/cgroup file
+func loadV1SavedGroup(paths map[string]string) (*v1Group, error) {
+	cg, err := cgroups.Load(cgroups.V1, func(name cgroups.Name) (string, error) {
+		if path, ok := paths[string(name)]; ok {
+			return path, nil
+		}
+		if path, ok := paths["name="+string(name)]; ok {
+			return path, nil
+		}
+		return "", cgroups.ErrControllerNotActive
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &v1Group{cg: cg, path: paths[string(cgroups.Freezer)]}, nil
+}
+
+func (g *v1Group) New(name string, spec *specs.LinuxResources) (controlGroup, error) {
+	warnV2Only(spec)
+	spec, weight := withoutIOWeight(spec)
+	cg, err := g.cg.New(name, spec)
+	if err != nil {
+		return nil, err
+	}
+	child := &v1Group{cg: cg, path: filepath.Join(g.path, name)}
+	if weight != nil {
+		if err := child.writeIOWeight(*weight); err != nil {
+			cg.Delete()
+			return nil, err
+		}
+	}
+	return child, nil
+}
+
+func (g *v1Group) Add(pid int) error {
+	return g.cg.Add(cgroups.Process{Pid: pid})
+}
+
+// Update applies spec to the control group.  Negative limits stand for
+// unlimited; containerd translates them for every subsystem but pids, so that
+// one is done here.  containerd does not enable the OOM killer back either.
+func (g *v1Group) Update(spec *specs.LinuxResources) error {
+	warnV2Only(spec)
+	spec, weight := withoutIOWeight(spec)
+	if err := g.cg.Update(spec); err != nil {
+		return err
+	}
+	if weight != nil {
+		if err := g.writeIOWeight(*weight); err != nil {
+			return err
+		}
+	}
+	if spec.Pids != nil && spec.Pids.Limit < 0 {
+		if err := g.write(cgroups.Pids, "pids.max", "max"); err != nil {
+			return err
+		}
+	}
+	if m := spec.Memory; m != nil && m.DisableOOMKiller != nil && !*m.DisableOOMKiller {
+		if err := g.write(cgroups.Memory, "memory.oom_control", "0"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes value into a file of the control group in a subsystem
+func (g *v1Group) write(subsystem cgroups.Name, file, value string) error {
+	dir, err := g.subsystemPath(subsystem)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0)
+}
+
+// read reads a file of the control group in a subsystem
+func (g *v1Group) read(subsystem cgroups.Name, file string) (string, error) {
+	dir, err := g.subsystemPath(subsystem)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, file))
+	return string(data), err
+}
+
+// subsystemPath returns the directory of the control group in a subsystem
+func (g *v1Group) subsystemPath(subsystem cgroups.Name) (string, error) {
+	for _, s := range g.cg.Subsystems() {
+		if p, ok := s.(pather); ok && s.Name() == subsystem {
+			return p.Path(g.path), nil
+		}
+	}
+	return "", fmt.Errorf("no %s subsystem", subsystem)
+}
+
+// warnV2Only logs the settings in spec that V1 hierarchies lack, and so are
+// ignored
+func warnV2Only(spec *specs.LinuxResources) {
+	for key := range spec.Unified {
+		log.Logger.Warnf("Ignoring %s, not supported in V1 hierarchies", key)
+	}
+}
+
+// withoutIOWeight returns a copy of spec without I/O weight, and the weight.
+// containerd would write it to blkio.weight, that is there only with the CFQ
+// scheduler (gone in kernel 5.0), so fetter writes it on its own.
+func withoutIOWeight(spec *specs.LinuxResources) (*specs.LinuxResources, *uint16) {
+	if spec.BlockIO == nil || spec.BlockIO.Weight == nil {
+		return spec, nil
+	}
+	copied, io := *spec, *spec.BlockIO
+	copied.BlockIO = &io
+	io.Weight = nil
+	return &copied, spec.BlockIO.Weight
+}
+
+// writeIOWeight writes an I/O weight, in the scale of the unified hierarchy,
+// into the file of the I/O scheduler in use, translated into its scale
+func (g *v1Group) writeIOWeight(weight uint16) error {
+	for _, s := range g.cg.Subsystems() {
+		p, ok := s.(pather)
+		if !ok || s.Name() != cgroups.Blkio {
+			continue
+		}
+		for _, scheduler := range []struct {
+			file  string
+			scale weightScale
+		}{
+			{"blkio.bfq.weight", weightScale{1, 100, 1000}},
+			{"blkio.weight", weightScale{10, 500, 1000}},
+		} {
+			file := filepath.Join(p.Path(g.path), scheduler.file)
+			if _, err := os.Stat(file); err != nil {
+				continue
+			}
+			value := scheduler.scale.fromV2(uint64(weight))
+			return ioutil.WriteFile(file, []byte(strconv.FormatUint(value, 10)), 0)
+		}
+		return fmt.Errorf("no I/O weight support (BFQ or CFQ I/O schedulers are needed)")
+	}
+	return fmt.Errorf("no blkio subsystem")
+}
+
+func (g *v1Group) Processes() ([]int, error) {
+	procs, err := g.cg.Processes(cgroups.Freezer, true)
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]int, 0, len(procs))
+	for _, p := range procs {
+		pids = append(pids, p.Pid)
+	}
+	return pids, nil
+}
+
+func (g *v1Group) MoveTo(destination controlGroup) error {
+	dest, ok := destination.(*v1Group)
+	if !ok {
+		return fmt.Errorf("cannot move processes across cgroup versions")
+	}
+	return g.cg.MoveTo(dest.cg)
+}
+
+func (g *v1Group) Usage() (*Usage, error) {
+	metrics, err := g.cg.Stat(cgroups.IgnoreNotExist)
+	if err != nil {
+		return nil, err
+	}
+	usage := &Usage{Frozen: g.cg.State() == cgroups.Frozen}
+	if memory := metrics.Memory; memory != nil && memory.Usage != nil {
+		usage.Memory = memory.Usage.Usage
+	}
+	if cpu := metrics.CPU; cpu != nil {
+		if cpu.Usage != nil {
+			usage.CPU = cpu.Usage.Total
+		}
+		if cpu.Throttling != nil {
+			usage.Throttled = cpu.Throttling.ThrottledPeriods
+		}
+	}
+	if pids := metrics.Pids; pids != nil {
+		usage.Pids = pids.Current
+	}
+	return usage, nil
+}
+
+// MemoryEvents reads the OOM kills from memory.oom_control (kernels before
+// 4.13 lack them), and the times the limit was hit from memory.failcnt.  V1
+// hierarchies do not count the rest.
+func (g *v1Group) MemoryEvents() (*MemoryEvents, error) {
+	data, err := g.read(cgroups.Memory, "memory.oom_control")
+	if err != nil {
+		return nil, err
+	}
+	counters, err := parseCounters(data)
+	if err != nil {
+		return nil, err
+	}
+	events := &MemoryEvents{OOMKill: counters["oom_kill"], UnderOOM: counters["under_oom"] == 1}
+	if data, err := g.read(cgroups.Memory, "memory.failcnt"); err == nil {
+		events.Max, _ = strconv.ParseUint(strings.TrimSpace(data), 10, 64)
+	}
+	return events, nil
+}
+
+// MemoryPressure returns nil: the kernel tracks pressure of control groups in
+// the unified hierarchy only
+func (g *v1Group) MemoryPressure() (*Pressure, error) {
+	return nil, nil
+}
+
+// WatchMemory returns an eventfd registered for OOM notifications
+func (g *v1Group) WatchMemory() (*os.File, error) {
+	fd, err := g.cg.OOMEventFD()
+	if err != nil {
+		return nil, err
+	}
+	return pollable(int(fd), "oom-"+g.path)
+}
+
+func (g *v1Group) Freeze() error {
+	return g.cg.Freeze()
+}
+
+func (g *v1Group) Thaw() error {
+	return g.cg.Thaw()
+}
+
+func (g *v1Group) Delete() error {
+	return g.cg.Delete()
+}
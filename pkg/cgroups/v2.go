@@ -0,0 +1,366 @@
+package cgroups
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	v2 "github.com/containerd/cgroups/v2"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+
+	"github.com/juan-leon/fetter/pkg/log"
+)
+
+const unifiedMountpoint = "/sys/fs/cgroup"
+
+// v2Group is a control group living in the unified (V2) hierarchy
+type v2Group struct {
+	manager *v2.Manager
+	group   string // path relative to mountpoint, like "/fetter/browsers"
+}
+
+func newV2Group(name string) (*v2Group, error) {
+	group := filepath.Join("/", name)
+	manager, err := v2.NewManager(unifiedMountpoint, group, &v2.Resources{})
+	if err != nil {
+		return nil, err
+	}
+	return &v2Group{manager: manager, group: group}, nil
+}
+
+func loadV2Group(name string) (*v2Group, error) {
+	group := filepath.Join("/", name)
+	manager, err := v2.LoadManager(unifiedMountpoint, group)
+	if err != nil {
+		return nil, err
+	}
+	return &v2Group{manager: manager, group: group}, nil
+}
+
+func (g *v2Group) New(name string, spec *specs.LinuxResources) (controlGroup, error) {
+	child, err := loadV2Group(filepath.Join(g.group, name))
+	if err != nil {
+		return nil, err
+	}
+	values := v2Values(spec)
+	child.enableControllers(values)
+	if err := os.MkdirAll(child.path(), 0755); err != nil {
+		return nil, err
+	}
+	if err := child.write(values); err != nil {
+		os.Remove(child.path())
+		return nil, err
+	}
+	return child, nil
+}
+
+func (g *v2Group) Add(pid int) error {
+	return g.manager.AddProc(uint64(pid))
+}
+
+// Update enables controllers first, like New does: updates write the knobs of
+// every controller, and groups may have been created with fewer of them.
+func (g *v2Group) Update(spec *specs.LinuxResources) error {
+	values := v2Values(spec)
+	g.enableControllers(values)
+	return g.write(values)
+}
+
+// enableControllers enables the controllers values are for.  In the unified
+// hierarchy, controllers need to be enabled in the cgroup.subtree_control file
+// of every ancestor before their knobs show up in a group.  Only controllers
+// available in the system are asked for, since asking for a missing one makes
+// the whole write fail.
+func (g *v2Group) enableControllers(values map[string]string) {
+	if controllers := availableControllers(g.manager, v2Controllers(values)); len(controllers) > 0 {
+		if err := g.manager.ToggleControllers(controllers, v2.Enable); err != nil {
+			log.Logger.Warnf("Could not enable controllers %s for %s: %s", controllers, g.group, err)
+		}
+	}
+}
+
+func (g *v2Group) Processes() ([]int, error) {
+	procs, err := g.manager.Procs(true)
+	if err != nil {
+		return nil, err
+	}
+	pids := make([]int, 0, len(procs))
+	for _, pid := range procs {
+		pids = append(pids, int(pid))
+	}
+	return pids, nil
+}
+
+func (g *v2Group) MoveTo(destination controlGroup) error {
+	pids, err := g.Processes()
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if err := destination.Add(pid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *v2Group) Usage() (*Usage, error) {
+	metrics, err := g.manager.Stat()
+	if err != nil {
+		return nil, err
+	}
+	usage := &Usage{}
+	if memory := metrics.Memory; memory != nil {
+		usage.Memory = memory.Usage
+	}
+	if cpu := metrics.CPU; cpu != nil {
+		usage.CPU = cpu.UsageUsec * 1000
+		usage.Throttled = cpu.NrThrottled
+	}
+	if pids := metrics.Pids; pids != nil {
+		usage.Pids = pids.Current
+	}
+	if frozen, err := ioutil.ReadFile(filepath.Join(g.path(), "cgroup.freeze")); err == nil {
+		usage.Frozen = strings.TrimSpace(string(frozen)) == "1"
+	}
+	if usage.MemoryPressure, err = g.MemoryPressure(); err != nil {
+		log.Logger.Debugf("Could not read memory pressure of %s: %s", g.group, err)
+	}
+	return usage, nil
+}
+
+func (g *v2Group) MemoryEvents() (*MemoryEvents, error) {
+	data, err := ioutil.ReadFile(filepath.Join(g.path(), "memory.events"))
+	if err != nil {
+		return nil, err
+	}
+	counters, err := parseCounters(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryEvents{
+		High:    counters["high"],
+		Max:     counters["max"],
+		OOM:     counters["oom"],
+		OOMKill: counters["oom_kill"],
+	}, nil
+}
+
+// MemoryPressure returns nil if the kernel does not track pressure (PSI)
+func (g *v2Group) MemoryPressure() (*Pressure, error) {
+	data, err := ioutil.ReadFile(filepath.Join(g.path(), "memory.pressure"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parsePressure(string(data))
+}
+
+// WatchMemory returns an inotify instance watching memory.events, that the
+// kernel modifies on every event
+func (g *v2Group) WatchMemory() (*os.File, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unix.InotifyAddWatch(fd, filepath.Join(g.path(), "memory.events"), unix.IN_MODIFY); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return pollable(fd, "inotify-"+g.group)
+}
+
+func (g *v2Group) Freeze() error {
+	return g.manager.Freeze()
+}
+
+func (g *v2Group) Thaw() error {
+	return g.manager.Thaw()
+}
+
+// Delete removes children first: a cgroup directory cannot be removed while it
+// has subdirectories.
+func (g *v2Group) Delete() error {
+	entries, err := ioutil.ReadDir(g.path())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		child, err := loadV2Group(filepath.Join(g.group, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := child.Delete(); err != nil {
+			return err
+		}
+	}
+	return g.manager.Delete()
+}
+
+func (g *v2Group) path() string {
+	return filepath.Join(unifiedMountpoint, g.group)
+}
+
+// write writes values into the interface files of the control group, sorted
+// by file name so that the outcome does not depend on map ordering.  Values
+// with several lines (like io.max, with a line per device) are written a line
+// at a time, since the kernel reads only one per write.
+func (g *v2Group) write(values map[string]string) error {
+	files := make([]string, 0, len(values))
+	for file := range values {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		for _, line := range strings.Split(values[file], "\n") {
+			if err := ioutil.WriteFile(filepath.Join(g.path(), file), []byte(line), 0); err != nil {
+				return fmt.Errorf("could not write %s to %s: %w", line, file, err)
+			}
+		}
+	}
+	return nil
+}
+
+// v2Values translates a spec into the values of the interface files of a
+// control group in the unified hierarchy.  Negative limits stand for unlimited
+// ("max").
+func v2Values(spec *specs.LinuxResources) map[string]string {
+	values := make(map[string]string)
+	if cpu := spec.CPU; cpu != nil {
+		if cpu.Period != nil {
+			quota := int64(-1)
+			if cpu.Quota != nil {
+				quota = *cpu.Quota
+			}
+			values["cpu.max"] = fmt.Sprintf("%s %d", v2Limit(quota), *cpu.Period)
+		}
+		if cpu.Shares != nil {
+			values["cpu.weight"] = strconv.FormatUint(sharesScale.toV2(*cpu.Shares), 10)
+		}
+		if cpu.Cpus != "" {
+			values["cpuset.cpus"] = cpu.Cpus
+		}
+		if cpu.Mems != "" {
+			values["cpuset.mems"] = cpu.Mems
+		}
+	}
+	if memory := spec.Memory; memory != nil {
+		if memory.Limit != nil {
+			values["memory.max"] = v2Limit(*memory.Limit)
+		}
+		if memory.Reservation != nil {
+			low := *memory.Reservation
+			if low < 0 {
+				low = 0
+			}
+			values["memory.low"] = strconv.FormatInt(low, 10)
+		}
+		if memory.Swap != nil {
+			// Swap only, not memory plus swap
+			swap := *memory.Swap
+			if swap > 0 && memory.Limit != nil && *memory.Limit > 0 {
+				swap -= *memory.Limit
+			}
+			values["memory.swap.max"] = v2Limit(swap)
+		}
+		if memory.DisableOOMKiller != nil && *memory.DisableOOMKiller {
+			log.Logger.Warnf("Ignoring oom_kill_disable, not supported in unified hierarchy")
+		}
+	}
+	if pids := spec.Pids; pids != nil && pids.Limit != 0 {
+		values["pids.max"] = v2Limit(pids.Limit)
+	}
+	if io := spec.BlockIO; io != nil {
+		if io.Weight != nil {
+			values["io.weight"] = fmt.Sprintf("default %d", *io.Weight)
+		}
+		if max := v2IOMax(io); max != "" {
+			values["io.max"] = max
+		}
+	}
+	for key, value := range spec.Unified {
+		values[key] = value
+	}
+	return values
+}
+
+// v2IOMax translates the I/O rates of a spec into the lines of io.max, one per
+// device.  Zero rates stand for unlimited.
+func v2IOMax(io *specs.LinuxBlockIO) string {
+	var devices []string
+	rates := make(map[string][]string)
+	for _, kind := range []struct {
+		key  string
+		list []specs.LinuxThrottleDevice
+	}{
+		{"rbps", io.ThrottleReadBpsDevice},
+		{"wbps", io.ThrottleWriteBpsDevice},
+		{"riops", io.ThrottleReadIOPSDevice},
+		{"wiops", io.ThrottleWriteIOPSDevice},
+	} {
+		for _, t := range kind.list {
+			device := fmt.Sprintf("%d:%d", t.Major, t.Minor)
+			if _, ok := rates[device]; !ok {
+				devices = append(devices, device)
+			}
+			rate := "max"
+			if t.Rate > 0 {
+				rate = strconv.FormatUint(t.Rate, 10)
+			}
+			rates[device] = append(rates[device], kind.key+"="+rate)
+		}
+	}
+	lines := make([]string, 0, len(devices))
+	for _, device := range devices {
+		lines = append(lines, device+" "+strings.Join(rates[device], " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func v2Limit(limit int64) string {
+	if limit < 0 {
+		return "max"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// v2Controllers returns the controllers owning the interface files in values
+func v2Controllers(values map[string]string) (controllers []string) {
+	seen := make(map[string]bool)
+	for file := range values {
+		controller := strings.SplitN(file, ".", 2)[0]
+		if !seen[controller] {
+			seen[controller] = true
+			controllers = append(controllers, controller)
+		}
+	}
+	sort.Strings(controllers)
+	return
+}
+
+func availableControllers(manager *v2.Manager, wanted []string) (controllers []string) {
+	root, err := manager.RootControllers()
+	if err != nil {
+		log.Logger.Warnf("Could not read available controllers: %s", err)
+		return
+	}
+	available := make(map[string]bool)
+	for _, c := range root {
+		available[c] = true
+	}
+	for _, c := range wanted {
+		if available[c] {
+			controllers = append(controllers, c)
+		}
+	}
+	return
+}
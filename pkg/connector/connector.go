@@ -0,0 +1,305 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/elastic/go-libaudit/v2/sys"
+	"github.com/shirou/gopsutil/process"
+	"golang.org/x/sys/unix"
+
+	"github.com/juan-leon/fetter/pkg/cgroups"
+	"github.com/juan-leon/fetter/pkg/history"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/match"
+	"github.com/juan-leon/fetter/pkg/metrics"
+	"github.com/juan-leon/fetter/pkg/settings"
+	"github.com/juan-leon/fetter/pkg/triggers"
+)
+
+// Values from linux/connector.h and linux/cn_proc.h
+const (
+	cnIdxProc         = 0x1
+	cnValProc         = 0x1
+	procCnMcastListen = 0x1
+)
+
+const (
+	procEventFork uint32 = 0x00000001
+	procEventExec uint32 = 0x00000002
+	procEventExit uint32 = 0x80000000
+)
+
+var byteOrder = sys.GetEndian()
+
+// cnMsg mimics struct cn_msg
+type cnMsg struct {
+	Idx   uint32
+	Val   uint32
+	Seq   uint32
+	Ack   uint32
+	Len   uint16
+	Flags uint16
+}
+
+// eventHeader mimics the fixed part of struct proc_event
+type eventHeader struct {
+	What      uint32
+	CPU       uint32
+	Timestamp uint64
+}
+
+// forkEvent mimics struct fork_proc_event
+type forkEvent struct {
+	ParentPid  uint32
+	ParentTgid uint32
+	ChildPid   uint32
+	ChildTgid  uint32
+}
+
+// execEvent mimics struct exec_proc_event
+type execEvent struct {
+	ProcessPid  uint32
+	ProcessTgid uint32
+}
+
+// exitEvent mimics struct exit_proc_event
+type exitEvent struct {
+	ProcessPid  uint32
+	ProcessTgid uint32
+	ExitCode    uint32
+	ExitSignal  uint32
+}
+
+// procEvent is the digested version of a process connector event
+type procEvent struct {
+	what uint32
+	pid  int
+	ppid int // only for forks
+}
+
+// ProcConnector instances listen for process events (forks, execs and exits)
+// sent by the kernel process connector, and act on the executions that match
+// the rules.
+type ProcConnector struct {
+	mu         sync.RWMutex
+	config     *settings.Settings
+	sock       int
+	matcher    *match.Matcher
+	procMover  cgroups.ProcessMover
+	procRunner triggers.ProcessRunner
+	matches    *history.History
+}
+
+// NewProcConnector creates and initializes a ProcConnector instance
+func NewProcConnector(config *settings.Settings, procMover cgroups.ProcessMover, procRunner triggers.ProcessRunner, matches *history.History) *ProcConnector {
+	sock, err := dial()
+	if err != nil {
+		log.Logger.Errorf("failed to subscribe to process connector euid=%v: %s", os.Geteuid(), err)
+		return nil
+	}
+	warnIgnored(config)
+	return &ProcConnector{
+		config:     config,
+		sock:       sock,
+		matcher:    match.NewMatcher(config, settings.ActionExecute),
+		procMover:  procMover,
+		procRunner: procRunner,
+		matches:    matches,
+	}
+}
+
+// Loop listen for process events from kernel and act accordlingly, until ctx
+// is cancelled.
+func (pc *ProcConnector) Loop(ctx context.Context) {
+	defer unix.Close(pc.sock)
+	log.Logger.Debugw("Listening process events until cancelled")
+	buf := make([]byte, os.Getpagesize())
+	for ctx.Err() == nil {
+		n, from, err := unix.Recvfrom(pc.sock, buf, 0)
+		if err != nil {
+			if err == unix.EINTR || err == unix.EAGAIN {
+				// EAGAIN means receive timeout expired
+				continue
+			}
+			if err == unix.ENOBUFS {
+				log.Logger.Warn("Process connector overrun: some events were lost")
+				continue
+			}
+			log.Logger.Warnf("Error listening kernel events: %s", err)
+			continue
+		}
+		if addr, ok := from.(*unix.SockaddrNetlink); !ok || addr.Pid != 0 {
+			// Not sent by the kernel
+			continue
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			log.Logger.Errorf("Error parsing netlink message: %s", err)
+			metrics.ParseErrors.Inc()
+			continue
+		}
+		for _, msg := range msgs {
+			if msg.Header.Type != syscall.NLMSG_DONE {
+				continue
+			}
+			event, err := parseEvent(msg.Data)
+			if err != nil {
+				log.Logger.Errorf("Error parsing process event: %s", err)
+				metrics.ParseErrors.Inc()
+				continue
+			}
+			pc.processEvent(event)
+		}
+	}
+}
+
+// Reload applies the rules of a new configuration
+func (pc *ProcConnector) Reload(config *settings.Settings) {
+	matcher := match.NewMatcher(config, settings.ActionExecute)
+	warnIgnored(config)
+	pc.mu.Lock()
+	pc.config = config
+	pc.matcher = matcher
+	pc.mu.Unlock()
+}
+
+// warnIgnored warns about the rules that never match in this mode, so that
+// they are not taken as enforced
+func warnIgnored(config *settings.Settings) {
+	for _, name := range config.IgnoredRules() {
+		log.Logger.Warnf("Ignoring rule %s: only executions are seen in %s mode", name, config.Mode)
+	}
+}
+
+func (pc *ProcConnector) processEvent(event *procEvent) {
+	switch event.what {
+	case procEventFork:
+		log.Logger.Debugw("Received fork event", "pid", event.pid, "ppid", event.ppid)
+	case procEventExit:
+		log.Logger.Debugw("Received exit event", "pid", event.pid)
+	case procEventExec:
+		data, err := getProcessData(event.pid)
+		if err != nil {
+			// Typically, condition races related to short lived processes
+			return
+		}
+		log.Logger.Debugw("Received exec event", "pid", event.pid, "exe", data["exe"])
+		pc.mu.RLock()
+		defer pc.mu.RUnlock()
+		if rule := pc.matcher.Match(data["exe"], event.pid); rule != "" {
+			match.Apply(pc.config, rule, event.pid, &data, pc.procMover, pc.procRunner, pc.matches)
+		}
+	}
+}
+
+func getProcessData(pid int) (map[string]string, error) {
+	p, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return nil, err
+	}
+	exe, err := p.Exe()
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]string{
+		"pid":     strconv.Itoa(pid),
+		"exe":     exe,
+		"syscall": "execve",
+	}
+	if ppid, err := p.Ppid(); err == nil {
+		data["ppid"] = strconv.Itoa(int(ppid))
+	}
+	if uids, err := p.Uids(); err == nil && len(uids) > 1 {
+		data["uid"] = strconv.Itoa(int(uids[0]))
+		data["euid"] = strconv.Itoa(int(uids[1]))
+	}
+	return data, nil
+}
+
+func dial() (int, error) {
+	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_CONNECTOR)
+	if err != nil {
+		return -1, err
+	}
+	addr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: cnIdxProc,
+		Pid:    uint32(os.Getpid()),
+	}
+	if err := unix.Bind(sock, addr); err != nil {
+		unix.Close(sock)
+		return -1, err
+	}
+	// A receive timeout allows Loop to notice when it is cancelled
+	if err := unix.SetsockoptTimeval(sock, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		unix.Close(sock)
+		return -1, err
+	}
+	if err := unix.Sendto(sock, listenMessage(), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(sock)
+		return -1, err
+	}
+	return sock, nil
+}
+
+// listenMessage builds the netlink message that subscribes us to process
+// events.
+func listenMessage() []byte {
+	op := uint32(procCnMcastListen)
+	msg := cnMsg{Idx: cnIdxProc, Val: cnValProc, Len: uint16(binary.Size(op))}
+	header := unix.NlMsghdr{
+		Len:  uint32(unix.SizeofNlMsghdr + binary.Size(msg) + binary.Size(op)),
+		Type: uint16(unix.NLMSG_DONE),
+		Pid:  uint32(os.Getpid()),
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, byteOrder, header)
+	binary.Write(buf, byteOrder, msg)
+	binary.Write(buf, byteOrder, op)
+	return buf.Bytes()
+}
+
+func parseEvent(data []byte) (*procEvent, error) {
+	reader := bytes.NewReader(data)
+	msg := cnMsg{}
+	if err := binary.Read(reader, byteOrder, &msg); err != nil {
+		return nil, err
+	}
+	if msg.Idx != cnIdxProc || msg.Val != cnValProc {
+		return nil, fmt.Errorf("unexpected connector id %d:%d", msg.Idx, msg.Val)
+	}
+	header := eventHeader{}
+	if err := binary.Read(reader, byteOrder, &header); err != nil {
+		return nil, err
+	}
+	event := &procEvent{what: header.What}
+	switch header.What {
+	case procEventFork:
+		fork := forkEvent{}
+		if err := binary.Read(reader, byteOrder, &fork); err != nil {
+			return nil, err
+		}
+		event.pid = int(fork.ChildTgid)
+		event.ppid = int(fork.ParentTgid)
+	case procEventExec:
+		exec := execEvent{}
+		if err := binary.Read(reader, byteOrder, &exec); err != nil {
+			return nil, err
+		}
+		event.pid = int(exec.ProcessTgid)
+	case procEventExit:
+		exit := exitEvent{}
+		if err := binary.Read(reader, byteOrder, &exit); err != nil {
+			return nil, err
+		}
+		event.pid = int(exit.ProcessTgid)
+	}
+	return event, nil
+}
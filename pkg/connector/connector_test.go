@@ -0,0 +1,139 @@
+package connector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/match"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+var config = &settings.Settings{
+	Rules: map[string]settings.Rule{
+		"r1": {Paths: []string{"/usr/bin/make"}, Action: "execute", Trigger: "t1"},
+		"r2": {Paths: []string{"/opt/ide/"}, Action: "execute", Group: "g1"},
+		"r3": {Paths: []string{"/usr/bin/cat"}, Action: "read", Group: "g1"},
+	},
+}
+
+type mock struct {
+	moved bool
+	ran   bool
+}
+
+func (m *mock) Move(pid int, cgroup string) error {
+	m.moved = true
+	return nil
+}
+
+func (m *mock) MoveTree(pid int, cgroup string) error {
+	m.moved = true
+	return nil
+}
+
+func (m *mock) Run(name string, data *map[string]string) error {
+	m.ran = true
+	return nil
+}
+
+func rawEvent(what uint32, payload interface{}) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, byteOrder, cnMsg{Idx: cnIdxProc, Val: cnValProc})
+	binary.Write(buf, byteOrder, eventHeader{What: what})
+	binary.Write(buf, byteOrder, payload)
+	return buf.Bytes()
+}
+
+func TestParseEvents(t *testing.T) {
+	event, err := parseEvent(rawEvent(procEventExec, execEvent{ProcessPid: 33, ProcessTgid: 33}))
+	if err != nil || event.what != procEventExec || event.pid != 33 {
+		t.Error("Bad exec event", event, err)
+	}
+	event, err = parseEvent(rawEvent(procEventFork, forkEvent{ParentTgid: 1, ChildPid: 2, ChildTgid: 2}))
+	if err != nil || event.what != procEventFork || event.pid != 2 || event.ppid != 1 {
+		t.Error("Bad fork event", event, err)
+	}
+	event, err = parseEvent(rawEvent(procEventExit, exitEvent{ProcessPid: 7, ProcessTgid: 7}))
+	if err != nil || event.what != procEventExit || event.pid != 7 {
+		t.Error("Bad exit event", event, err)
+	}
+	if _, err = parseEvent([]byte{1, 2, 3}); err == nil {
+		t.Error("Truncated event should fail to parse")
+	}
+}
+
+func TestListenMessage(t *testing.T) {
+	msg := listenMessage()
+	if binary.Size(msg) != 40 {
+		t.Error("Bad size for listen message", len(msg))
+	}
+}
+
+func TestRuleFor(t *testing.T) {
+	log.InitLoggerForTests()
+	pc := ProcConnector{config: config, matcher: match.NewMatcher(config, settings.ActionExecute)}
+	if rule := pc.matcher.Match("/usr/bin/make", 1); rule != "r1" {
+		t.Error("Should have matched r1 instead of", rule)
+	}
+	if rule := pc.matcher.Match("/opt/ide/bin/ide", 1); rule != "r2" {
+		t.Error("Should have matched r2 instead of", rule)
+	}
+	if rule := pc.matcher.Match("/usr/bin/cat", 1); rule != "" {
+		t.Error("Only execute rules should match", rule)
+	}
+	if rule := pc.matcher.Match("/usr/bin/make2", 1); rule != "" {
+		t.Error("Should not have matched", rule)
+	}
+}
+
+func TestExecEvent(t *testing.T) {
+	log.InitLoggerForTests()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to find command", err)
+	}
+	m := &mock{}
+	pc := ProcConnector{
+		config: &settings.Settings{Rules: map[string]settings.Rule{
+			"r1": {Paths: []string{executable}, Action: "execute", Group: "g1", Trigger: "t1"},
+		}},
+		procMover:  m,
+		procRunner: m,
+	}
+	pc.matcher = match.NewMatcher(pc.config, settings.ActionExecute)
+	pc.processEvent(&procEvent{what: procEventFork, pid: os.Getpid()})
+	if m.moved || m.ran {
+		t.Error("Forks should not trigger rules")
+	}
+	pc.processEvent(&procEvent{what: procEventExec, pid: os.Getpid()})
+	if !m.moved {
+		t.Error("Process should have been moved")
+	}
+	if !m.ran {
+		t.Error("Process should have been triggered here")
+	}
+}
+
+func TestExecEventWithCmdline(t *testing.T) {
+	log.InitLoggerForTests()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to find command", err)
+	}
+	m := &mock{}
+	pc := ProcConnector{
+		config: &settings.Settings{Rules: map[string]settings.Rule{
+			"r1": {Paths: []string{executable}, Action: "execute", Group: "g1", Cmdline: []string{"no-such-argument"}},
+		}},
+		procMover:  m,
+		procRunner: m,
+	}
+	pc.matcher = match.NewMatcher(pc.config, settings.ActionExecute)
+	pc.processEvent(&procEvent{what: procEventExec, pid: os.Getpid()})
+	if m.moved {
+		t.Error("Process should not have been moved")
+	}
+}
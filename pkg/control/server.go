@@ -0,0 +1,264 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juan-leon/fetter/pkg/cgroups"
+	"github.com/juan-leon/fetter/pkg/history"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+// GroupManager objects implement the operations on control groups the control
+// socket gives access to
+type GroupManager interface {
+	cgroups.ProcessMover
+	// Status returns the status of every control group, indexed by group name
+	Status() map[string]cgroups.GroupStatus
+	// Release moves a process back to where it was before being moved
+	Release(pid int) error
+	// Freeze freezes all processes in a control group
+	Freeze(cgroup string) error
+	// Thaw resumes all processes in a control group
+	Thaw(cgroup string) error
+	// Frozen tells whether the processes in a control group are frozen
+	Frozen(cgroup string) (bool, error)
+}
+
+// Request is the body of the commands sent to the control socket
+type Request struct {
+	Pid   int    `json:"pid,omitempty"`
+	Group string `json:"group,omitempty"`
+	Tree  bool   `json:"tree,omitempty"`
+}
+
+// Response is the body of the answers to commands sent to the control socket
+type Response struct {
+	Ok     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Frozen *bool  `json:"frozen,omitempty"` // freezer state of the group, after freezing or thawing
+}
+
+// Server instances serve a JSON API over a unix socket, for inspecting a
+// running fetter and sending commands to it.  Access is restricted to root by
+// socket permissions.
+type Server struct {
+	mu       sync.RWMutex
+	config   *settings.Settings
+	groups   GroupManager
+	matches  *history.History
+	reload   func() error
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewServer creates and initializes a Server listening in the socket
+// configured.  Requests are not served until Serve is called.
+func NewServer(config *settings.Settings, groups GroupManager, matches *history.History, reload func() error) *Server {
+	listener, err := listen(config.Control.Socket)
+	if err != nil {
+		log.Logger.Errorf("Could not listen in control socket %s: %s", config.Control.Socket, err)
+		return nil
+	}
+	s := &Server{
+		config:   config,
+		groups:   groups,
+		matches:  matches,
+		reload:   reload,
+		listener: listener,
+	}
+	s.server = &http.Server{Handler: s.handler()}
+	return s
+}
+
+// Serve serves requests until Close is called
+func (s *Server) Serve() {
+	log.Logger.Debugw("Serving control socket", "socket", s.listener.Addr())
+	if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+		log.Logger.Errorf("Error serving control socket: %s", err)
+	}
+}
+
+// Close stops serving requests and removes the socket
+func (s *Server) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Logger.Warnf("Could not shut down control socket: %s", err)
+	}
+	// Closing the listener removes the socket.  Shutting down closes it too,
+	// but only if Serve was already running.
+	s.listener.Close()
+}
+
+// Reload applies a new configuration
+func (s *Server) Reload(config *settings.Settings) {
+	s.mu.Lock()
+	s.config = config
+	s.mu.Unlock()
+}
+
+// listen creates the socket, replacing any stale one left behind, with
+// permissions for root only.  A socket someone is still serving (like another
+// fetter process) is not stale.
+func listen(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is in use", path)
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/groups", get(s.getGroups))
+	mux.HandleFunc("/rules", get(s.getRules))
+	mux.HandleFunc("/matches", get(s.getMatches))
+	mux.HandleFunc("/move", post(done(s.move)))
+	mux.HandleFunc("/release", post(done(s.release)))
+	mux.HandleFunc("/freeze", post(s.freeze))
+	mux.HandleFunc("/thaw", post(s.thaw))
+	mux.HandleFunc("/reload", post(done(func(*Request) error { return s.reload() })))
+	return mux
+}
+
+func (s *Server) getGroups() interface{} {
+	return s.groups.Status()
+}
+
+func (s *Server) getRules() interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config.Rules
+}
+
+func (s *Server) getMatches() interface{} {
+	return s.matches.Recent()
+}
+
+func (s *Server) move(r *Request) error {
+	if r.Pid <= 0 {
+		return fmt.Errorf("bad pid: %d", r.Pid)
+	}
+	if err := s.assertGroup(r.Group); err != nil {
+		return err
+	}
+	if r.Tree {
+		return s.groups.MoveTree(r.Pid, r.Group)
+	}
+	return s.groups.Move(r.Pid, r.Group)
+}
+
+func (s *Server) release(r *Request) error {
+	if r.Pid <= 0 {
+		return fmt.Errorf("bad pid: %d", r.Pid)
+	}
+	return s.groups.Release(r.Pid)
+}
+
+func (s *Server) freeze(r *Request) (*Response, error) {
+	if err := s.assertGroup(r.Group); err != nil {
+		return nil, err
+	}
+	if err := s.groups.Freeze(r.Group); err != nil {
+		return nil, err
+	}
+	return s.freezerState(r.Group)
+}
+
+func (s *Server) thaw(r *Request) (*Response, error) {
+	if err := s.assertGroup(r.Group); err != nil {
+		return nil, err
+	}
+	if err := s.groups.Thaw(r.Group); err != nil {
+		return nil, err
+	}
+	return s.freezerState(r.Group)
+}
+
+func (s *Server) freezerState(group string) (*Response, error) {
+	frozen, err := s.groups.Frozen(group)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Ok: true, Frozen: &frozen}, nil
+}
+
+func (s *Server) assertGroup(group string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config.AssertGroup(group)
+}
+
+// get adapts a function returning some data to a handler of GET requests
+func get(f func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			reply(w, http.StatusMethodNotAllowed, Response{Error: "method not allowed"})
+			return
+		}
+		reply(w, http.StatusOK, f())
+	}
+}
+
+// done adapts a function running a command to the functions post takes, for
+// commands with nothing to report besides errors
+func done(f func(*Request) error) func(*Request) (*Response, error) {
+	return func(r *Request) (*Response, error) {
+		return nil, f(r)
+	}
+}
+
+// post adapts a function running a command to a handler of POST requests.  If
+// the function returns no response, a plain Ok one is sent.
+func post(f func(*Request) (*Response, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			reply(w, http.StatusMethodNotAllowed, Response{Error: "method not allowed"})
+			return
+		}
+		r := &Request{}
+		if req.ContentLength != 0 {
+			if err := json.NewDecoder(req.Body).Decode(r); err != nil {
+				reply(w, http.StatusBadRequest, Response{Error: err.Error()})
+				return
+			}
+		}
+		log.Logger.Infow("Received command in control socket", "command", req.URL.Path, "request", r)
+		resp, err := f(r)
+		if err != nil {
+			reply(w, http.StatusUnprocessableEntity, Response{Error: err.Error()})
+			return
+		}
+		if resp == nil {
+			resp = &Response{Ok: true}
+		}
+		reply(w, http.StatusOK, resp)
+	}
+}
+
+func reply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Logger.Warnf("Could not write reply in control socket: %s", err)
+	}
+}
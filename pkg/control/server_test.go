@@ -0,0 +1,208 @@
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juan-leon/fetter/pkg/cgroups"
+	"github.com/juan-leon/fetter/pkg/history"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+var config = &settings.Settings{
+	Rules: map[string]settings.Rule{
+		"r1": {Paths: []string{"/usr/bin/make"}, Action: "execute", Group: "g1"},
+	},
+	Groups: map[string]settings.Group{
+		"g1": {RAM: 100},
+	},
+}
+
+type mock struct {
+	moved    int
+	tree     bool
+	released int
+	frozen   string
+	thawed   string
+}
+
+func (m *mock) Move(pid int, cgroup string) error {
+	m.moved = pid
+	return nil
+}
+
+func (m *mock) MoveTree(pid int, cgroup string) error {
+	m.tree = true
+	return m.Move(pid, cgroup)
+}
+
+func (m *mock) Status() map[string]cgroups.GroupStatus {
+	return map[string]cgroups.GroupStatus{
+		"g1": {Limits: config.Groups["g1"], Usage: &cgroups.Usage{Pids: 2}, Members: []int{1, 2}},
+	}
+}
+
+func (m *mock) Release(pid int) error {
+	m.released = pid
+	return nil
+}
+
+func (m *mock) Freeze(cgroup string) error {
+	m.frozen = cgroup
+	return nil
+}
+
+func (m *mock) Thaw(cgroup string) error {
+	m.thawed = cgroup
+	m.frozen = ""
+	return nil
+}
+
+func (m *mock) Frozen(cgroup string) (bool, error) {
+	return m.frozen == cgroup, nil
+}
+
+func newTestServer(m *mock, reload func() error) *httptest.Server {
+	matches := history.NewHistory(10)
+	matches.Add(history.Match{Rule: "r1", Pid: 1, Group: "g1"})
+	s := &Server{config: config, groups: m, matches: matches, reload: reload}
+	return httptest.NewServer(s.handler())
+}
+
+func send(t *testing.T, ts *httptest.Server, path string, r *Request) (int, *Response) {
+	body, _ := json.Marshal(r)
+	resp, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal("Request failed", err)
+	}
+	defer resp.Body.Close()
+	response := &Response{}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		t.Fatal("Bad response", err)
+	}
+	return resp.StatusCode, response
+}
+
+func TestGetGroups(t *testing.T) {
+	log.InitLoggerForTests()
+	ts := newTestServer(&mock{}, nil)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/groups")
+	if err != nil {
+		t.Fatal("Request failed", err)
+	}
+	defer resp.Body.Close()
+	groups := make(map[string]cgroups.GroupStatus)
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		t.Fatal("Bad response", err)
+	}
+	if g := groups["g1"]; len(g.Members) != 2 || g.Limits.RAM != 100 || g.Usage.Pids != 2 {
+		t.Error("Bad group status", groups)
+	}
+}
+
+func TestGetMatches(t *testing.T) {
+	log.InitLoggerForTests()
+	ts := newTestServer(&mock{}, nil)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/matches")
+	if err != nil {
+		t.Fatal("Request failed", err)
+	}
+	defer resp.Body.Close()
+	var matches []history.Match
+	if err := json.NewDecoder(resp.Body).Decode(&matches); err != nil {
+		t.Fatal("Bad response", err)
+	}
+	if len(matches) != 1 || matches[0].Rule != "r1" {
+		t.Error("Bad matches", matches)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	log.InitLoggerForTests()
+	m := &mock{}
+	reloaded := false
+	ts := newTestServer(m, func() error { reloaded = true; return nil })
+	defer ts.Close()
+	if status, resp := send(t, ts, "/move", &Request{Pid: 7, Group: "g1", Tree: true}); status != http.StatusOK || !resp.Ok {
+		t.Error("Move should have succeeded", status, resp)
+	}
+	if m.moved != 7 || !m.tree {
+		t.Error("Process tree should have been moved")
+	}
+	if status, resp := send(t, ts, "/move", &Request{Pid: 7, Group: "nothing"}); status == http.StatusOK || resp.Ok {
+		t.Error("Move to unknown group should have failed", status, resp)
+	}
+	if status, _ := send(t, ts, "/release", &Request{Pid: 7}); status != http.StatusOK || m.released != 7 {
+		t.Error("Process should have been released", status)
+	}
+	if status, resp := send(t, ts, "/freeze", &Request{Group: "g1"}); status != http.StatusOK || m.frozen != "g1" {
+		t.Error("Group should have been frozen", status)
+	} else if resp.Frozen == nil || !*resp.Frozen {
+		t.Error("Freezer state should have been reported", resp)
+	}
+	if status, resp := send(t, ts, "/thaw", &Request{Group: "g1"}); status != http.StatusOK || m.thawed != "g1" {
+		t.Error("Group should have been thawed", status)
+	} else if resp.Frozen == nil || *resp.Frozen {
+		t.Error("Freezer state should have been reported", resp)
+	}
+	if status, _ := send(t, ts, "/reload", &Request{}); status != http.StatusOK || !reloaded {
+		t.Error("Config should have been reloaded", status)
+	}
+	ts.Config.Handler = (&Server{config: config, reload: func() error { return fmt.Errorf("boom") }}).handler()
+	if status, resp := send(t, ts, "/reload", &Request{}); status == http.StatusOK || resp.Error != "boom" {
+		t.Error("Reload errors should be reported", status, resp)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	log.InitLoggerForTests()
+	ts := newTestServer(&mock{}, nil)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/move")
+	if err != nil {
+		t.Fatal("Request failed", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("GET should not be allowed for commands", resp.StatusCode)
+	}
+}
+
+func TestSocketPermissions(t *testing.T) {
+	log.InitLoggerForTests()
+	dir, err := ioutil.TempDir("", "fetter")
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to create dir", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fetter.sock")
+	s := NewServer(&settings.Settings{Control: settings.Control{Socket: path}}, &mock{}, nil, nil)
+	if s == nil {
+		t.Fatal("Server should have been created")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal("Socket should exist", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Error("Socket should be accessible for owner only", info.Mode())
+	}
+	go s.Serve()
+	if NewServer(&settings.Settings{Control: settings.Control{Socket: path}}, &mock{}, nil, nil) != nil {
+		t.Error("Socket in use should not be replaced")
+	}
+	s.Close()
+	if _, err := os.Stat(path); err == nil {
+		t.Error("Socket should have been removed")
+	}
+}
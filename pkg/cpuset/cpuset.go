@@ -0,0 +1,84 @@
+package cpuset
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Where the kernel lists the CPUs and memory nodes that are online
+var (
+	onlineCPUs = "/sys/devices/system/cpu/online"
+	onlineMems = "/sys/devices/system/node/online"
+)
+
+// Parse returns the numbers in a list like "0-3,6", as used for cpuset.cpus
+// and cpuset.mems
+func Parse(list string) ([]int, error) {
+	var numbers []int
+	for _, item := range strings.Split(strings.TrimSpace(list), ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("bad list '%s'", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("bad list '%s'", list)
+			}
+		}
+		for n := first; n <= last; n++ {
+			numbers = append(numbers, n)
+		}
+	}
+	return numbers, nil
+}
+
+// OnlineCPUs returns the list of CPUs that are online, like "0-7"
+func OnlineCPUs() (string, error) {
+	return online(onlineCPUs)
+}
+
+// OnlineMems returns the list of memory nodes that are online, like "0".
+// Kernels without NUMA support have a single one.
+func OnlineMems() (string, error) {
+	list, err := online(onlineMems)
+	if os.IsNotExist(err) {
+		return "0", nil
+	}
+	return list, err
+}
+
+func online(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// AssertOnline returns an error if any number in list is not in the online
+// list too
+func AssertOnline(list, online string) error {
+	numbers, err := Parse(list)
+	if err != nil {
+		return err
+	}
+	available, err := Parse(online)
+	if err != nil {
+		return err
+	}
+	set := make(map[int]bool)
+	for _, n := range available {
+		set[n] = true
+	}
+	for _, n := range numbers {
+		if !set[n] {
+			return fmt.Errorf("%d is not online (online: %s)", n, online)
+		}
+	}
+	return nil
+}
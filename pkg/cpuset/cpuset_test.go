@@ -0,0 +1,45 @@
+package cpuset
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for list, expected := range map[string][]int{
+		"0":         {0},
+		"0-3":       {0, 1, 2, 3},
+		"0-1,6,8-9": {0, 1, 6, 8, 9},
+		"2\n":       {2},
+	} {
+		if numbers, err := Parse(list); err != nil || !reflect.DeepEqual(numbers, expected) {
+			t.Error("Bad numbers for", list, numbers, err)
+		}
+	}
+	for _, list := range []string{"", "a", "3-1", "-1", "1-", "0,,1"} {
+		if _, err := Parse(list); err == nil {
+			t.Error("Parsing should fail for", list)
+		}
+	}
+}
+
+func TestOnline(t *testing.T) {
+	list, err := OnlineCPUs()
+	if err != nil {
+		t.Fatal("Could not read online CPUs", err)
+	}
+	if err := AssertOnline("0", list); err != nil {
+		t.Error("CPU 0 should be online", err)
+	}
+	if err := AssertOnline("4096", list); err == nil {
+		t.Error("CPU 4096 should not be online")
+	}
+	if _, err := OnlineMems(); err != nil {
+		t.Error("Could not read online memory nodes", err)
+	}
+	onlineMems = "/no/such/file"
+	defer func() { onlineMems = "/sys/devices/system/node/online" }()
+	if list, err := OnlineMems(); err != nil || list != "0" {
+		t.Error("Without NUMA, there should be a single node", list, err)
+	}
+}
@@ -0,0 +1,20 @@
+package devices
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Numbers returns the major and minor numbers of a block device, given its
+// path (like /dev/nvme0n1)
+func Numbers(path string) (major, minor int64, err error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return 0, 0, fmt.Errorf("%s: not a block device", path)
+	}
+	return int64(unix.Major(stat.Rdev)), int64(unix.Minor(stat.Rdev)), nil
+}
@@ -0,0 +1,40 @@
+package devices
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNumbers(t *testing.T) {
+	if _, _, err := Numbers("/dev/null"); err == nil {
+		t.Error("Character devices should fail")
+	}
+	if _, _, err := Numbers("/no/such/device"); err == nil {
+		t.Error("Missing devices should fail")
+	}
+	files, err := ioutil.ReadDir("/dev")
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to read /dev", err)
+	}
+	for _, f := range files {
+		if f.Mode()&os.ModeDevice == 0 || f.Mode()&os.ModeCharDevice != 0 {
+			continue
+		}
+		path := filepath.Join("/dev", f.Name())
+		major, minor, err := Numbers(path)
+		if err != nil {
+			t.Fatal("Could not read numbers of", path, err)
+		}
+		var stat unix.Stat_t
+		unix.Stat(path, &stat)
+		if uint64(unix.Mkdev(uint32(major), uint32(minor))) != uint64(stat.Rdev) {
+			t.Error("Bad numbers for", path, major, minor)
+		}
+		return
+	}
+	t.Skip("No block device found")
+}
@@ -0,0 +1,80 @@
+package explain
+
+import (
+	"fmt"
+
+	"github.com/juan-leon/fetter/pkg/filter"
+	"github.com/juan-leon/fetter/pkg/pattern"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+// Verdict tells whether a rule matches the execution of a file, and why
+type Verdict struct {
+	Rule    string
+	Matched bool
+	Reason  string
+}
+
+// Rules evaluates every rule of config against the execution of exe, the way
+// the configured run mode does.  Filters are checked against p; with no
+// process, they are assumed to match.
+func Rules(config *settings.Settings, exe string, p *filter.Process) []Verdict {
+	filters := filter.NewFilters(config)
+	verdicts := make([]Verdict, 0, len(config.Rules))
+	for _, name := range config.RuleNames() {
+		verdicts = append(verdicts, rule(config, filters[name], name, exe, p))
+	}
+	return verdicts
+}
+
+// Winner returns the matching rule that would be acted on, if any.  Like
+// fetter does, the first rule matching in the order of their names wins.
+func Winner(verdicts []Verdict) string {
+	for _, v := range verdicts {
+		if v.Matched {
+			return v.Rule
+		}
+	}
+	return ""
+}
+
+func rule(config *settings.Settings, f *filter.Filter, name, exe string, p *filter.Process) Verdict {
+	v := Verdict{Rule: name}
+	r := config.Rules[name]
+	if r.Action != settings.ActionExecute {
+		v.Reason = fmt.Sprintf("action is %s, not execute", r.Action)
+		return v
+	}
+	if config.Mode == settings.RunModeScanner && r.Group == "" {
+		v.Reason = "no group (triggers are not run in scanner mode)"
+		return v
+	}
+	if f == nil {
+		v.Reason = "rule is ignored (bad filters)"
+		return v
+	}
+	paths, _ := pattern.NewPaths(r.Paths)
+	cover, ok := paths.Cover(exe)
+	path := ""
+	if ok {
+		path = cover.String()
+	}
+	switch {
+	case !ok:
+		v.Reason = "no path matches"
+	case p == nil && !f.Empty():
+		v.Matched = true
+		v.Reason = fmt.Sprintf("path %s matches (filters not checked)", path)
+	case p == nil:
+		v.Matched = true
+		v.Reason = fmt.Sprintf("path %s matches", path)
+	default:
+		if condition := f.Mismatch(p); condition != "" {
+			v.Reason = fmt.Sprintf("path %s matches, but %s does not", path, condition)
+		} else {
+			v.Matched = true
+			v.Reason = fmt.Sprintf("path %s matches", path)
+		}
+	}
+	return v
+}
@@ -0,0 +1,79 @@
+package explain
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/juan-leon/fetter/pkg/filter"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+var rules = map[string]settings.Rule{
+	"r1": {Paths: []string{"/usr/bin"}, Action: "execute", Group: "g1"},
+	"r2": {Paths: []string{"/usr/bin/make"}, Action: "execute", Group: "g1", Users: []string{"1000"}},
+	"r3": {Paths: []string{"/usr/bin/m*"}, Action: "execute", Trigger: "t1"},
+	"r4": {Paths: []string{"/usr/bin/make"}, Action: "read", Group: "g1"},
+	"r5": {Paths: []string{"/opt"}, Action: "execute", Group: "g1"},
+}
+
+func reasons(verdicts []Verdict) map[string]string {
+	result := make(map[string]string)
+	for _, v := range verdicts {
+		if v.Matched {
+			result[v.Rule] = "yes: " + v.Reason
+		} else {
+			result[v.Rule] = "no: " + v.Reason
+		}
+	}
+	return result
+}
+
+func TestRules(t *testing.T) {
+	log.InitLoggerForTests()
+	config := &settings.Settings{Mode: settings.RunModeProcConnector, Rules: rules}
+	verdicts := Rules(config, "/usr/bin/make", &filter.Process{UID: 0})
+	expected := map[string]string{
+		"r1": "yes: path /usr/bin matches",
+		"r2": "no: path /usr/bin/make matches, but users does not",
+		"r3": "yes: path /usr/bin/m* matches",
+		"r4": "no: action is read, not execute",
+		"r5": "no: no path matches",
+	}
+	if result := reasons(verdicts); !reflect.DeepEqual(result, expected) {
+		t.Error("Unexpected verdicts", result)
+	}
+	if winner := Winner(verdicts); winner != "r1" {
+		t.Error("First rule should win", winner)
+	}
+	verdicts = Rules(config, "/usr/bin/mv", &filter.Process{UID: 1000})
+	if winner := Winner(verdicts); winner != "r1" {
+		t.Error("First rule should win over closer paths", winner)
+	}
+	verdicts = Rules(config, "/usr/bin/make", nil)
+	if reasons(verdicts)["r2"] != "yes: path /usr/bin/make matches (filters not checked)" {
+		t.Error("Filters should not be checked without a process", reasons(verdicts)["r2"])
+	}
+	if winner := Winner(Rules(config, "/bin/sh", nil)); winner != "" {
+		t.Error("No rule should win", winner)
+	}
+}
+
+func TestRulesInScannerMode(t *testing.T) {
+	log.InitLoggerForTests()
+	config := &settings.Settings{Mode: settings.RunModeScanner, Rules: rules}
+	expected := map[string]string{
+		"r1": "yes: path /usr/bin matches",
+		"r2": "no: path /usr/bin/make matches, but users does not",
+		"r3": "no: no group (triggers are not run in scanner mode)",
+		"r4": "no: action is read, not execute",
+		"r5": "no: no path matches",
+	}
+	verdicts := Rules(config, "/usr/bin/make", &filter.Process{UID: 0})
+	if result := reasons(verdicts); !reflect.DeepEqual(result, expected) {
+		t.Error("Unexpected verdicts", result)
+	}
+	if winner := Winner(verdicts); winner != "r1" {
+		t.Error("Directories should cover executables in scanner mode too", winner)
+	}
+}
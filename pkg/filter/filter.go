@@ -0,0 +1,203 @@
+package filter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/process"
+
+	"github.com/juan-leon/fetter/pkg/ids"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/pattern"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+// Process holds the details of a process that rules can be filtered by
+type Process struct {
+	Pid     int
+	Cmdline string // arguments, joined by spaces
+	UID     uint32 // real user id
+	GID     uint32 // real group id
+	Auid    uint32 // login user id
+}
+
+// LoadProcess reads the details of a running process
+func LoadProcess(pid int) (*Process, error) {
+	p, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return nil, err
+	}
+	args, err := p.CmdlineSlice()
+	if err != nil {
+		return nil, err
+	}
+	uids, err := p.Uids()
+	if err != nil || len(uids) == 0 {
+		return nil, fmt.Errorf("could not read uid of process %d: %v", pid, err)
+	}
+	gids, err := p.Gids()
+	if err != nil || len(gids) == 0 {
+		return nil, fmt.Errorf("could not read gid of process %d: %v", pid, err)
+	}
+	auid, err := loginUID(pid)
+	if err != nil {
+		return nil, err
+	}
+	return &Process{
+		Pid:     pid,
+		Cmdline: strings.Join(args, " "),
+		UID:     uint32(uids[0]),
+		GID:     uint32(gids[0]),
+		Auid:    auid,
+	}, nil
+}
+
+// UnsetLoginUID is the login uid of processes not started from a login
+// session (or in kernels without audit support)
+const UnsetLoginUID = 4294967295
+
+func loginUID(pid int) (uint32, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/loginuid", pid))
+	if os.IsNotExist(err) {
+		return UnsetLoginUID, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	auid, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	return uint32(auid), err
+}
+
+// Filter holds the conditions, besides paths, a process needs to meet for
+// matching a rule
+type Filter struct {
+	cmdline      []*pattern.Cmdline
+	users        []uint32
+	groups       []uint32
+	excludeUsers []uint32
+	auids        []uint32
+}
+
+// New creates a Filter for rule
+func New(rule settings.Rule) (f *Filter, err error) {
+	f = &Filter{}
+	for _, text := range rule.Cmdline {
+		c, err := pattern.NewCmdline(text)
+		if err != nil {
+			return nil, err
+		}
+		f.cmdline = append(f.cmdline, c)
+	}
+	if f.users, err = ids.UIDs(rule.Users); err != nil {
+		return nil, err
+	}
+	if f.groups, err = ids.GIDs(rule.Groups); err != nil {
+		return nil, err
+	}
+	if f.excludeUsers, err = ids.UIDs(rule.ExcludeUsers); err != nil {
+		return nil, err
+	}
+	if f.auids, err = ids.UIDs(rule.Auid); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Empty tells whether the filter lets any process through
+func (f *Filter) Empty() bool {
+	return len(f.cmdline) == 0 && len(f.users) == 0 && len(f.groups) == 0 &&
+		len(f.excludeUsers) == 0 && len(f.auids) == 0
+}
+
+// Match tells whether a process meets the conditions of the filter.  Every
+// kind of condition must be met, but for each kind one of the values matching
+// is enough (like the process running as any of the users).
+func (f *Filter) Match(p *Process) bool {
+	return f.Mismatch(p) == ""
+}
+
+// Mismatch returns the first condition of the filter a process does not meet,
+// or an empty string if it meets them all
+func (f *Filter) Mismatch(p *Process) string {
+	if len(f.cmdline) > 0 && !matchAny(f.cmdline, p.Cmdline) {
+		return "cmdline"
+	}
+	if len(f.users) > 0 && !contains(f.users, p.UID) {
+		return "users"
+	}
+	if len(f.groups) > 0 && !contains(f.groups, p.GID) {
+		return "groups"
+	}
+	if contains(f.excludeUsers, p.UID) {
+		return "exclude_users"
+	}
+	if len(f.auids) > 0 && !contains(f.auids, p.Auid) {
+		return "auid"
+	}
+	return ""
+}
+
+func matchAny(matchers []*pattern.Cmdline, cmdline string) bool {
+	for _, c := range matchers {
+		if c.Match(cmdline) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []uint32, value uint32) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Filters holds the filters of the rules of a configuration, indexed by rule
+// name
+type Filters map[string]*Filter
+
+// NewFilters creates the filters for the rules of config.  Rules with bad
+// filters are left out.
+func NewFilters(config *settings.Settings) Filters {
+	filters := make(Filters)
+	for name, rule := range config.Rules {
+		f, err := New(rule)
+		if err != nil {
+			log.Logger.Errorf("Ignoring rule %s: %s", name, err)
+			continue
+		}
+		filters[name] = f
+	}
+	return filters
+}
+
+// Match tells whether the process with pid meets the conditions of rule.  The
+// details of the process are read only if needed.
+func (fs Filters) Match(rule string, pid int) bool {
+	f, ok := fs[rule]
+	if !ok {
+		return false
+	}
+	if f.Empty() {
+		return true
+	}
+	p, err := LoadProcess(pid)
+	if err != nil {
+		// Typically, condition races related to short lived processes
+		log.Logger.Debugw("Could not read process details", "pid", pid, "error", err)
+		return false
+	}
+	return f.Match(p)
+}
+
+// MatchProcess is like Match, for a process whose details are known already
+func (fs Filters) MatchProcess(rule string, p *Process) bool {
+	f, ok := fs[rule]
+	return ok && f.Match(p)
+}
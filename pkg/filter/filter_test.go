@@ -0,0 +1,90 @@
+package filter
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+func TestLoadProcess(t *testing.T) {
+	p, err := LoadProcess(os.Getpid())
+	if err != nil {
+		t.Fatal("Could not load process", err)
+	}
+	if !strings.Contains(p.Cmdline, "-test.") {
+		t.Error("Bad command line", p.Cmdline)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f, err := New(settings.Rule{Cmdline: []string{"foo.jar", "re:bar\\.jar$"}})
+	if err != nil {
+		t.Fatal("Could not create filter", err)
+	}
+	if f.Empty() {
+		t.Error("Filter should not be empty")
+	}
+	if !f.Match(&Process{Cmdline: "java -jar foo.jar"}) || !f.Match(&Process{Cmdline: "java -jar bar.jar"}) {
+		t.Error("Command line should have matched")
+	}
+	if f.Match(&Process{Cmdline: "java -jar baz.jar"}) {
+		t.Error("Command line should not have matched")
+	}
+	if _, err := New(settings.Rule{Cmdline: []string{"re:("}}); err == nil {
+		t.Error("Bad filter should fail")
+	}
+}
+
+func TestFilterCredentials(t *testing.T) {
+	f, err := New(settings.Rule{
+		Users:        []string{"root", "1000", "1001"},
+		Groups:       []string{"0", "1000"},
+		ExcludeUsers: []string{"1001"},
+		Auid:         []string{"1000"},
+	})
+	if err != nil {
+		t.Fatal("Could not create filter", err)
+	}
+	if f.Empty() {
+		t.Error("Filter should not be empty")
+	}
+	for _, c := range []struct {
+		p        Process
+		expected bool
+	}{
+		{Process{UID: 0, GID: 0, Auid: 1000}, true},
+		{Process{UID: 1000, GID: 1000, Auid: 1000}, true},
+		{Process{UID: 1001, GID: 1000, Auid: 1000}, false},
+		{Process{UID: 1002, GID: 1000, Auid: 1000}, false},
+		{Process{UID: 1000, GID: 1002, Auid: 1000}, false},
+		{Process{UID: 1000, GID: 1000, Auid: UnsetLoginUID}, false},
+	} {
+		if f.Match(&c.p) != c.expected {
+			t.Error("Bad filter result for", c.p)
+		}
+	}
+	if _, err := New(settings.Rule{Users: []string{"no-such-user"}}); err == nil {
+		t.Error("Bad filter should fail")
+	}
+}
+
+func TestFilters(t *testing.T) {
+	log.InitLoggerForTests()
+	filters := NewFilters(&settings.Settings{Rules: map[string]settings.Rule{
+		"r1": {},
+		"r2": {Cmdline: []string{"-test."}},
+		"r3": {Cmdline: []string{"no-such-argument"}},
+		"r4": {Cmdline: []string{"re:("}},
+		"r6": {Users: []string{strconv.Itoa(os.Getuid())}},
+		"r7": {ExcludeUsers: []string{strconv.Itoa(os.Getuid())}},
+	}})
+	for rule, expected := range map[string]bool{"r1": true, "r2": true, "r3": false, "r4": false, "r5": false, "r6": true, "r7": false} {
+		if filters.Match(rule, os.Getpid()) != expected {
+			t.Error("Bad filter result for", rule)
+		}
+	}
+}
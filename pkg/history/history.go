@@ -0,0 +1,60 @@
+package history
+
+import (
+	"sync"
+	"time"
+)
+
+// Match holds the details of a rule matched by a process
+type Match struct {
+	Time    time.Time `json:"time"`
+	Rule    string    `json:"rule"`
+	Pid     int       `json:"pid"`
+	Group   string    `json:"group,omitempty"`
+	Trigger string    `json:"trigger,omitempty"`
+	DryRun  bool      `json:"dry_run,omitempty"` // nothing was done about it
+}
+
+// History keeps the most recent matches, up to a fixed number of them.  A nil
+// History is valid, and records nothing.
+type History struct {
+	mu      sync.Mutex
+	matches []Match
+	next    int
+	full    bool
+}
+
+// NewHistory creates and initializes a History able to hold size matches
+func NewHistory(size int) *History {
+	return &History{matches: make([]Match, size)}
+}
+
+// Add records a match
+func (h *History) Add(match Match) {
+	if h == nil || len(h.matches) == 0 {
+		return
+	}
+	if match.Time.IsZero() {
+		match.Time = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.matches[h.next] = match
+	h.next = (h.next + 1) % len(h.matches)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Recent returns the recorded matches, oldest first
+func (h *History) Recent() []Match {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]Match{}, h.matches[:h.next]...)
+	}
+	return append(append([]Match{}, h.matches[h.next:]...), h.matches[:h.next]...)
+}
@@ -0,0 +1,34 @@
+package history
+
+import (
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	h := NewHistory(3)
+	if len(h.Recent()) != 0 {
+		t.Error("History should be empty")
+	}
+	h.Add(Match{Pid: 1})
+	h.Add(Match{Pid: 2})
+	if recent := h.Recent(); len(recent) != 2 || recent[0].Pid != 1 || recent[1].Pid != 2 {
+		t.Error("Bad recent matches", recent)
+	}
+	h.Add(Match{Pid: 3})
+	h.Add(Match{Pid: 4})
+	recent := h.Recent()
+	if len(recent) != 3 || recent[0].Pid != 2 || recent[2].Pid != 4 {
+		t.Error("Bad recent matches", recent)
+	}
+	if recent[0].Time.IsZero() {
+		t.Error("Time should have been set")
+	}
+}
+
+func TestNilHistory(t *testing.T) {
+	var h *History
+	h.Add(Match{Pid: 1})
+	if h.Recent() != nil {
+		t.Error("Nil history should hold nothing")
+	}
+}
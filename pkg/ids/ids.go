@@ -0,0 +1,58 @@
+package ids
+
+import (
+	"os/user"
+	"strconv"
+)
+
+// UID returns the uid of a user, given either its name or its uid
+func UID(name string) (uint32, error) {
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(uid), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(uid), err
+}
+
+// GID returns the gid of a group, given either its name or its gid
+func GID(name string) (uint32, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(gid), err
+}
+
+// UIDs returns the uids of users, given either by name or by uid
+func UIDs(names []string) ([]uint32, error) {
+	uids := make([]uint32, 0, len(names))
+	for _, name := range names {
+		uid, err := UID(name)
+		if err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+
+// GIDs returns the gids of groups, given either by name or by gid
+func GIDs(names []string) ([]uint32, error) {
+	gids := make([]uint32, 0, len(names))
+	for _, name := range names {
+		gid, err := GID(name)
+		if err != nil {
+			return nil, err
+		}
+		gids = append(gids, gid)
+	}
+	return gids, nil
+}
@@ -0,0 +1,33 @@
+package ids
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUID(t *testing.T) {
+	if uid, err := UID("root"); err != nil || uid != 0 {
+		t.Error("Bad uid for root", uid, err)
+	}
+	if uid, err := UID("1234"); err != nil || uid != 1234 {
+		t.Error("Bad uid for 1234", uid, err)
+	}
+	if _, err := UID("no-such-user"); err == nil {
+		t.Error("Unknown user should fail")
+	}
+	if uids, err := UIDs([]string{"root", "7"}); err != nil || !reflect.DeepEqual(uids, []uint32{0, 7}) {
+		t.Error("Bad uids", uids, err)
+	}
+}
+
+func TestGID(t *testing.T) {
+	if gid, err := GID("root"); err != nil || gid != 0 {
+		t.Error("Bad gid for root", gid, err)
+	}
+	if _, err := GID("no-such-group"); err == nil {
+		t.Error("Unknown group should fail")
+	}
+	if gids, err := GIDs([]string{"root", "7"}); err != nil || !reflect.DeepEqual(gids, []uint32{0, 7}) {
+		t.Error("Bad gids", gids, err)
+	}
+}
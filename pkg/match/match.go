@@ -0,0 +1,36 @@
+package match
+
+import (
+	"github.com/juan-leon/fetter/pkg/cgroups"
+	"github.com/juan-leon/fetter/pkg/history"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/metrics"
+	"github.com/juan-leon/fetter/pkg/settings"
+	"github.com/juan-leon/fetter/pkg/triggers"
+)
+
+// Apply acts on a process matching a rule, the same way in every run mode
+// where processes are matched as they are executed: the match is recorded,
+// the process is moved to the group of the rule (with its descendants, for
+// rules with tree scope) and the trigger of the rule is run with data.  For
+// rules not enforced, moving and triggering are only logged.
+func Apply(config *settings.Settings, rule string, pid int, data *map[string]string, procMover cgroups.ProcessMover, procRunner triggers.ProcessRunner, matches *history.History) {
+	log.Logger.Infof("Match for rule %s in pid %d", rule, pid)
+	group, trigger := config.GetGroup(rule), config.GetTrigger(rule)
+	enforced := config.Enforced(rule)
+	matches.Add(history.Match{Rule: rule, Pid: pid, Group: group, Trigger: trigger, DryRun: !enforced})
+	metrics.RuleMatches.WithLabelValues(rule).Inc()
+	if !enforced {
+		procMover, procRunner = cgroups.DryRun{}, triggers.DryRun{}
+	}
+	if group != "" {
+		if config.GetScope(rule) == settings.ScopeTree {
+			procMover.MoveTree(pid, group)
+		} else {
+			procMover.Move(pid, group)
+		}
+	}
+	if trigger != "" {
+		procRunner.Run(trigger, data)
+	}
+}
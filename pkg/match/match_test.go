@@ -0,0 +1,60 @@
+package match
+
+import (
+	"testing"
+
+	"github.com/juan-leon/fetter/pkg/history"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+type mock struct {
+	moved     bool
+	movedTree bool
+	ran       bool
+}
+
+func (m *mock) Move(pid int, cgroup string) error {
+	m.moved = true
+	return nil
+}
+
+func (m *mock) MoveTree(pid int, cgroup string) error {
+	m.movedTree = true
+	return nil
+}
+
+func (m *mock) Run(name string, data *map[string]string) error {
+	m.ran = true
+	return nil
+}
+
+func TestApply(t *testing.T) {
+	log.InitLoggerForTests()
+	enforce := false
+	config := &settings.Settings{Rules: map[string]settings.Rule{
+		"r1": {Paths: []string{"/bin/a"}, Action: "execute", Trigger: "t1"},
+		"r2": {Paths: []string{"/bin/b"}, Action: "execute", Group: "g1", Scope: "tree"},
+		"r3": {Paths: []string{"/bin/c"}, Action: "execute", Group: "g1", Trigger: "t1", Enforce: &enforce},
+	}}
+	matches := history.NewHistory(10)
+	m := &mock{}
+	Apply(config, "r1", 10, &map[string]string{}, m, m, matches)
+	if m.moved || m.movedTree || !m.ran {
+		t.Error("Trigger only should have run", m)
+	}
+	m = &mock{}
+	Apply(config, "r2", 11, nil, m, m, matches)
+	if m.moved || !m.movedTree || m.ran {
+		t.Error("Process tree only should have been moved", m)
+	}
+	m = &mock{}
+	Apply(config, "r3", 12, nil, m, m, matches)
+	if m.moved || m.movedTree || m.ran {
+		t.Error("Nothing should be done for rules not enforced", m)
+	}
+	recent := matches.Recent()
+	if len(recent) != 3 || recent[0].Rule != "r1" || recent[0].DryRun || !recent[2].DryRun {
+		t.Error("Bad matches", recent)
+	}
+}
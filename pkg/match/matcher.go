@@ -0,0 +1,71 @@
+package match
+
+import (
+	"github.com/juan-leon/fetter/pkg/filter"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/pattern"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+// Matcher finds the rule a process matches, for an action on a file (like
+// executing it).  Rules are tried in the order of their names: the first one
+// whose paths cover the file and whose filters the process meets wins.
+type Matcher struct {
+	rules   []string // with the action, in order
+	paths   map[string]pattern.Paths
+	filters filter.Filters
+}
+
+// NewMatcher creates a Matcher for the rules of config with action.  Bad paths
+// are left out, and rules with bad filters are ignored.
+func NewMatcher(config *settings.Settings, action string) *Matcher {
+	m := &Matcher{
+		paths:   make(map[string]pattern.Paths),
+		filters: filter.NewFilters(config),
+	}
+	for _, name := range config.RuleNames() {
+		r := config.Rules[name]
+		if r.Action != action {
+			continue
+		}
+		paths, err := pattern.NewPaths(r.Paths)
+		if err != nil {
+			log.Logger.Warnf("Ignoring path of rule %s: %s", name, err)
+		}
+		m.rules = append(m.rules, name)
+		m.paths[name] = paths
+	}
+	return m
+}
+
+// Rules returns the rules whose paths cover file, in order
+func (m *Matcher) Rules(file string) []string {
+	var rules []string
+	for _, name := range m.rules {
+		if _, ok := m.paths[name].Cover(file); ok {
+			rules = append(rules, name)
+		}
+	}
+	return rules
+}
+
+// Match returns the rule the process with pid matches for file, if any.  The
+// details of the process are read only if needed.
+func (m *Matcher) Match(file string, pid int) string {
+	for _, rule := range m.Rules(file) {
+		if m.filters.Match(rule, pid) {
+			return rule
+		}
+	}
+	return ""
+}
+
+// MatchProcess is like Match, for a process whose details are known already
+func (m *Matcher) MatchProcess(file string, p *filter.Process) string {
+	for _, rule := range m.Rules(file) {
+		if m.filters.MatchProcess(rule, p) {
+			return rule
+		}
+	}
+	return ""
+}
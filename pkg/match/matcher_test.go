@@ -0,0 +1,45 @@
+package match
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/juan-leon/fetter/pkg/filter"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+func TestMatcher(t *testing.T) {
+	log.InitLoggerForTests()
+	config := &settings.Settings{Rules: map[string]settings.Rule{
+		"r1": {Paths: []string{"re:^/opt/[a-z]+/bin/java$", "/usr/bin/make"}, Action: "execute", Group: "g1"},
+		"r2": {Paths: []string{"/usr/bin/*"}, Action: "execute", Group: "g1", Cmdline: []string{"install"}},
+		"r3": {Paths: []string{"/usr/"}, Action: "execute", Group: "g1"},
+		"r4": {Paths: []string{"/usr/bin/make"}, Action: "read", Group: "g1"},
+	}}
+	m := NewMatcher(config, settings.ActionExecute)
+	// Mixed paths: plain ones work along with regular expressions
+	for file, expected := range map[string][]string{
+		"/usr/bin/make":     {"r1", "r2", "r3"},
+		"/opt/jdk/bin/java": {"r1"},
+		"/usr/lib/x/y":      {"r3"},
+		"/opt/jdk/bin/jar":  nil,
+	} {
+		if rules := m.Rules(file); !reflect.DeepEqual(rules, expected) {
+			t.Error("Bad rules for", file, rules)
+		}
+	}
+	if rule := m.MatchProcess("/usr/bin/cc", &filter.Process{Cmdline: "cc -o x"}); rule != "r3" {
+		t.Error("Rule with filters not met should be skipped", rule)
+	}
+	if rule := m.MatchProcess("/usr/bin/cc", &filter.Process{Cmdline: "make install"}); rule != "r2" {
+		t.Error("First rule should win", rule)
+	}
+	if rule := m.Match("/opt/jdk/bin/java", os.Getpid()); rule != "r1" {
+		t.Error("Should have matched r1 instead of", rule)
+	}
+	if rules := NewMatcher(config, settings.ActionRead).Rules("/usr/bin/make"); !reflect.DeepEqual(rules, []string{"r4"}) {
+		t.Error("Only rules with the action should match", rules)
+	}
+}
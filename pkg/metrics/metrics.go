@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+const namespace = "fetter"
+
+var (
+	// AuditEvents counts the audit events received from the kernel
+	AuditEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_events_total",
+		Help:      "Audit events received from the kernel.",
+	})
+	// ParseErrors counts the kernel events that could not be parsed
+	ParseErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "parse_errors_total",
+		Help:      "Kernel events that could not be parsed.",
+	})
+	// LostEvents counts the audit events lost (due to a slow receiver, or to
+	// kernel rate limits)
+	LostEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_events_lost_total",
+		Help:      "Audit events lost, based on gaps in sequence numbers.",
+	})
+	// RuleMatches counts the matches of every rule
+	RuleMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rule_matches_total",
+		Help:      "Processes matching a rule.",
+	}, []string{"rule"})
+	// Moves counts the processes moved into every control group
+	Moves = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "moves_total",
+		Help:      "Processes moved into a control group.",
+	}, []string{"group"})
+	// Kills counts the processes killed from every control group (empty for
+	// processes that were in none of the hierarchy)
+	Kills = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kills_total",
+		Help:      "Processes killed, by the control group they were in.",
+	}, []string{"group"})
+	// Escalations counts the processes moved down the escalation steps of
+	// every rule
+	Escalations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "escalations_total",
+		Help:      "Processes moved (or killed) by an escalation step of a rule.",
+	}, []string{"rule", "group"})
+	// MemoryEvents counts the memory events (like OOM kills) of every control
+	// group, instances of template groups included.  In cgroup V1, max counts
+	// the times the limit was hit (memory.failcnt).
+	MemoryEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "memory_events_total",
+		Help:      "Memory events in a control group: high, max (limit hit), oom, oom_kill and pressure.",
+	}, []string{"group", "event"})
+	// TriggerRuns counts the executions of every trigger
+	TriggerRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "trigger_runs_total",
+		Help:      "Executions of a trigger.",
+	}, []string{"trigger"})
+	// TriggerFailures counts the executions of every trigger that failed
+	TriggerFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "trigger_failures_total",
+		Help:      "Executions of a trigger that failed.",
+	}, []string{"trigger"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		AuditEvents,
+		ParseErrors,
+		LostEvents,
+		RuleMatches,
+		Moves,
+		Kills,
+		Escalations,
+		MemoryEvents,
+		TriggerRuns,
+		TriggerFailures,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// Server instances expose metrics over HTTP, for Prometheus to scrape them
+type Server struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewServer creates and initializes a Server listening in the address
+// configured.  Metrics of collectors are exposed too.  Requests are not served
+// until Serve is called.
+func NewServer(config *settings.Settings, collectors ...prometheus.Collector) *Server {
+	listener, err := net.Listen("tcp", config.Metrics.Address)
+	if err != nil {
+		log.Logger.Errorf("Could not listen for metrics in %s: %s", config.Metrics.Address, err)
+		return nil
+	}
+	gatherers := prometheus.Gatherers{registry}
+	if len(collectors) > 0 {
+		extra := prometheus.NewRegistry()
+		for _, c := range collectors {
+			if err := extra.Register(c); err != nil {
+				log.Logger.Errorf("Could not register metrics collector: %s", err)
+				listener.Close()
+				return nil
+			}
+		}
+		gatherers = append(gatherers, extra)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{
+		ErrorLog:      errorLogger{},
+		ErrorHandling: promhttp.ContinueOnError,
+	}))
+	return &Server{listener: listener, server: &http.Server{Handler: mux}}
+}
+
+// Serve serves requests until Close is called
+func (s *Server) Serve() {
+	log.Logger.Debugw("Serving metrics", "address", s.listener.Addr())
+	if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+		log.Logger.Errorf("Error serving metrics: %s", err)
+	}
+}
+
+// Close stops serving requests
+func (s *Server) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Logger.Warnf("Could not shut down metrics server: %s", err)
+	}
+	s.listener.Close()
+}
+
+// errorLogger adapts the logger to what promhttp expects
+type errorLogger struct{}
+
+func (errorLogger) Println(v ...interface{}) {
+	log.Logger.Warn(v...)
+}
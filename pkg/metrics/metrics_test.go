@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+func TestServer(t *testing.T) {
+	log.InitLoggerForTests()
+	s := NewServer(&settings.Settings{Metrics: settings.Metrics{Address: "127.0.0.1:0"}})
+	if s == nil {
+		t.Fatal("Server should have been created")
+	}
+	go s.Serve()
+	defer s.Close()
+	RuleMatches.WithLabelValues("r1").Inc()
+	Moves.WithLabelValues("g1").Inc()
+	resp, err := http.Get("http://" + s.listener.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal("Request failed", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("Could not read response", err)
+	}
+	for _, expected := range []string{
+		`fetter_rule_matches_total{rule="r1"} 1`,
+		`fetter_moves_total{group="g1"} 1`,
+		"fetter_audit_events_total 0",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Error("Missing metric", expected)
+		}
+	}
+}
+
+func TestBadAddress(t *testing.T) {
+	log.InitLoggerForTests()
+	if NewServer(&settings.Settings{Metrics: settings.Metrics{Address: "nowhere"}}) != nil {
+		t.Error("Server should not have been created")
+	}
+}
@@ -0,0 +1,232 @@
+package pattern
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// RegexPrefix is the prefix of the paths of rules that are regular expressions
+const RegexPrefix = "re:"
+
+const (
+	literal = iota
+	glob
+	regex
+)
+
+// Pattern is an entry of the paths of a rule: either a literal path, a glob
+// (like /opt/jetbrains/*/bin/java) or a regular expression, prefixed by "re:"
+// (like re:^/home/[^/]+/\.cargo/bin/.*$).  Regular expressions are not
+// anchored unless they say so.
+type Pattern struct {
+	text string
+	kind int
+	re   *regexp.Regexp
+}
+
+// New creates a Pattern from an entry of the paths of a rule
+func New(text string) (*Pattern, error) {
+	switch {
+	case strings.HasPrefix(text, RegexPrefix):
+		re, err := regexp.Compile(text[len(RegexPrefix):])
+		if err != nil {
+			return nil, fmt.Errorf("bad regular expression %s: %w", text, err)
+		}
+		return &Pattern{text: text, kind: regex, re: re}, nil
+	case strings.ContainsAny(text, "*?["):
+		if _, err := filepath.Match(text, ""); err != nil {
+			return nil, fmt.Errorf("bad glob %s: %w", text, err)
+		}
+		return &Pattern{text: filepath.Clean(text), kind: glob}, nil
+	default:
+		return &Pattern{text: filepath.Clean(text), kind: literal}, nil
+	}
+}
+
+func (p *Pattern) String() string {
+	return p.text
+}
+
+// IsLiteral tells whether the pattern is a plain path
+func (p *Pattern) IsLiteral() bool {
+	return p.kind == literal
+}
+
+// IsRegex tells whether the pattern is a regular expression
+func (p *Pattern) IsRegex() bool {
+	return p.kind == regex
+}
+
+// Match tells whether path matches the pattern
+func (p *Pattern) Match(path string) bool {
+	switch p.kind {
+	case glob:
+		matched, _ := filepath.Match(p.text, path)
+		return matched
+	case regex:
+		return p.re.MatchString(path)
+	default:
+		return p.text == path
+	}
+}
+
+// Watches returns the paths that need to be watched (in audit mode) for
+// catching every path matching the pattern: globs are expanded to the paths
+// existing right now, and regular expressions are turned into the directory
+// every match is under.  Events for those watches can still be about paths not
+// matching a regular expression, so they need filtering.
+func (p *Pattern) Watches() ([]string, error) {
+	switch p.kind {
+	case glob:
+		return filepath.Glob(p.text)
+	case regex:
+		prefix := literalPrefix(p.text[len(RegexPrefix):])
+		dir := filepath.Clean(prefix[:strings.LastIndex(prefix, "/")+1])
+		if dir == "/" || dir == "." {
+			return nil, fmt.Errorf("regular expression %s should be anchored to a directory other than /", p.text)
+		}
+		return []string{dir}, nil
+	default:
+		return []string{p.text}, nil
+	}
+}
+
+// literalPrefix returns the literal string every string matching a regular
+// expression starts with.  Unlike regexp.LiteralPrefix, it copes with anchors,
+// and there is no such prefix if the expression is not anchored at start.
+func literalPrefix(expr string) string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+	if len(subs) == 0 || subs[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	var prefix strings.Builder
+	for _, sub := range subs[1:] {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			break
+		}
+		prefix.WriteString(string(sub.Rune))
+	}
+	return prefix.String()
+}
+
+// Paths are the paths of a rule, matched as a whole, the same way in every
+// run mode
+type Paths []*Pattern
+
+// NewPaths creates the Paths of a rule.  Bad entries are left out; the error
+// about the last of them is returned along with the rest.
+func NewPaths(texts []string) (paths Paths, err error) {
+	for _, text := range texts {
+		p, e := New(text)
+		if e != nil {
+			err = e
+			continue
+		}
+		paths = append(paths, p)
+	}
+	return
+}
+
+// Cover returns the entry covering file, if any: the first one matching file
+// itself or, failing that, the one matching the closest directory file is
+// under.  As it happens with audit watches, a directory covers every file
+// under it.  Regular expressions must match file itself, though: they are
+// watched as directories, but only because watches cannot be patterns.
+func (ps Paths) Cover(file string) (*Pattern, bool) {
+	for _, p := range ps {
+		if p.Match(file) {
+			return p, true
+		}
+	}
+	for dir := filepath.Dir(file); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		for _, p := range ps {
+			if !p.IsRegex() && p.Match(dir) {
+				return p, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Cmdline is an entry of the command line matchers of a rule: either a
+// substring, a glob (where * matches anything, slashes included) or a regular
+// expression, prefixed by "re:".  Globs must match the whole command line.
+type Cmdline struct {
+	text string
+	re   *regexp.Regexp
+}
+
+// NewCmdline creates a Cmdline from an entry of the command line matchers of a
+// rule
+func NewCmdline(text string) (*Cmdline, error) {
+	switch {
+	case strings.HasPrefix(text, RegexPrefix):
+		re, err := regexp.Compile(text[len(RegexPrefix):])
+		if err != nil {
+			return nil, fmt.Errorf("bad regular expression %s: %w", text, err)
+		}
+		return &Cmdline{text: text, re: re}, nil
+	case strings.ContainsAny(text, "*?["):
+		re, err := regexp.Compile(globRegexp(text))
+		if err != nil {
+			return nil, fmt.Errorf("bad glob %s: %w", text, err)
+		}
+		return &Cmdline{text: text, re: re}, nil
+	default:
+		return &Cmdline{text: text}, nil
+	}
+}
+
+func (c *Cmdline) String() string {
+	return c.text
+}
+
+// Match tells whether a command line (arguments joined by spaces) matches
+func (c *Cmdline) Match(cmdline string) bool {
+	if c.re == nil {
+		return strings.Contains(cmdline, c.text)
+	}
+	return c.re.MatchString(cmdline)
+}
+
+// globRegexp translates a glob into an anchored regular expression
+func globRegexp(glob string) string {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				// Unterminated class; make regexp complain about it
+				re.WriteString("[")
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return re.String()
+}
@@ -0,0 +1,141 @@
+package pattern
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	if p, err := New("/usr/bin/make/"); err != nil || !p.IsLiteral() || p.String() != "/usr/bin/make" {
+		t.Error("Bad literal pattern", p, err)
+	}
+	if p, err := New("/opt/*/bin/java"); err != nil || p.IsLiteral() || p.IsRegex() {
+		t.Error("Bad glob pattern", p, err)
+	}
+	if p, err := New("re:^/opt/.*"); err != nil || !p.IsRegex() {
+		t.Error("Bad regex pattern", p, err)
+	}
+	if _, err := New("/opt/[/bin"); err == nil {
+		t.Error("Bad glob should fail")
+	}
+	if _, err := New("re:^/opt/(.*"); err == nil {
+		t.Error("Bad regular expression should fail")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"/usr/bin/make", "/usr/bin/make", true},
+		{"/usr/bin/make", "/usr/bin/make2", false},
+		{"/opt/jetbrains/*/bin/java", "/opt/jetbrains/2021.1/bin/java", true},
+		{"/opt/jetbrains/*/bin/java", "/opt/jetbrains/2021.1/lib/java", false},
+		{"re:^/home/[^/]+/\\.cargo/bin/.*$", "/home/alice/.cargo/bin/rustc", true},
+		{"re:^/home/[^/]+/\\.cargo/bin/.*$", "/home/alice/xcargo/bin/rustc", false},
+	}
+	for _, c := range cases {
+		p, err := New(c.pattern)
+		if err != nil {
+			t.Fatal("Could not create pattern", c.pattern, err)
+		}
+		if p.Match(c.path) != c.match {
+			t.Error("Bad match result for", c.pattern, c.path)
+		}
+	}
+}
+
+func TestWatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fetter")
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to create dir", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, version := range []string{"1.0", "2.0"} {
+		if err := os.MkdirAll(filepath.Join(dir, version, "bin"), 0755); err != nil {
+			t.Fatal("Test cannot continue; failed to create dir", err)
+		}
+	}
+	cases := []struct {
+		pattern string
+		watches []string
+	}{
+		{"/usr/bin/make", []string{"/usr/bin/make"}},
+		{filepath.Join(dir, "*", "bin"), []string{filepath.Join(dir, "1.0", "bin"), filepath.Join(dir, "2.0", "bin")}},
+		{"re:^/home/[^/]+/\\.cargo/bin/", []string{"/home"}},
+		{"re:^/usr/bin/py.*", []string{"/usr/bin"}},
+		{"re:^/usr/(s)?bin/.*", []string{"/usr"}},
+	}
+	for _, c := range cases {
+		p, _ := New(c.pattern)
+		if watches, err := p.Watches(); err != nil || !reflect.DeepEqual(watches, c.watches) {
+			t.Error("Bad watches for", c.pattern, watches, err)
+		}
+	}
+	for _, bad := range []string{"re:.*java", "re:/usr/bin/.*", "re:^/[a-z]+/bin"} {
+		p, _ := New(bad)
+		if _, err := p.Watches(); err == nil {
+			t.Error("Watches should fail for", bad)
+		}
+	}
+}
+
+func TestPaths(t *testing.T) {
+	paths, err := NewPaths([]string{"re:^/opt/[a-z]+/bin/java$", "/usr/bin/make", "/usr/lib/*", "/opt/ide/", "re:("})
+	if err == nil || len(paths) != 4 {
+		t.Fatal("Bad path should have been left out", paths, err)
+	}
+	for file, expected := range map[string]string{
+		"/opt/jdk/bin/java":       "re:^/opt/[a-z]+/bin/java$",
+		"/usr/bin/make":           "/usr/bin/make",
+		"/usr/lib/firefox":        "/usr/lib/*",
+		"/usr/lib/firefox/bin/ff": "/usr/lib/*",
+		"/opt/ide/bin/ide":        "/opt/ide",
+		"/opt/ide":                "/opt/ide",
+	} {
+		if p, ok := paths.Cover(file); !ok || p.String() != expected {
+			t.Error("Bad entry covering", file, p)
+		}
+	}
+	for _, file := range []string{"/opt/jdk/bin/java/x", "/opt/jdk/bin/javac", "/usr/bin/make2", "/usr/lib", "/opt/ide2/ide"} {
+		if p, ok := paths.Cover(file); ok {
+			t.Error("Nothing should cover", file, p)
+		}
+	}
+}
+
+func TestCmdline(t *testing.T) {
+	cases := []struct {
+		matcher string
+		cmdline string
+		match   bool
+	}{
+		{"foo.jar", "java -jar /opt/foo.jar", true},
+		{"foo.jar", "java -jar /opt/bar.jar", false},
+		{"*-jar */foo.jar*", "java -jar /opt/foo.jar --verbose", true},
+		{"*-jar */foo.jar", "java -jar /opt/foo.jar --verbose", false},
+		{"python3 train?.py", "python3 train2.py", true},
+		{"python3 train[!0-9].py", "python3 train2.py", false},
+		{"re:train\\.py( |$)", "python3 train.py --epochs 3", true},
+		{"re:^python3 [a-z]+\\.py$", "python3 train.py --epochs 3", false},
+	}
+	for _, c := range cases {
+		m, err := NewCmdline(c.matcher)
+		if err != nil {
+			t.Fatal("Could not create matcher", c.matcher, err)
+		}
+		if m.Match(c.cmdline) != c.match {
+			t.Error("Bad match result for", c.matcher, c.cmdline)
+		}
+	}
+	for _, bad := range []string{"re:(", "foo[bar"} {
+		if _, err := NewCmdline(bad); err == nil {
+			t.Error("Matcher should fail", bad)
+		}
+	}
+}
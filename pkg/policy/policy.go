@@ -0,0 +1,297 @@
+package policy
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juan-leon/fetter/pkg/cgroups"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/metrics"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+// How often the members of control groups are checked against the escalation
+// steps of rules
+const checkInterval = 10 * time.Second
+
+// Hierarchy is what a PolicyEngine needs from the control group hierarchy
+// (implemented by cgroups.GroupHierarchy)
+type Hierarchy interface {
+	cgroups.ProcessMover
+	// Status returns the status of every control group, indexed by name
+	Status() map[string]cgroups.GroupStatus
+}
+
+// PolicyEngine entities move the processes in control groups down the
+// escalation steps of rules, as they stay there (with the usage of the group
+// over thresholds, if configured).
+type PolicyEngine struct {
+	mu      sync.Mutex
+	config  *settings.Settings
+	groups  Hierarchy
+	members map[string]map[int]*member // by control group name and pid
+	over    map[stepKey]time.Time      // since when usage is over thresholds
+	cpu     map[string]cpuSample       // by control group name
+}
+
+// member is what is known about a process in a control group
+type member struct {
+	since     time.Time // first seen in the control group
+	escalated bool      // moved down already (or logged, if not enforced)
+}
+
+// stepKey identifies an escalation step of a rule, applied to a control group
+type stepKey struct {
+	rule   string
+	step   int
+	cgroup string
+}
+
+// cpuSample holds the CPU used by a control group at some point, for telling
+// how fast it is using it
+type cpuSample struct {
+	usage uint64 // in nanoseconds
+	at    time.Time
+}
+
+// NewPolicyEngine creates and initializes a PolicyEngine object
+func NewPolicyEngine(config *settings.Settings, groups Hierarchy) *PolicyEngine {
+	return &PolicyEngine{
+		config:  config,
+		groups:  groups,
+		members: make(map[string]map[int]*member),
+		over:    make(map[stepKey]time.Time),
+		cpu:     make(map[string]cpuSample),
+	}
+}
+
+// Reload applies the rules of a new configuration.  Usage is tracked afresh,
+// and processes escalated already are due again, for the rules whose escalation
+// changed.
+func (pe *PolicyEngine) Reload(config *settings.Settings) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	for key := range pe.over {
+		if changed(pe.config, config, key.rule) {
+			delete(pe.over, key)
+		}
+	}
+	// Processes in the groups of those rules are due again, by the new steps
+	var from []string
+	for _, c := range []*settings.Settings{pe.config, config} {
+		for _, rule := range c.RuleNames() {
+			if changed(pe.config, config, rule) {
+				from = append(from, escalatedFrom(c, rule)...)
+			}
+		}
+	}
+	for cgroup, members := range pe.members {
+		for _, name := range from {
+			if within(cgroup, name) {
+				for _, m := range members {
+					m.escalated = false
+				}
+				break
+			}
+		}
+	}
+	pe.config = config
+}
+
+// changed tells whether the escalation of a rule differs between two
+// configurations
+func changed(old, config *settings.Settings, rule string) bool {
+	o, r := old.Rules[rule], config.Rules[rule]
+	return o.Group != r.Group || !reflect.DeepEqual(o.Escalate, r.Escalate)
+}
+
+// escalatedFrom returns the groups processes are escalated from by a rule:
+// its group, and those of its steps but the last one
+func escalatedFrom(config *settings.Settings, rule string) []string {
+	steps := config.GetEscalation(rule)
+	if len(steps) == 0 {
+		return nil
+	}
+	from := []string{config.GetGroup(rule)}
+	for _, step := range steps[:len(steps)-1] {
+		from = append(from, step.Group)
+	}
+	return from
+}
+
+// Loop calls Check method every now and then, until ctx is cancelled
+func (pe *PolicyEngine) Loop(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pe.Check()
+		}
+	}
+}
+
+// Check moves down the next escalation step the processes that are due
+func (pe *PolicyEngine) Check() {
+	pe.check(time.Now())
+}
+
+func (pe *PolicyEngine) check(now time.Time) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	if !pe.escalating() {
+		return
+	}
+	status := pe.groups.Status()
+	rates := pe.sample(status, now)
+	pe.track(status, now)
+	names := make([]string, 0, len(status))
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	over := make(map[stepKey]time.Time)
+	for _, rule := range pe.config.RuleNames() {
+		from := pe.config.GetGroup(rule)
+		for i, step := range pe.config.GetEscalation(rule) {
+			for _, name := range names {
+				if !within(name, from) {
+					continue
+				}
+				// Processes are due after being in the group for long
+				// enough, and with usage over thresholds all along
+				var start time.Time
+				if step.Memory > 0 || step.CPU > 0 {
+					if !overThresholds(step, status[name], rates[name]) {
+						continue
+					}
+					key := stepKey{rule, i, name}
+					since, ok := pe.over[key]
+					if !ok {
+						since = now
+					}
+					over[key], start = since, since
+				}
+				pe.escalate(rule, step, name, start, now)
+			}
+			from = step.Group
+		}
+	}
+	pe.over = over
+}
+
+// escalating tells whether any rule has escalation steps
+func (pe *PolicyEngine) escalating() bool {
+	for _, rule := range pe.config.Rules {
+		if len(rule.Escalate) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// escalate moves the processes in a control group to the group of a step, if
+// they have been there for long enough since start
+func (pe *PolicyEngine) escalate(rule string, step settings.Step, cgroup string, start, now time.Time) {
+	members := pe.members[cgroup]
+	pids := make([]int, 0, len(members))
+	for pid := range members {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	enforced := pe.config.Enforced(rule)
+	var procMover cgroups.ProcessMover = pe.groups
+	if !enforced {
+		procMover = cgroups.DryRun{}
+	}
+	group, _ := settings.SplitGroup(step.Group)
+	for _, pid := range pids {
+		m := members[pid]
+		since := m.since
+		if start.After(since) {
+			since = start
+		}
+		if m.escalated || now.Sub(since) < time.Duration(step.After) {
+			continue
+		}
+		if enforced {
+			log.Logger.Infow("Escalating process", "pid", pid, "rule", rule, "from", cgroup, "to", step.Group)
+		}
+		if err := procMover.Move(pid, step.Group); err != nil {
+			continue
+		}
+		m.escalated = true
+		if enforced {
+			metrics.Escalations.WithLabelValues(rule, group).Inc()
+		}
+	}
+}
+
+// track takes note of the processes in every control group, and since when
+// they are there
+func (pe *PolicyEngine) track(status map[string]cgroups.GroupStatus, now time.Time) {
+	members := make(map[string]map[int]*member)
+	for name, s := range status {
+		members[name] = make(map[int]*member)
+		for _, pid := range s.Members {
+			m, ok := pe.members[name][pid]
+			if !ok {
+				m = &member{since: now}
+			}
+			members[name][pid] = m
+		}
+	}
+	pe.members = members
+}
+
+// sample returns the CPU used by every control group since last check, in
+// cores
+func (pe *PolicyEngine) sample(status map[string]cgroups.GroupStatus, now time.Time) map[string]float64 {
+	rates := make(map[string]float64)
+	samples := make(map[string]cpuSample)
+	for name, s := range status {
+		if s.Usage == nil {
+			continue
+		}
+		if last, ok := pe.cpu[name]; ok && now.After(last.at) && s.Usage.CPU >= last.usage {
+			rates[name] = float64(s.Usage.CPU-last.usage) / float64(now.Sub(last.at))
+		}
+		samples[name] = cpuSample{usage: s.Usage.CPU, at: now}
+	}
+	pe.cpu = samples
+	return rates
+}
+
+// overThresholds tells whether the usage of a control group is over any of
+// the thresholds of a step.  cores is the CPU it used since last check.
+func overThresholds(step settings.Step, s cgroups.GroupStatus, cores float64) bool {
+	if s.Usage == nil {
+		return false
+	}
+	if step.Memory > 0 && s.Limits.RAM > 0 && float64(s.Usage.Memory) >= step.Memory/100*float64(s.Limits.RAM) {
+		return true
+	}
+	return step.CPU > 0 && s.Limits.CPU > 0 && cores >= step.CPU/100*float64(s.Limits.CPU)
+}
+
+// within tells whether a control group, identified by its name, is the group
+// configured (for a rule or step) as name, or one of its instances if name
+// has placeholders (like browsers/{user})
+func within(cgroup, name string) bool {
+	group, key := settings.SplitGroup(name)
+	cgroupGroup, cgroupKey := settings.SplitGroup(cgroup)
+	switch {
+	case cgroupGroup != group:
+		return false
+	case strings.Contains(key, "{"):
+		return cgroupKey != ""
+	default:
+		return cgroupKey == key
+	}
+}
@@ -0,0 +1,162 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/juan-leon/fetter/pkg/cgroups"
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
+// fakeHierarchy moves processes between the control groups in its status
+type fakeHierarchy struct {
+	status map[string]cgroups.GroupStatus
+	moves  []string
+}
+
+func (f *fakeHierarchy) Move(pid int, cgroup string) error {
+	f.moves = append(f.moves, cgroup)
+	for name, s := range f.status {
+		for i, member := range s.Members {
+			if member == pid {
+				s.Members = append(s.Members[:i], s.Members[i+1:]...)
+				f.status[name] = s
+				break
+			}
+		}
+	}
+	if s, ok := f.status[cgroup]; ok {
+		s.Members = append(s.Members, pid)
+		f.status[cgroup] = s
+	}
+	return nil
+}
+
+func (f *fakeHierarchy) MoveTree(pid int, cgroup string) error {
+	return f.Move(pid, cgroup)
+}
+
+func (f *fakeHierarchy) Status() map[string]cgroups.GroupStatus {
+	status := make(map[string]cgroups.GroupStatus)
+	for name, s := range f.status {
+		s.Members = append([]int{}, s.Members...)
+		status[name] = s
+	}
+	return status
+}
+
+func TestEscalation(t *testing.T) {
+	log.InitLoggerForTests()
+	slow := settings.Group{RAM: 100 * settings.Megabyte, CPU: 2}
+	config := &settings.Settings{
+		Groups: map[string]settings.Group{"slow": slow, "frozen": {Freeze: true}},
+		Rules: map[string]settings.Rule{
+			"r1": {Group: "slow", Escalate: []settings.Step{
+				{Group: "frozen", After: settings.Duration(time.Minute), Memory: 90, CPU: 50},
+				{Group: settings.Kill, After: settings.Duration(5 * time.Minute)},
+			}},
+		},
+	}
+	f := &fakeHierarchy{status: map[string]cgroups.GroupStatus{
+		"slow":   {Limits: slow, Usage: &cgroups.Usage{Memory: 50 << 20}, Members: []int{10, 11}},
+		"frozen": {Usage: &cgroups.Usage{}},
+	}}
+	pe := NewPolicyEngine(config, f)
+	start := time.Now()
+	at := func(d time.Duration, memory, cpu uint64) {
+		s := f.status["slow"]
+		s.Usage = &cgroups.Usage{Memory: memory << 20, CPU: cpu}
+		f.status["slow"] = s
+		pe.check(start.Add(d))
+	}
+	at(0, 50, 0)
+	// Over memory threshold, but not for long enough
+	at(time.Minute, 95, 0)
+	at(90*time.Second, 95, 0)
+	if len(f.moves) != 0 {
+		t.Fatal("Nothing should have moved yet", f.moves)
+	}
+	// Back under the thresholds: time over them starts again
+	at(2*time.Minute, 50, uint64(10*time.Second))
+	at(3*time.Minute, 95, uint64(10*time.Second))
+	at(3*time.Minute+50*time.Second, 95, uint64(10*time.Second))
+	if len(f.moves) != 0 {
+		t.Fatal("Nothing should have moved yet", f.moves)
+	}
+	// Over CPU threshold (a core out of two) instead
+	at(4*time.Minute, 50, uint64(20*time.Second))
+	if !reflect.DeepEqual(f.moves, []string{"frozen", "frozen"}) {
+		t.Fatal("Processes should have been frozen", f.moves)
+	}
+	// Time in the new group counts since it was seen there
+	at(8*time.Minute, 50, 0)
+	at(12*time.Minute, 50, 0)
+	if len(f.moves) != 2 {
+		t.Fatal("Processes should not have been killed yet", f.moves)
+	}
+	at(13*time.Minute, 50, 0)
+	if !reflect.DeepEqual(f.moves, []string{"frozen", "frozen", settings.Kill, settings.Kill}) {
+		t.Fatal("Processes should have been killed", f.moves)
+	}
+	// Not enforced: logged once, but not acted on
+	f.status["slow"] = cgroups.GroupStatus{Limits: slow, Usage: &cgroups.Usage{}, Members: []int{12}}
+	enforce := false
+	rule := config.Rules["r1"]
+	rule.Enforce = &enforce
+	config.Rules["r1"] = rule
+	pe.Reload(config)
+	at(14*time.Minute, 95, 0)
+	at(16*time.Minute, 95, 0)
+	at(17*time.Minute, 95, 0)
+	if len(f.moves) != 4 || !pe.members["slow"][12].escalated {
+		t.Error("Processes should be escalated in dry run only", f.moves)
+	}
+}
+
+func TestReload(t *testing.T) {
+	log.InitLoggerForTests()
+	config := &settings.Settings{
+		Rules: map[string]settings.Rule{
+			"r1": {Group: "slow", Escalate: []settings.Step{{Group: "frozen", After: settings.Duration(time.Minute)}}},
+			"r2": {Group: "browsers/{user}", Escalate: []settings.Step{{Group: "frozen", After: settings.Duration(time.Minute)}}},
+		},
+	}
+	pe := NewPolicyEngine(config, &fakeHierarchy{})
+	pe.members = map[string]map[int]*member{
+		"slow":           {10: {escalated: true}},
+		"browsers/alice": {11: {escalated: true}},
+		"frozen":         {12: {escalated: true}},
+	}
+	reloaded := &settings.Settings{Rules: map[string]settings.Rule{
+		"r1": config.Rules["r1"],
+		"r2": {Group: "browsers/{user}", Escalate: []settings.Step{{Group: "frozen", After: settings.Duration(time.Hour)}}},
+	}}
+	pe.Reload(reloaded)
+	if !pe.members["slow"][10].escalated || !pe.members["frozen"][12].escalated {
+		t.Error("Processes escalated by unchanged rules should stay so")
+	}
+	if pe.members["browsers/alice"][11].escalated {
+		t.Error("Processes escalated by changed rules should be due again")
+	}
+}
+
+func TestWithin(t *testing.T) {
+	for _, c := range []struct {
+		cgroup, name string
+		ok           bool
+	}{
+		{"slow", "slow", true},
+		{"slow", "slower", false},
+		{"browsers/alice", "browsers/{user}", true},
+		{"browsers/alice", "browsers/alice", true},
+		{"browsers/bob", "browsers/alice", false},
+		{"browsers", "browsers/{user}", false},
+		{"slow", settings.Kill, false},
+	} {
+		if within(c.cgroup, c.name) != c.ok {
+			t.Error("Bad result for", c.cgroup, c.name)
+		}
+	}
+}
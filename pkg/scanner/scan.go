@@ -1,38 +1,71 @@
 package scanner
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/shirou/gopsutil/process"
 
 	"github.com/juan-leon/fetter/pkg/cgroups"
+	"github.com/juan-leon/fetter/pkg/history"
 	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/match"
+	"github.com/juan-leon/fetter/pkg/metrics"
 	"github.com/juan-leon/fetter/pkg/settings"
 )
 
 // ProcessScanner entities can scan running processes and move them to control groups.
 type ProcessScanner struct {
-	ruleMap   map[string]string
+	mu        sync.RWMutex
+	config    *settings.Settings
+	matcher   *match.Matcher
 	procMover cgroups.ProcessMover
+	matches   *history.History
+	matched   map[int32]string // rule matched by each process in last scan
+}
+
+// holder is implemented by process movers that can tell whether a process is
+// in one of their control groups already (like cgroups.GroupHierarchy)
+type holder interface {
+	Holds(pid int) bool
 }
 
 // NewProcessScanner creates and initializes a ProcessScanner object.
-func NewProcessScanner(config *settings.Settings, procMover cgroups.ProcessMover) *ProcessScanner {
-	ruleMap := make(map[string]string)
-	for _, r := range config.Rules {
-		if r.Action == "execute" && r.Group != "" {
-			for _, path := range r.Paths {
-				if _, ok := ruleMap[path]; ok {
-					log.Logger.Warnf("Path %s appears in several rules; ignoring", path)
-				}
-				ruleMap[path] = r.Group
-			}
-		}
-	}
+func NewProcessScanner(config *settings.Settings, procMover cgroups.ProcessMover, matches *history.History) *ProcessScanner {
 	return &ProcessScanner{
-		ruleMap:   ruleMap,
+		config:    config,
+		matcher:   newMatcher(config),
 		procMover: procMover,
+		matches:   matches,
+		matched:   make(map[int32]string),
+	}
+}
+
+// Reload applies the rules of a new configuration.  They will be used from
+// next scan on.
+func (ps *ProcessScanner) Reload(config *settings.Settings) {
+	matcher := newMatcher(config)
+	ps.mu.Lock()
+	ps.config = config
+	ps.matcher = matcher
+	ps.mu.Unlock()
+}
+
+// newMatcher returns the Matcher for the rules scanning can act on: those
+// moving processes to groups (triggers are not run when scanning)
+func newMatcher(config *settings.Settings) *match.Matcher {
+	for _, name := range config.IgnoredRules() {
+		log.Logger.Warnf("Ignoring rule %s: only executions are seen in %s mode", name, config.Mode)
+	}
+	scanned := *config
+	scanned.Rules = make(map[string]settings.Rule)
+	for name, r := range config.Rules {
+		if r.Group != "" {
+			scanned.Rules[name] = r
+		}
 	}
+	return match.NewMatcher(&scanned, settings.ActionExecute)
 }
 
 // Scan does the job a ProcessScanner is supposed to do.
@@ -41,28 +74,76 @@ func (ps *ProcessScanner) Scan() {
 	if err != nil {
 		log.Logger.Fatalf("Cannot scan processes %s", err)
 	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	matched := make(map[int32]string)
+	held, _ := ps.procMover.(holder)
+	// Processes in a control group already are left there: they were moved
+	// by a previous scan, or somewhere else since (like down the escalation
+	// steps of the rule), and moving them back would undo that
+	move := func(procMover cgroups.ProcessMover, pid int, group string) {
+		if held != nil && held.Holds(pid) {
+			return
+		}
+		log.Logger.Debugf("Adding process %d to cgroup %s", pid, group)
+		procMover.Move(pid, group)
+	}
+	// The process table is read once per scan, for every rule with tree
+	// scope, and only if needed
+	var children map[int][]int
 	for _, p := range processes {
 		exe, err := p.Exe()
 		if err != nil {
 			// Typically, condition races related to short lived processes
 			continue
 		}
-		if group, ok := ps.ruleMap[exe]; ok {
-			log.Logger.Debugf("Adding %s (pid %d) to cgroup %s", exe, p.Pid, group)
-			ps.procMover.Move(int(p.Pid), group)
+		if rule := ps.matcher.Match(exe, int(p.Pid)); rule != "" {
+			group := ps.config.GetGroup(rule)
+			enforced := ps.config.Enforced(rule)
+			// Processes are matched again on every scan; only the first
+			// time counts as a match (and is worth logging in dry run).
+			first := ps.matched[p.Pid] != rule
+			if first {
+				ps.matches.Add(history.Match{Rule: rule, Pid: int(p.Pid), Group: group, DryRun: !enforced})
+				metrics.RuleMatches.WithLabelValues(rule).Inc()
+			}
+			procMover := ps.procMover
+			if !enforced {
+				procMover = cgroups.DryRun{}
+			}
+			if enforced || first {
+				move(procMover, int(p.Pid), group)
+				if ps.config.GetScope(rule) == settings.ScopeTree {
+					// Since this is done on every scan, descendants forked
+					// since previous scan are caught too.
+					if children == nil {
+						children = cgroups.ChildrenMap(processes)
+					}
+					for _, child := range cgroups.Descendants(int(p.Pid), children) {
+						move(procMover, child, group)
+					}
+				}
+			}
+			matched[p.Pid] = rule
 		}
 	}
+	ps.matched = matched
 }
 
-// Loop calls Scan method every second.  This method never returns.
-func (ps *ProcessScanner) Loop() {
+// Loop calls Scan method every second, until ctx is cancelled.
+func (ps *ProcessScanner) Loop(ctx context.Context) {
 	for {
 		ps.Scan()
 		// Scanning processes uses some CPU in heavily loaded machines, but long
 		// delays between scans will increase the likelihood of processes
 		// spawning children that are left out the control group (for instance,
 		// a rule could be good to catch an IDE, but not its LSP subprocesses).
-		// That is a problem better solved with the audit alternative.
-		time.Sleep(time.Second)
+		// That is a problem better solved with the audit alternative, or
+		// with rules with tree scope.
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
 	}
 }
@@ -1,25 +1,39 @@
 package scanner
 
 import (
+	"context"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/juan-leon/fetter/pkg/cgroups"
+	"github.com/juan-leon/fetter/pkg/history"
 	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/policy"
 	"github.com/juan-leon/fetter/pkg/settings"
 )
 
 type fakeMover struct {
 	pid   int
 	where string
+	tree  bool
+	pids  []int // every process moved
 }
 
 func (f *fakeMover) Move(pid int, cgroup string) error {
 	f.pid = pid
+	f.pids = append(f.pids, pid)
 	f.where = cgroup
 	return nil
 }
 
+func (f *fakeMover) MoveTree(pid int, cgroup string) error {
+	f.tree = true
+	return f.Move(pid, cgroup)
+}
+
 func TestScan(t *testing.T) {
 	log.InitLoggerForTests()
 	executable, err := os.Executable()
@@ -40,7 +54,7 @@ func TestScan(t *testing.T) {
 		},
 	}
 	mock := fakeMover{}
-	ps := NewProcessScanner(config, &mock)
+	ps := NewProcessScanner(config, &mock, nil)
 	ps.Scan()
 	if mock.pid == 0 {
 		t.Error("We should have detected the pid")
@@ -48,4 +62,235 @@ func TestScan(t *testing.T) {
 	if mock.where != "g1" {
 		t.Error("We should have move the process into group 'g1'")
 	}
+	if mock.tree {
+		t.Error("We should not have moved the process tree")
+	}
+}
+
+func TestScanDirectory(t *testing.T) {
+	log.InitLoggerForTests()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to find command", err)
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to resolve symlinks", executable, err)
+	}
+	config := &settings.Settings{
+		Rules: map[string]settings.Rule{
+			"r1": {Paths: []string{"re:^/no/such/dir/.*", filepath.Dir(executable)}, Action: "execute", Group: "g1"},
+		},
+	}
+	mock := fakeMover{}
+	NewProcessScanner(config, &mock, nil).Scan()
+	if mock.where != "g1" {
+		t.Error("Directories should cover the executables under them", mock.where)
+	}
+}
+
+func TestScanDryRun(t *testing.T) {
+	log.InitLoggerForTests()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to find command", err)
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to resolve symlinks", executable, err)
+	}
+	enforce := false
+	config := &settings.Settings{
+		Rules: map[string]settings.Rule{
+			"r1": {Paths: []string{executable}, Action: "execute", Group: "g1", Enforce: &enforce},
+		},
+	}
+	mock := fakeMover{}
+	matches := history.NewHistory(10)
+	NewProcessScanner(config, &mock, matches).Scan()
+	if mock.pid != 0 {
+		t.Error("No process should be moved in dry run")
+	}
+	if recent := matches.Recent(); len(recent) != 1 || !recent[0].DryRun {
+		t.Error("Match should have been recorded as a dry run", recent)
+	}
+}
+
+func TestScanWithCmdline(t *testing.T) {
+	log.InitLoggerForTests()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to find command", err)
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to resolve symlinks", executable, err)
+	}
+	config := &settings.Settings{
+		Rules: map[string]settings.Rule{
+			"r1": {Paths: []string{executable}, Action: "execute", Group: "g1", Cmdline: []string{"no-such-argument"}},
+			"r2": {Paths: []string{executable}, Action: "execute", Group: "g2", Cmdline: []string{"*-test.*"}},
+		},
+	}
+	mock := fakeMover{}
+	NewProcessScanner(config, &mock, nil).Scan()
+	if mock.where != "g2" {
+		t.Error("We should have moved the process into group 'g2'", mock.where)
+	}
+}
+
+func TestScanRecordsMatchesOnce(t *testing.T) {
+	log.InitLoggerForTests()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to find command", err)
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to resolve symlinks", executable, err)
+	}
+	config := &settings.Settings{
+		Rules: map[string]settings.Rule{
+			"r1": {Paths: []string{executable}, Action: "execute", Group: "g1"},
+		},
+	}
+	matches := history.NewHistory(10)
+	ps := NewProcessScanner(config, &fakeMover{}, matches)
+	ps.Scan()
+	ps.Scan()
+	recent := matches.Recent()
+	if len(recent) != 1 {
+		t.Fatal("Process should have been recorded once", recent)
+	}
+	if recent[0].Rule != "r1" || recent[0].Group != "g1" || recent[0].Pid != os.Getpid() {
+		t.Error("Bad match recorded", recent[0])
+	}
+}
+
+func TestScanTree(t *testing.T) {
+	log.InitLoggerForTests()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to find command", err)
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to resolve symlinks", executable, err)
+	}
+	cmd := exec.Command("/bin/sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatal("Test cannot continue; failed to spawn child", err)
+	}
+	defer cmd.Process.Kill()
+	config := &settings.Settings{
+		Rules: map[string]settings.Rule{
+			"r1": {Paths: []string{executable}, Action: "execute", Group: "g1", Scope: "tree"},
+		},
+	}
+	mock := fakeMover{}
+	NewProcessScanner(config, &mock, nil).Scan()
+	if len(mock.pids) < 2 || mock.pids[0] != os.Getpid() {
+		t.Fatal("Process should have been moved before its descendants", mock.pids)
+	}
+	for _, pid := range mock.pids {
+		if pid == cmd.Process.Pid {
+			return
+		}
+	}
+	t.Error("Child", cmd.Process.Pid, "should have been moved too", mock.pids)
+}
+
+func TestReload(t *testing.T) {
+	log.InitLoggerForTests()
+	ps := NewProcessScanner(&settings.Settings{}, &fakeMover{}, nil)
+	ps.Reload(&settings.Settings{
+		Rules: map[string]settings.Rule{
+			"r1": {Paths: []string{"/bin/foo"}, Action: "execute", Group: "g1"},
+			"r2": {Paths: []string{"/bin/bar"}, Action: "read", Group: "g1"},
+		},
+	})
+	if rules := ps.matcher.Rules("/bin/foo"); len(rules) != 1 {
+		t.Error("Rules should have been reloaded", rules)
+	}
+	if rules := ps.matcher.Rules("/bin/bar"); len(rules) != 0 {
+		t.Error("Only execute rules should be scanned", rules)
+	}
+}
+
+func TestLoopCancelled(t *testing.T) {
+	log.InitLoggerForTests()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan bool)
+	go func() {
+		NewProcessScanner(&settings.Settings{}, &fakeMover{}, nil).Loop(ctx)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Loop should have returned once cancelled")
+	}
+}
+
+// fakeHierarchy keeps the control group of every process moved
+type fakeHierarchy struct {
+	groups map[int]string
+	moves  int
+}
+
+func (f *fakeHierarchy) Move(pid int, cgroup string) error {
+	f.groups[pid] = cgroup
+	f.moves++
+	return nil
+}
+
+func (f *fakeHierarchy) MoveTree(pid int, cgroup string) error {
+	return f.Move(pid, cgroup)
+}
+
+func (f *fakeHierarchy) Holds(pid int) bool {
+	_, ok := f.groups[pid]
+	return ok
+}
+
+func (f *fakeHierarchy) Status() map[string]cgroups.GroupStatus {
+	status := map[string]cgroups.GroupStatus{"g1": {}, "frozen": {}}
+	for pid, cgroup := range f.groups {
+		s := status[cgroup]
+		s.Members = append(s.Members, pid)
+		status[cgroup] = s
+	}
+	return status
+}
+
+func TestScanWithEscalation(t *testing.T) {
+	log.InitLoggerForTests()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to find command", err)
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		t.Fatal("Test cannot continue; failed to resolve symlinks", executable, err)
+	}
+	config := &settings.Settings{
+		Groups: map[string]settings.Group{"g1": {}, "frozen": {Freeze: true}},
+		Rules: map[string]settings.Rule{
+			"r1": {Paths: []string{executable}, Action: "execute", Group: "g1", Escalate: []settings.Step{{Group: "frozen"}}},
+		},
+	}
+	f := &fakeHierarchy{groups: make(map[int]string)}
+	ps := NewProcessScanner(config, f, nil)
+	pe := policy.NewPolicyEngine(config, f)
+	ps.Scan()
+	if f.groups[os.Getpid()] != "g1" {
+		t.Fatal("Process should have been moved to the group of the rule", f.groups)
+	}
+	pe.Check()
+	ps.Scan()
+	pe.Check()
+	if f.groups[os.Getpid()] != "frozen" || f.moves != 2 {
+		t.Error("Escalated process should not be moved back by scans", f.groups, f.moves)
+	}
 }
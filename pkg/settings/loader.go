@@ -2,7 +2,7 @@ package settings
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"os"
 
 	"github.com/heetch/confita"
@@ -11,6 +11,16 @@ import (
 
 // Load configuration into settings variable
 func Load(path string) (settings *Settings, err error) {
+	settings, err = read(path)
+	if err == nil {
+		err = assertConfigOk(settings)
+	}
+	return
+}
+
+// read loads configuration, with defaults for what is not there, but without
+// checking it
+func read(path string) (settings *Settings, err error) {
 	settings = &Settings{
 		Name: "fetter",
 		Mode: RunModeAudit,
@@ -18,40 +28,62 @@ func Load(path string) (settings *Settings, err error) {
 			File:  "/tmp/fetter.log",
 			Level: "info",
 		},
-		Audit: Audit{Mode: "override"},
+		Audit:   Audit{Mode: "override"},
+		Control: Control{Socket: "/run/fetter.sock"},
 	}
 	if _, err = os.Stat(path); err != nil {
 		return nil, err
 	}
 	loader := confita.NewLoader(file.NewBackend(path))
 	err = loader.Load(context.Background(), settings)
-	if err == nil {
-		err = assertConfigOk(settings)
+	return
+}
+
+// Reload loads configuration from path, like Load does, but keeping from
+// current those settings that cannot be changed while running: name, mode,
+// logging, audit mode, control socket and metrics endpoint.  The names of the
+// settings that differ in the file are returned, so that they can be reported.
+// Dry run, that does not come from the file, is kept too.
+func Reload(path string, current *Settings) (settings *Settings, ignored []string, err error) {
+	settings, err = Load(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	settings.DryRun = current.DryRun
+	if settings.Name != current.Name {
+		ignored = append(ignored, "name")
+		settings.Name = current.Name
+	}
+	if settings.Mode != current.Mode {
+		ignored = append(ignored, "mode")
+		settings.Mode = current.Mode
+	}
+	if settings.Logging != current.Logging {
+		ignored = append(ignored, "logging")
+		settings.Logging = current.Logging
+	}
+	if settings.Audit != current.Audit {
+		ignored = append(ignored, "audit")
+		settings.Audit = current.Audit
+	}
+	if settings.Control != current.Control {
+		ignored = append(ignored, "control")
+		settings.Control = current.Control
+	}
+	if settings.Metrics != current.Metrics {
+		ignored = append(ignored, "metrics")
+		settings.Metrics = current.Metrics
 	}
 	return
 }
 
+// assertConfigOk returns the first error found in settings, if any.  See
+// Validate for a full report.
 func assertConfigOk(settings *Settings) error {
-	for name, rule := range settings.Rules {
-		if rule.Trigger != "" {
-			if rule.Trigger == "KILL" {
-				continue
-			}
-			if _, ok := settings.Triggers[rule.Trigger]; !ok {
-				return fmt.Errorf("missing trigger '%s' defined for rule '%s'", rule.Trigger, name)
-			}
+	for _, p := range check(settings) {
+		if !p.Warning {
+			return errors.New(p.Message)
 		}
-		if rule.Group != "" {
-			if _, ok := settings.Groups[rule.Group]; !ok {
-				return fmt.Errorf("missing group '%s' defined for rule '%s'", rule.Trigger, name)
-			}
-		}
-	}
-	switch settings.Mode {
-	case
-		RunModeAudit, RunModeScanner:
-		return nil
-	default:
-		return fmt.Errorf("run mode not supported: %s", settings.Mode)
 	}
+	return nil
 }
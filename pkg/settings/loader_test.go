@@ -1,10 +1,15 @@
 package settings
 
 import (
+	"fmt"
 	"path"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/juan-leon/fetter/pkg/cpuset"
 )
 
 func load(file string) (settings *Settings, err error) {
@@ -24,19 +29,24 @@ func TestConfigFile(t *testing.T) {
 		t.Error("could not load settings file", err)
 		return
 	}
+	enforce := false
 	expected := &Settings{
 		Logging: Logging{File: "foo.log", Level: "debug"},
 		Name:    "testing-fetter",
 		Mode:    "scanner",
 		Audit:   Audit{Mode: "reuse"},
+		Control: Control{Socket: "/tmp/fetter-testing.sock"},
+		Metrics: Metrics{Address: "127.0.0.1:9867"},
 		Rules: map[string]Rule{
-			"r1": {Paths: []string{"/usr/bin/make"}, Action: "execute", Group: "g1"},
-			"r2": {Paths: []string{"/usr/bin/make2"}, Action: "read", Group: "g2", Trigger: "t2"},
+			"r1": {Paths: []string{"/usr/bin/make"}, Action: "execute", Group: "g1", Scope: "tree"},
+			"r2": {Paths: []string{"/usr/bin/make2"}, Action: "read", Group: "g2", Trigger: "t2", Enforce: &enforce},
 			"r3": {Paths: []string{"/root/danger"}, Action: "execute", Trigger: "KILL"},
 		},
 		Groups: map[string]Group{
-			"g1": {RAM: 100, CPU: 10, Pids: 1, Freeze: false},
-			"g2": {RAM: 200, CPU: 20, Pids: 0, Freeze: true},
+			"g1": {RAM: 100 * Megabyte, CPU: Cores(float64(10*numCPUs) / 100), Pids: 1, Freeze: false, Schedule: []Window{
+				{Days: 0x3e, From: 9 * 60, To: 18 * 60, Limits: Group{RAM: 50 * Megabyte, CPU: 1}},
+			}},
+			"g2": {RAM: 1536 * Megabyte, CPU: 2.5, Pids: 1000, Freeze: true},
 		},
 		Triggers: map[string]Trigger{
 			"t1": {Run: "/bin/true", Args: []string{"foo", "bar"}, User: "nobody"},
@@ -52,6 +62,63 @@ func TestConfigFile(t *testing.T) {
 	if s.GetTrigger("r2") != "t2" {
 		t.Error("bad trigger for rule")
 	}
+	if s.GetScope("r1") != ScopeTree || s.GetScope("r2") != ScopeProcess {
+		t.Error("bad scope for rule")
+	}
+	if !s.Enforced("r1") || s.Enforced("r2") {
+		t.Error("bad enforcement for rule")
+	}
+	s.DryRun = true
+	if s.Enforced("r1") {
+		t.Error("no rule should be enforced in dry run")
+	}
+}
+
+func TestJSONConfigFile(t *testing.T) {
+	s, err := load("config-ok.json")
+	if err != nil {
+		t.Fatal("could not load settings file", err)
+	}
+	expected := map[string]Group{
+		"g1": {RAM: 100 * Megabyte, CPU: 2.5, Pids: 1000, IO: map[string]IOLimit{
+			"/dev/sda": {ReadBps: 50 * 1048576, WriteIOPS: 100},
+		}},
+		"g2": {RAM: 1536 * Megabyte, Freeze: true, Schedule: []Window{
+			{Days: 0x3e, From: 540, To: 1080, Limits: Group{RAM: 50 * Megabyte, CPU: 1}},
+		}},
+	}
+	if !reflect.DeepEqual(s.Groups, expected) {
+		t.Error("Unexpected groups", s.Groups)
+	}
+	if after := s.Rules["r1"].Escalate[0].After; after != Duration(10*time.Minute) {
+		t.Error("Unexpected escalation", after)
+	}
+}
+
+func TestReload(t *testing.T) {
+	current, err := load("config-ok.yaml")
+	if err != nil {
+		t.Fatal("could not load settings file", err)
+	}
+	current.Name = "fetter"
+	current.Mode = RunModeAudit
+	current.DryRun = true
+	s, ignored, err := Reload(path.Join("../../tests/configs", "config-ok.yaml"), current)
+	if err != nil {
+		t.Fatal("could not reload settings file", err)
+	}
+	if !reflect.DeepEqual(ignored, []string{"name", "mode"}) {
+		t.Error("bad ignored settings", ignored)
+	}
+	if s.Name != "fetter" || s.Mode != RunModeAudit || !s.DryRun {
+		t.Error("name and mode should have been kept", s.Name, s.Mode)
+	}
+	if !reflect.DeepEqual(s.Rules, current.Rules) {
+		t.Error("rules should have been loaded", s.Rules)
+	}
+	if _, _, err := Reload(path.Join("../../tests/configs", "config-bad-mode.yaml"), current); err == nil {
+		t.Error("reloading a bad config should fail")
+	}
 }
 
 func TestUnsupportedMode(t *testing.T) {
@@ -66,6 +133,18 @@ func TestUnsupportedMode(t *testing.T) {
 	}
 }
 
+func TestUnsupportedScope(t *testing.T) {
+	_, err := load("config-bad-scope.yaml")
+	if err == nil {
+		t.Error("Loading config should fail")
+		return
+	}
+	expected := "scope not supported for rule 'r1': forest"
+	if !strings.Contains(err.Error(), expected) {
+		t.Error("Should complain of invalid scope", err)
+	}
+}
+
 func TestRequiredSections(t *testing.T) {
 	_, err := load("config-no-rules.yaml")
 	if err == nil {
@@ -92,3 +171,187 @@ func TestRulesMissingTargets(t *testing.T) {
 		t.Error("Should complain of Missing trigger", err)
 	}
 }
+
+func TestBadPath(t *testing.T) {
+	_, err := load("config-bad-path.yaml")
+	if err == nil {
+		t.Error("Loading config should fail")
+		return
+	}
+	expected := "bad path for rule 'r1'"
+	if !strings.Contains(err.Error(), expected) {
+		t.Error("Should complain of invalid path", err)
+	}
+}
+
+func TestBadUnit(t *testing.T) {
+	_, err := load("config-bad-unit.yaml")
+	if err == nil {
+		t.Error("Loading config should fail")
+		return
+	}
+	expected := `invalid cpu "2.5 cpus"`
+	if !strings.Contains(err.Error(), expected) {
+		t.Error("Should complain of invalid cpu", err)
+	}
+}
+
+func TestBadUser(t *testing.T) {
+	_, err := load("config-bad-user.yaml")
+	if err == nil {
+		t.Error("Loading config should fail")
+		return
+	}
+	expected := "bad user for rule 'r1'"
+	if !strings.Contains(err.Error(), expected) {
+		t.Error("Should complain of invalid user", err)
+	}
+}
+
+func TestAssertGroup(t *testing.T) {
+	config := &Settings{
+		Groups: map[string]Group{"g1": {}, "g2": {Template: true}},
+		Rules:  map[string]Rule{"r1": {Group: "g2/{rule}-{user}"}},
+	}
+	for name, ok := range map[string]bool{
+		"g1":               true,
+		"g1/{user}":        false,
+		"g2":               false,
+		"g2/{user}":        true,
+		"g2/{uid}-{pid}":   true,
+		"g2/alice":         true,
+		"g2/{login}":       false,
+		"g2/{user}/{rule}": false,
+		"g3":               false,
+	} {
+		if err := config.AssertGroup(name); (err == nil) != ok {
+			t.Error("Bad result when asserting group", name, err)
+		}
+	}
+	if group := config.GetGroup("r1"); group != "g2/r1-{user}" {
+		t.Error("Rule placeholder should be expanded", group)
+	}
+}
+
+func TestCheckEscalation(t *testing.T) {
+	config := &Settings{
+		Groups: map[string]Group{
+			"slow": {RAM: 100 * Megabyte, Schedule: []Window{
+				{Days: 0x3e, Limits: Group{RAM: 50 * Megabyte}},
+				{Limits: Group{CPU: 1}},
+			}},
+			"tight":  {Template: true},
+			"frozen": {Freeze: true},
+		},
+		Rules: map[string]Rule{
+			"r1": {Group: "slow", Escalate: []Step{
+				{Group: "tight/{rule}", After: Duration(time.Minute), Memory: 90},
+				{Group: "frozen"},
+				{Group: Kill, After: Duration(time.Hour)},
+			}},
+			"r2": {Group: "slow", Escalate: []Step{{Group: "frozen"}}},
+			"r3": {Trigger: "t1", Escalate: []Step{{Group: "frozen"}}},
+			"r4": {Group: "frozen", Escalate: []Step{{Group: "slow"}, {Group: "frozen"}}},
+			"r5": {Group: "tight/{user}", Escalate: []Step{{Group: "slow/{user}", CPU: 50}, {Group: "cold"}}},
+		},
+	}
+	escalating := make(map[string]string)
+	var result []string
+	for _, name := range config.RuleNames() {
+		for _, p := range checkEscalation(config, name, escalating) {
+			result = append(result, p.String())
+		}
+	}
+	expected := []string{
+		"error: rules.r1.escalate.0.memory: memory threshold for escalation of rule 'r1' needs ram for group 'slow' in window 1 of its schedule",
+		"error: rules.r2.escalate.0: group 'slow' escalates in rules 'r1' and 'r2'",
+		"error: rules.r3.escalate: escalation of rule 'r3' needs a group",
+		"error: rules.r4.escalate.0: group 'frozen' escalates in rules 'r1' and 'r4'",
+		"error: rules.r4.escalate.1: group 'slow' escalates in rules 'r1' and 'r4'",
+		"error: rules.r4.escalate.1.group: escalation of rule 'r4' goes back to group 'frozen'",
+		"error: rules.r5.escalate.0: group 'tight' escalates in rules 'r1' and 'r5'",
+		"error: rules.r5.escalate.0.cpu: cpu threshold for escalation of rule 'r5' needs cpu for group 'tight'",
+		"error: rules.r5.escalate.0.group: bad group for escalation of rule 'r5': group slow is not a template",
+		"error: rules.r5.escalate.1: group 'slow' escalates in rules 'r1' and 'r5'",
+		"error: rules.r5.escalate.1.group: missing group 'cold' defined for escalation of rule 'r5'",
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Error("unexpected problems", strings.Join(result, "\n"))
+	}
+	if steps := config.GetEscalation("r1"); steps[0].Group != "tight/r1" || config.Rules["r1"].Escalate[0].Group != "tight/{rule}" {
+		t.Error("Rule placeholder should be expanded in a copy", steps)
+	}
+}
+
+func TestIgnoredRules(t *testing.T) {
+	config := &Settings{
+		Mode: RunModeProcConnector,
+		Rules: map[string]Rule{
+			"r1": {Action: ActionWrite},
+			"r2": {Action: ActionExecute},
+			"r3": {},
+			"r4": {Action: ActionRead},
+		},
+	}
+	if ignored := config.IgnoredRules(); !reflect.DeepEqual(ignored, []string{"r1", "r4"}) {
+		t.Error("read and write rules should be ignored in proc-connector mode", ignored)
+	}
+	config.Mode = RunModeAudit
+	if ignored := config.IgnoredRules(); len(ignored) != 0 {
+		t.Error("no rule should be ignored in audit mode", ignored)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	problems, err := Validate(path.Join("../../tests/configs", "config-problems.yaml"))
+	if err != nil {
+		t.Fatal("could not validate settings file", err)
+	}
+	expected := []string{
+		"4:3: error: logging.level: log level not supported: chatty",
+		"10:5: error: rules.r1.group: missing group 'g2' defined for rule 'r1'",
+		"14:5: error: rules.r2.action: action not supported for rule 'r2': exec",
+		"15:5: error: rules.r2.trigger: missing trigger 't2' defined for rule 'r2'",
+		"16:5: error: rules.r2.scope: scope not supported for rule 'r2': forest",
+		"18:3: error: rules.r3: neither group nor trigger for rule 'r3'",
+		"19:5: warning: rules.r3.paths: path of rule 'r3' does not exist: /no/such/file",
+		"20:5: warning: rules.r3.action: rule 'r3' is ignored in scanner mode, that sees executions only",
+		"21:5: error: rules.r3.grop: unknown key 'grop'",
+		"24:5: warning: rules.r4.paths: path of rule 'r4' is also in rule 'r1', that takes precedence: /bin/sh",
+		"35:9: error: rules.r5.escalate.0.cpu: cpu threshold for escalation of rule 'r5' needs cpu for group 'g1'",
+		"36:9: error: rules.r5.escalate.0.memory: memory threshold for escalation of rule 'r5' out of range: 150",
+		"37:9: error: rules.r5.escalate.1: escalation of rule 'r5' goes on after KILL",
+		"42:5: warning: groups.g1.ram_high: ram_high of group 'g1' is not below ram",
+		"43:5: error: groups.g1.io_weight: io weight for group 'g1' out of range: 20000",
+		"45:7: error: groups.g1.io./dev/null: bad device for group 'g1': /dev/null: not a block device",
+		"47:9: error: groups.g1.io./dev/null.rbps: unknown key 'rbps'",
+		"48:7: warning: groups.g1.io./dev/no-such-disk: device of group 'g1' does not exist: /dev/no-such-disk",
+		"50:3: warning: groups.g3: group 'g3' is not used by any rule",
+		"51:5: warning: groups.g3.cpu: cpu of group 'g3' is over the CORES cores of the system: 409600%",
+		"52:5: error: groups.g3.cpu_weight: cpu weight for group 'g3' out of range: 20000",
+		"53:5: error: groups.g3.cpus: bad cpus for group 'g3': 4096 is not online (online: ONLINE)",
+		"54:5: error: groups.g3.swap: swap for group 'g3' needs ram",
+		"55:5: error: groups.g3.oom_kill: unknown key 'oom_kill'",
+		"56:5: error: groups.g3.oom_trigger: missing trigger 't3' defined for group 'g3'",
+		"57:5: error: groups.g3.pressure_threshold: pressure threshold for group 'g3' out of range: 200",
+		"60:9: error: groups.g3.schedule.0.from: bad schedule for group 'g3': window starts at 24:00",
+		"62:11: error: groups.g3.schedule.0.limits.cpu_weight: cpu weight for group 'g3' out of range: 20000",
+		"63:11: error: groups.g3.schedule.0.limits.oom_trigger: bad schedule for group 'g3': oom_trigger is not a limit",
+		"66:3: warning: triggers.t1: trigger 't1' is not used by any rule or group",
+	}
+	online, _ := cpuset.OnlineCPUs()
+	for i := range expected {
+		expected[i] = strings.Replace(expected[i], "ONLINE", online, 1)
+		expected[i] = strings.Replace(expected[i], "CORES", strconv.Itoa(numCPUs), 1)
+	}
+	var result []string
+	for _, p := range problems {
+		result = append(result, fmt.Sprintf("%d:%d: %s", p.Line, p.Column, p))
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Error("unexpected problems", strings.Join(result, "\n"))
+	}
+	if _, err := Validate(path.Join("../../tests/configs", "not-a-file.yaml")); err == nil {
+		t.Error("should fail if no file")
+	}
+}
@@ -0,0 +1,189 @@
+package settings
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window is a time window in which a group takes other limits, like office
+// hours.  Times are local.
+type Window struct {
+	// Days of the week the window starts on (every day, if none)
+	Days Weekdays `config:"days" json:"days,omitempty"`
+	// Time of day the window starts and ends.  Windows ending before they
+	// start end the day after (like 22:00 to 06:00), and windows ending when
+	// they start (like the default 00:00 to 00:00) last the whole day.
+	From TimeOfDay `config:"from" json:"from"`
+	To   TimeOfDay `config:"to" json:"to"`
+	// Limits of the group within the window, replacing all of its limits
+	Limits Group `config:"limits" json:"limits"`
+}
+
+// Weekdays is a set of days of the week, a bit per time.Weekday.  In
+// configuration files it is a list of days and ranges of days, like mon-fri or
+// sat,sun.
+type Weekdays uint8
+
+// TimeOfDay is a number of minutes since midnight.  In configuration files it
+// is written like 09:00 or 18:30 (up to 24:00).
+type TimeOfDay int
+
+// Minutes in a day, the highest TimeOfDay
+const day TimeOfDay = 24 * 60
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseDay parses the name of a day of the week, like mon or monday
+func parseDay(s string) (time.Weekday, bool) {
+	for i, name := range dayNames {
+		if s == name || s == strings.ToLower(time.Weekday(i).String()) {
+			return time.Weekday(i), true
+		}
+	}
+	return 0, false
+}
+
+// ParseWeekdays parses days of the week, like mon-fri or sat,sun.  Ranges can
+// wrap around the week, like fri-mon.
+func ParseWeekdays(s string) (Weekdays, error) {
+	var days Weekdays
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, ok := parseDay(strings.TrimSpace(bounds[0]))
+		last := first
+		if ok && len(bounds) == 2 {
+			last, ok = parseDay(strings.TrimSpace(bounds[1]))
+		}
+		if !ok {
+			return 0, fmt.Errorf("invalid days %q: want days of the week and ranges of them, like mon-fri or sat,sun", s)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days |= 1 << d
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+var timeOfDayRegexp = regexp.MustCompile(`^([0-9]{1,2}):([0-9]{2})$`)
+
+// ParseTimeOfDay parses a time of day, like 09:00 or 18:30
+func ParseTimeOfDay(s string) (TimeOfDay, error) {
+	match := timeOfDayRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if match != nil {
+		hours, _ := strconv.Atoi(match[1])
+		minutes, _ := strconv.Atoi(match[2])
+		if t := TimeOfDay(hours*60 + minutes); minutes < 60 && t <= day {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time of day %q: want hours and minutes, like 09:00 or 18:30", s)
+}
+
+// UnmarshalYAML parses days of the week in configuration files
+func (d *Weekdays) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	text, err := unmarshalText(unmarshal)
+	if err == nil {
+		*d, err = ParseWeekdays(text)
+	}
+	return err
+}
+
+// UnmarshalYAML parses times of day in configuration files
+func (t *TimeOfDay) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	text, err := unmarshalText(unmarshal)
+	if err == nil {
+		*t, err = ParseTimeOfDay(text)
+	}
+	return err
+}
+
+// UnmarshalJSON parses days of the week in JSON configuration files
+func (d *Weekdays) UnmarshalJSON(data []byte) error {
+	text, ok, err := unmarshalJSONText(data)
+	if ok {
+		*d, err = ParseWeekdays(text)
+	}
+	return err
+}
+
+// UnmarshalJSON parses times of day in JSON configuration files
+func (t *TimeOfDay) UnmarshalJSON(data []byte) error {
+	text, ok, err := unmarshalJSONText(data)
+	if ok {
+		*t, err = ParseTimeOfDay(text)
+	}
+	return err
+}
+
+// Has tells whether a day is in the set.  An empty set has every day.
+func (d Weekdays) Has(day time.Weekday) bool {
+	return d == 0 || d&(1<<day) != 0
+}
+
+// String formats days of the week, like mon,tue,wed
+func (d Weekdays) String() string {
+	var names []string
+	for i, name := range dayNames {
+		if d&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// MarshalText formats days of the week for the status of groups
+func (d Weekdays) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// String formats a time of day, like 09:00
+func (t TimeOfDay) String() string {
+	return fmt.Sprintf("%02d:%02d", t/60, t%60)
+}
+
+// MarshalText formats a time of day for the status of groups
+func (t TimeOfDay) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// String describes a window, like mon,tue 09:00-18:00
+func (w Window) String() string {
+	if w.Days == 0 {
+		return fmt.Sprintf("%s-%s", w.From, w.To)
+	}
+	return fmt.Sprintf("%s %s-%s", w.Days, w.From, w.To)
+}
+
+// Contains tells whether t is within the window
+func (w Window) Contains(t time.Time) bool {
+	now := TimeOfDay(t.Hour()*60 + t.Minute())
+	today, yesterday := t.Weekday(), (t.Weekday()+6)%7
+	if w.From < w.To {
+		return w.Days.Has(today) && now >= w.From && now < w.To
+	}
+	// Started today, or still going on since yesterday
+	return (w.Days.Has(today) && now >= w.From) || (w.Days.Has(yesterday) && now < w.To)
+}
+
+// At returns the group as it is at t: with the limits of the first window of
+// its schedule containing t, if any.  The index of that window is returned
+// too, or -1.
+func (g Group) At(t time.Time) (Group, int) {
+	for i, w := range g.Schedule {
+		if w.Contains(t) {
+			limits := w.Limits
+			// What is not a limit stays
+			limits.Template, limits.Schedule = g.Template, g.Schedule
+			limits.OOMTrigger, limits.PressureTrigger = g.OOMTrigger, g.PressureTrigger
+			limits.PressureThreshold = g.PressureThreshold
+			return limits, i
+		}
+	}
+	return g, -1
+}
@@ -0,0 +1,99 @@
+package settings
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	for text, expected := range map[string]string{
+		"mon-fri":       "mon,tue,wed,thu,fri",
+		"sat, sun":      "sun,sat",
+		"Fri-Mon":       "sun,mon,fri,sat",
+		"monday-monday": "mon",
+		"sun-sat":       "sun,mon,tue,wed,thu,fri,sat",
+	} {
+		if days, err := ParseWeekdays(text); err != nil || days.String() != expected {
+			t.Error("Bad days for", text, days, err)
+		}
+	}
+	for _, text := range []string{"", "mon-", "weekend", "mon-fri-sun", "mon;tue"} {
+		if days, err := ParseWeekdays(text); err == nil {
+			t.Error("Should not parse", text, days)
+		}
+	}
+	for text, expected := range map[string]TimeOfDay{"09:00": 540, "9:30": 570, "00:00": 0, "24:00": 1440} {
+		if tod, err := ParseTimeOfDay(text); err != nil || tod != expected {
+			t.Error("Bad time of day for", text, tod, err)
+		}
+	}
+	for _, text := range []string{"9", "9:5", "24:01", "12:60", "noon"} {
+		if tod, err := ParseTimeOfDay(text); err == nil {
+			t.Error("Should not parse", text, tod)
+		}
+	}
+	var w Window
+	if err := json.Unmarshal([]byte(`{"days": "sat,sun", "from": "22:00", "to": "06:00"}`), &w); err != nil || w.String() != "sun,sat 22:00-06:00" {
+		t.Error("Bad window", w, err)
+	}
+	if err := json.Unmarshal([]byte(`{"from": 540}`), &w); err == nil {
+		t.Error("Times of day should be like 09:00", w)
+	}
+	text, _ := json.Marshal(Window{Days: 0x3e, From: 540, To: 1080})
+	if err := json.Unmarshal(text, &w); err != nil || w.String() != "mon,tue,wed,thu,fri 09:00-18:00" {
+		t.Error("Window should be unmarshalled as marshalled", string(text), w, err)
+	}
+	if text := (Window{Days: 0x3e, From: 540, To: 1080}).String(); text != "mon,tue,wed,thu,fri 09:00-18:00" {
+		t.Error("Bad text for window", text)
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	weekdays, _ := ParseWeekdays("mon-fri")
+	office := Window{Days: weekdays, From: 9 * 60, To: 18 * 60}
+	night := Window{Days: weekdays, From: 22 * 60, To: 6 * 60}
+	allDay := Window{Days: weekdays}
+	// 2024-01-05 is a Friday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+	}
+	for _, c := range []struct {
+		window Window
+		t      time.Time
+		ok     bool
+	}{
+		{office, at(5, 9, 0), true},
+		{office, at(5, 17, 59), true},
+		{office, at(5, 18, 0), false},
+		{office, at(5, 8, 59), false},
+		{office, at(6, 12, 0), false},
+		{night, at(5, 23, 0), true},
+		{night, at(6, 5, 59), true},
+		{night, at(6, 6, 0), false},
+		{night, at(6, 23, 0), false},
+		{night, at(8, 1, 0), false},
+		{allDay, at(5, 0, 0), true},
+		{allDay, at(5, 23, 59), true},
+		{allDay, at(7, 12, 0), false},
+		{Window{}, at(7, 12, 0), true},
+	} {
+		if c.window.Contains(c.t) != c.ok {
+			t.Error("Bad result for", c.window, c.t)
+		}
+	}
+	g := Group{RAM: 100 * Megabyte, OOMTrigger: "t1", Schedule: []Window{
+		{Days: weekdays, From: 9 * 60, To: 18 * 60, Limits: Group{CPU: 1}},
+		{Limits: Group{RAM: 10 * Megabyte}},
+	}}
+	if limits, window := g.At(at(5, 12, 0)); window != 0 || limits.CPU != 1 || limits.RAM != 0 || limits.OOMTrigger != "t1" || len(limits.Schedule) != 2 {
+		t.Error("First window should win", window, limits)
+	}
+	if limits, window := g.At(at(6, 12, 0)); window != 1 || limits.RAM != 10*Megabyte {
+		t.Error("Second window should apply", window, limits)
+	}
+	g.Schedule = g.Schedule[:1]
+	if limits, window := g.At(at(6, 12, 0)); window != -1 || limits.RAM != 100*Megabyte {
+		t.Error("No window should apply", window, limits)
+	}
+}
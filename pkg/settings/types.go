@@ -1,10 +1,66 @@
 package settings
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
 const (
 	// RunModeAudit is the string used to configure audit mode
 	RunModeAudit string = "audit"
 	// RunModeScanner is the string used to configure scanner mode
 	RunModeScanner string = "scanner"
+	// RunModeProcConnector is the string used to configure process connector
+	// mode
+	RunModeProcConnector string = "proc-connector"
+)
+
+const (
+	// AuditModeOverride is the string used to configure audit mode that
+	// replaces fetter audit rules on start, and deletes them on exit
+	AuditModeOverride string = "override"
+	// AuditModePreserve is the string used to configure audit mode that keeps
+	// audit rules not added by fetter
+	AuditModePreserve string = "preserve"
+	// AuditModeReuse is the string used to configure audit mode that relies
+	// on audit rules already there
+	AuditModeReuse string = "reuse"
+)
+
+const (
+	// ActionExecute is the string used to configure rules about executing
+	// files
+	ActionExecute string = "execute"
+	// ActionRead is the string used to configure rules about reading files
+	ActionRead string = "read"
+	// ActionWrite is the string used to configure rules about writing files
+	ActionWrite string = "write"
+)
+
+const (
+	// ScopeProcess is the string used to configure rules that move only the
+	// matching process
+	ScopeProcess string = "process"
+	// ScopeTree is the string used to configure rules that move the matching
+	// process together with its descendants
+	ScopeTree string = "tree"
+)
+
+// Kill is the name of the pseudo trigger (or group) for killing processes
+// outright
+const Kill string = "KILL"
+
+// Placeholders for the keys of template groups, like in browsers/{user}
+const (
+	// KeyUID stands for the uid of the process being moved
+	KeyUID string = "{uid}"
+	// KeyUser stands for the login name of the user of the process being moved
+	KeyUser string = "{user}"
+	// KeyRule stands for the name of the rule that matched
+	KeyRule string = "{rule}"
+	// KeyPid stands for the pid of the process being moved
+	KeyPid string = "{pid}"
 )
 
 // Logging holds the configuration options referred to logging
@@ -15,10 +71,38 @@ type Logging struct {
 
 // Rule holds the configuration options referred to a single rule
 type Rule struct {
-	Paths   []string `config:"paths,required"`
-	Action  string   `config:"action,required"`
-	Group   string   `config:"group"`
-	Trigger string   `config:"trigger"`
+	Paths   []string `config:"paths,required" json:"paths"`
+	Action  string   `config:"action,required" json:"action"`
+	Group   string   `config:"group" json:"group,omitempty"`
+	Trigger string   `config:"trigger" json:"trigger,omitempty"`
+	Scope   string   `config:"scope" json:"scope,omitempty"`
+	Cmdline []string `config:"cmdline" json:"cmdline,omitempty"`
+	// Credential filters: users and groups (by name or id) processes must
+	// run as, users they must not run as, and users they must have logged in
+	// as (audit login uid)
+	Users        []string `config:"users" json:"users,omitempty"`
+	Groups       []string `config:"groups" json:"groups,omitempty"`
+	ExcludeUsers []string `config:"exclude_users" yaml:"exclude_users" json:"exclude_users,omitempty"`
+	Auid         []string `config:"auid" json:"auid,omitempty"`
+	// Enforce is true unless configured otherwise: rules not enforced only
+	// log what they would do
+	Enforce *bool `config:"enforce" json:"enforce,omitempty"`
+	// Escalation steps, in order: processes moved by the rule are moved
+	// further down, step by step, while they keep misbehaving
+	Escalate []Step `config:"escalate" json:"escalate,omitempty"`
+}
+
+// Step is a step in the escalation of a rule.  Processes in the group of the
+// previous step (the group of the rule, for the first one) are moved to Group
+// (or killed, for KILL) once they have been there for After, with the usage of
+// the group over any of its thresholds (if any) all along.  Steps apply to
+// every process in the group, whichever rule moved it there.
+type Step struct {
+	Group string   `config:"group" json:"group"`
+	After Duration `config:"after" json:"after,omitempty"`
+	// Usage thresholds, as %-ages of the ram and cpu of the group
+	Memory float64 `config:"memory" json:"memory,omitempty"`
+	CPU    float64 `config:"cpu" json:"cpu,omitempty"`
 }
 
 // Audit holds the configuration options referred to a audit mode
@@ -28,10 +112,81 @@ type Audit struct {
 
 // Group holds the configuration options referred to a single process group
 type Group struct {
-	RAM    int64 `config:"ram"`
-	CPU    int   `config:"cpu"`
-	Pids   int64 `config:"pids"`
-	Freeze bool  `group:"freeze"`
+	RAM    Size  `config:"ram" json:"ram,omitempty"`
+	CPU    Cores `config:"cpu" json:"cpu,omitempty"`
+	Pids   Count `config:"pids" json:"pids,omitempty"`
+	Freeze bool  `config:"freeze" json:"freeze,omitempty"`
+	// Memory the group is pushed back to when the system runs short of it
+	RAMSoft Size `config:"ram_soft" yaml:"ram_soft" json:"ram_soft,omitempty"`
+	// Memory over which the group is throttled and made to reclaim, short of
+	// the OOM killer (unified hierarchy only)
+	RAMHigh Size `config:"ram_high" yaml:"ram_high" json:"ram_high,omitempty"`
+	// Swap the group can use, on top of ram
+	Swap Size `config:"swap" json:"swap,omitempty"`
+	// Processes over ram wait for memory instead of being killed (V1
+	// hierarchies only)
+	OOMKillDisable bool `config:"oom_kill_disable" yaml:"oom_kill_disable" json:"oom_kill_disable,omitempty"`
+	// The OOM killer kills every process of the group, not just one (unified
+	// hierarchy only)
+	OOMGroup bool `config:"oom_group" yaml:"oom_group" json:"oom_group,omitempty"`
+	// Triggers run when the OOM killer acts in the group, and when its memory
+	// pressure (the %-age of time its processes wait for memory, over the last
+	// 10 seconds) goes over pressure_threshold
+	OOMTrigger        string  `config:"oom_trigger" yaml:"oom_trigger" json:"oom_trigger,omitempty"`
+	PressureTrigger   string  `config:"pressure_trigger" yaml:"pressure_trigger" json:"pressure_trigger,omitempty"`
+	PressureThreshold float64 `config:"pressure_threshold" yaml:"pressure_threshold" json:"pressure_threshold,omitempty"`
+	// Relative weight when competing for CPU, from 1 to 10000 (default is
+	// 100).  Unlike cpu, it limits only when CPUs are busy.
+	CPUWeight uint64 `config:"cpu_weight" yaml:"cpu_weight" json:"cpu_weight,omitempty"`
+	// CPUs and memory nodes the processes can run on, like "0-3,6"
+	CPUs string `config:"cpus" json:"cpus,omitempty"`
+	Mems string `config:"mems" json:"mems,omitempty"`
+	// A template group is instantiated on demand, once per key (like per
+	// user), and its limits apply to every instance on its own
+	Template bool `config:"template" json:"template,omitempty"`
+	// Relative weight when competing for disk I/O, from 1 to 10000 (default
+	// is 100)
+	IOWeight uint16 `config:"io_weight" yaml:"io_weight" json:"io_weight,omitempty"`
+	// Disk I/O limits, indexed by device (like /dev/nvme0n1)
+	IO map[string]IOLimit `config:"io" json:"io,omitempty"`
+	// Time windows with other limits, like office hours.  The first window
+	// containing current time wins.
+	Schedule []Window `config:"schedule" json:"schedule,omitempty"`
+}
+
+// IOLimit holds the disk I/O limits of a group for a device.  Zero stands for
+// no limit.
+type IOLimit struct {
+	ReadBps   Bandwidth `yaml:"read_bps" json:"read_bps,omitempty"`
+	WriteBps  Bandwidth `yaml:"write_bps" json:"write_bps,omitempty"`
+	ReadIOPS  Count     `yaml:"read_iops" json:"read_iops,omitempty"` // operations per second
+	WriteIOPS Count     `yaml:"write_iops" json:"write_iops,omitempty"`
+}
+
+// MaxWeight is the highest weight (for CPU or disk I/O) a group can have
+const MaxWeight = 10000
+
+// DefaultPressureThreshold is the memory pressure over which the pressure
+// trigger of a group is run, unless configured otherwise
+const DefaultPressureThreshold = 10
+
+// GetPressureThreshold returns the memory pressure over which the pressure
+// trigger of a group is run
+func (g *Group) GetPressureThreshold() float64 {
+	if g.PressureThreshold > 0 {
+		return g.PressureThreshold
+	}
+	return DefaultPressureThreshold
+}
+
+// Control holds the configuration options referred to the control socket
+type Control struct {
+	Socket string `config:"socket"`
+}
+
+// Metrics holds the configuration options referred to the metrics endpoint
+type Metrics struct {
+	Address string `config:"address"`
 }
 
 // Trigger holds the configuration options referred to a single trigger
@@ -48,13 +203,112 @@ type Settings struct {
 	Groups   map[string]Group   `config:"groups"`
 	Triggers map[string]Trigger `config:"triggers"`
 	Audit    Audit              `config:"audit"`
+	Control  Control            `config:"control"`
+	Metrics  Metrics            `config:"metrics"`
 	Name     string             `config:"name,required"`
 	Mode     string             `config:"mode,required"`
+	// DryRun is set from command line, not from configuration file: no rule
+	// is enforced
+	DryRun bool `yaml:"-" json:"-"`
+}
+
+// RuleNames returns the names of the rules, sorted.  When several rules could
+// match a process, the first one in this order wins.
+func (s *Settings) RuleNames() []string {
+	names := make([]string, 0, len(s.Rules))
+	for name := range s.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-// GetGroup returns the name of a group configured for a rule
+// GetGroup returns the name of a group configured for a rule.  For template
+// groups the name includes the key, with the rule placeholder already
+// expanded.
 func (s *Settings) GetGroup(rule string) string {
-	return s.Rules[rule].Group
+	return strings.ReplaceAll(s.Rules[rule].Group, KeyRule, rule)
+}
+
+// SplitGroup splits the name of a group into the name of the group configured
+// and the key of the instance, if any (for names like browsers/{user} or
+// browsers/alice).
+func SplitGroup(name string) (group, key string) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 1 {
+		return name, ""
+	}
+	return parts[0], parts[1]
+}
+
+// AssertGroup checks that name refers to a configured group: template groups
+// need a key (placeholders or a literal one), and other groups cannot have it.
+func (s *Settings) AssertGroup(name string) error {
+	group, key := SplitGroup(name)
+	g, ok := s.Groups[group]
+	if !ok {
+		return fmt.Errorf("unknown group: %s", group)
+	}
+	if !g.Template {
+		if key != "" {
+			return fmt.Errorf("group %s is not a template", group)
+		}
+		return nil
+	}
+	if key == "" {
+		return fmt.Errorf("template group %s needs a key, like %s/%s", group, group, KeyUser)
+	}
+	bare := key
+	for _, placeholder := range []string{KeyUID, KeyUser, KeyRule, KeyPid} {
+		bare = strings.ReplaceAll(bare, placeholder, "")
+	}
+	if strings.ContainsAny(bare, "{}/") {
+		return fmt.Errorf("bad key for template group %s: %s", group, key)
+	}
+	return nil
+}
+
+// GetScope returns the scope configured for a rule
+func (s *Settings) GetScope(rule string) string {
+	if scope := s.Rules[rule].Scope; scope != "" {
+		return scope
+	}
+	return ScopeProcess
+}
+
+// Enforced tells whether matches of a rule should be acted on, rather than
+// just logged
+func (s *Settings) Enforced(rule string) bool {
+	if s.DryRun {
+		return false
+	}
+	enforce := s.Rules[rule].Enforce
+	return enforce == nil || *enforce
+}
+
+// GetEscalation returns the escalation steps of a rule, with the rule
+// placeholder expanded in their groups, like GetGroup does
+func (s *Settings) GetEscalation(rule string) []Step {
+	steps := append([]Step{}, s.Rules[rule].Escalate...)
+	for i := range steps {
+		steps[i].Group = strings.ReplaceAll(steps[i].Group, KeyRule, rule)
+	}
+	return steps
+}
+
+// IgnoredRules returns the rules the run mode cannot act on, sorted: outside
+// audit mode, only executions are seen, so rules for reads and writes never
+// match
+func (s *Settings) IgnoredRules() (ignored []string) {
+	if s.Mode == RunModeAudit {
+		return
+	}
+	for _, name := range s.RuleNames() {
+		if action := s.Rules[name].Action; action == ActionRead || action == ActionWrite {
+			ignored = append(ignored, name)
+		}
+	}
+	return
 }
 
 // GetTrigger returns the name of a trigger configured for a rule
@@ -0,0 +1,314 @@
+package settings
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Size is an amount of memory, in bytes.  In configuration files sizes take a
+// unit (like 512M or 1.5G, in powers of 1024); bare numbers are megabytes.
+type Size int64
+
+// Units of Size
+const (
+	Byte     Size = 1
+	Kilobyte      = 1024 * Byte
+	Megabyte      = 1024 * Kilobyte
+	Gigabyte      = 1024 * Megabyte
+	Terabyte      = 1024 * Gigabyte
+)
+
+// Bandwidth is an amount of bytes per second.  In configuration files it takes
+// the units of Size (optionally followed by /s, like 50M/s), but bare numbers
+// are bytes.
+type Bandwidth int64
+
+// Count is an amount of things (like processes).  In configuration files it
+// can take a k (thousands) or m (millions) suffix, like 1k.
+type Count int64
+
+// Cores is an amount of CPU power, in CPU cores.  In configuration files it
+// takes cores (like 2.5 cores) or a percentage of a core (like 250%); bare
+// numbers are percentages of all the cores of the system, so 25 is a core out
+// of 4.
+type Cores float64
+
+// Duration is a span of time.  In configuration files it takes units, like 90s,
+// 10m or 1h30m.
+type Duration time.Duration
+
+// Number of CPU cores of the system, for bare numbers of Cores
+var numCPUs = runtime.NumCPU()
+
+// sizeUnits is in descending order, for formatting
+var sizeUnits = []struct {
+	suffix string
+	size   Size
+}{
+	{"T", Terabyte},
+	{"G", Gigabyte},
+	{"M", Megabyte},
+	{"K", Kilobyte},
+	{"B", Byte},
+}
+
+// multipliers returns the units of sizes, indexed by their suffixes (K, KB and
+// KiB are the same), and bare, for numbers without unit
+func multipliers(bare Size) map[string]float64 {
+	units := map[string]float64{"": float64(bare)}
+	for _, u := range sizeUnits {
+		units[u.suffix] = float64(u.size)
+		if u.size > Byte {
+			units[u.suffix+"B"] = float64(u.size)
+			units[u.suffix+"IB"] = float64(u.size)
+		}
+	}
+	return units
+}
+
+var (
+	sizeMultipliers      = multipliers(Megabyte)
+	bandwidthMultipliers = multipliers(Byte)
+	countMultipliers     = map[string]float64{"": 1, "K": 1e3, "M": 1e6}
+)
+
+var quantityRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*(.*)$`)
+
+// parseQuantity parses a (non negative) number followed by a unit, among
+// units (indexed by their upper case suffixes; "" stands for no unit), and
+// returns the number times the unit
+func parseQuantity(s string, units map[string]float64) (float64, bool) {
+	match := quantityRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0, false
+	}
+	unit, ok := units[strings.ToUpper(match[2])]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return n * unit, true
+}
+
+// ParseSize parses a size, like 512M or 1.5G.  Suffixes like MB or MiB are
+// taken as M, and numbers without unit are megabytes.
+func ParseSize(s string) (Size, error) {
+	n, ok := parseQuantity(s, sizeMultipliers)
+	if !ok || n >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q: want a number of megabytes, or a number with a unit, like 512M or 1.5G", s)
+	}
+	return Size(math.Round(n)), nil
+}
+
+// ParseBandwidth parses a bandwidth, like 50M or 50M/s.  Numbers without unit
+// are bytes per second.
+func ParseBandwidth(s string) (Bandwidth, error) {
+	n, ok := parseQuantity(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s"), bandwidthMultipliers)
+	if !ok || n >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid bandwidth %q: want a number of bytes per second, or a number with a unit, like 50M", s)
+	}
+	return Bandwidth(math.Round(n)), nil
+}
+
+// ParseCount parses a count, like 100, 1k or 1.5m
+func ParseCount(s string) (Count, error) {
+	n, ok := parseQuantity(s, countMultipliers)
+	if !ok || n >= math.MaxInt64 || n != math.Trunc(n) {
+		return 0, fmt.Errorf("invalid count %q: want a whole number, like 500 or 1k", s)
+	}
+	return Count(n), nil
+}
+
+// ParseCores parses an amount of CPU power: cores (like 2.5 cores), a
+// percentage of a core (like 250%) or a percentage of all the cores of the
+// system (bare numbers)
+func ParseCores(s string) (Cores, error) {
+	n, ok := parseQuantity(s, map[string]float64{
+		"":      float64(numCPUs),
+		"%":     1,
+		"CORE":  100,
+		"CORES": 100,
+	})
+	if !ok {
+		return 0, fmt.Errorf("invalid cpu %q: want cores (like 2.5 cores), a percentage of a core (like 250%%), or a percentage of all cores (like 25)", s)
+	}
+	return Cores(n / 100), nil
+}
+
+// ParseDuration parses a span of time, like 90s, 10m or 1h30m
+func ParseDuration(s string) (Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q: want a number with a unit, like 90s, 10m or 1h30m", s)
+	}
+	return Duration(d), nil
+}
+
+// unmarshalText unmarshals a YAML scalar into text, for parsing
+func unmarshalText(unmarshal func(interface{}) error) (string, error) {
+	var text string
+	err := unmarshal(&text)
+	return text, err
+}
+
+// unmarshalJSONText unmarshals a JSON string or number into text, for parsing
+// like in YAML files.  Null is left as an empty text, and ok is false then.
+func unmarshalJSONText(data []byte) (text string, ok bool, err error) {
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		return "", false, nil
+	case len(data) > 0 && data[0] == '"':
+		err = json.Unmarshal(data, &text)
+	default:
+		var n json.Number
+		err = json.Unmarshal(data, &n)
+		text = n.String()
+	}
+	return text, err == nil, err
+}
+
+// UnmarshalYAML parses sizes in configuration files
+func (s *Size) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	text, err := unmarshalText(unmarshal)
+	if err == nil {
+		*s, err = ParseSize(text)
+	}
+	return err
+}
+
+// UnmarshalYAML parses bandwidths in configuration files
+func (b *Bandwidth) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	text, err := unmarshalText(unmarshal)
+	if err == nil {
+		*b, err = ParseBandwidth(text)
+	}
+	return err
+}
+
+// UnmarshalYAML parses counts in configuration files
+func (c *Count) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	text, err := unmarshalText(unmarshal)
+	if err == nil {
+		*c, err = ParseCount(text)
+	}
+	return err
+}
+
+// UnmarshalYAML parses amounts of CPU power in configuration files
+func (c *Cores) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	text, err := unmarshalText(unmarshal)
+	if err == nil {
+		*c, err = ParseCores(text)
+	}
+	return err
+}
+
+// UnmarshalYAML parses spans of time in configuration files
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	text, err := unmarshalText(unmarshal)
+	if err == nil {
+		*d, err = ParseDuration(text)
+	}
+	return err
+}
+
+// UnmarshalJSON parses sizes in JSON configuration files
+func (s *Size) UnmarshalJSON(data []byte) error {
+	text, ok, err := unmarshalJSONText(data)
+	if ok {
+		*s, err = ParseSize(text)
+	}
+	return err
+}
+
+// UnmarshalJSON parses bandwidths in JSON configuration files
+func (b *Bandwidth) UnmarshalJSON(data []byte) error {
+	text, ok, err := unmarshalJSONText(data)
+	if ok {
+		*b, err = ParseBandwidth(text)
+	}
+	return err
+}
+
+// UnmarshalJSON parses counts in JSON configuration files
+func (c *Count) UnmarshalJSON(data []byte) error {
+	text, ok, err := unmarshalJSONText(data)
+	if ok {
+		*c, err = ParseCount(text)
+	}
+	return err
+}
+
+// UnmarshalJSON parses amounts of CPU power in JSON configuration files
+func (c *Cores) UnmarshalJSON(data []byte) error {
+	text, ok, err := unmarshalJSONText(data)
+	if ok {
+		*c, err = ParseCores(text)
+	}
+	return err
+}
+
+// UnmarshalJSON parses spans of time in JSON configuration files
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	text, ok, err := unmarshalJSONText(data)
+	if ok {
+		*d, err = ParseDuration(text)
+	}
+	return err
+}
+
+// String formats a size with the largest unit that keeps it exact, like 512M
+func (s Size) String() string {
+	for _, u := range sizeUnits {
+		if s != 0 && s%u.size == 0 {
+			return fmt.Sprintf("%d%s", s/u.size, u.suffix)
+		}
+	}
+	return "0"
+}
+
+// MarshalText formats sizes in JSON (like the status of groups) the way they
+// are parsed back
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// String formats a bandwidth like a size, per second
+func (b Bandwidth) String() string {
+	return Size(b).String() + "/s"
+}
+
+// MarshalText formats bandwidths the way they are parsed back
+func (b Bandwidth) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// String formats an amount of CPU power as a percentage of a core, like 250%
+func (c Cores) String() string {
+	return strconv.FormatFloat(float64(c)*100, 'f', -1, 64) + "%"
+}
+
+// MarshalText formats amounts of CPU power the way they are parsed back
+func (c Cores) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// String formats a span of time, like 10m0s
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// MarshalText formats spans of time the way they are parsed back
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
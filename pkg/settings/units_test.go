@@ -0,0 +1,106 @@
+package settings
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for text, expected := range map[string]Size{
+		"100":     100 * Megabyte,
+		"512M":    512 * Megabyte,
+		"1.5G":    1536 * Megabyte,
+		"2gb":     2 * Gigabyte,
+		"2GiB":    2 * Gigabyte,
+		"64 K":    64 * Kilobyte,
+		"1T":      Terabyte,
+		"4096B":   4 * Kilobyte,
+		"0":       0,
+		" 10M   ": 10 * Megabyte,
+	} {
+		if size, err := ParseSize(text); err != nil || size != expected {
+			t.Error("Bad size for", text, size, err)
+		}
+	}
+	for _, text := range []string{"", "M", "-1M", ".5G", "1e3", "2X", "10000000T", "G2"} {
+		if size, err := ParseSize(text); err == nil {
+			t.Error("Should not parse", text, size)
+		}
+	}
+	for size, expected := range map[Size]string{0: "0", 512 * Megabyte: "512M", 1536 * Megabyte: "1536M", 2 * Gigabyte: "2G", 1000: "1000B"} {
+		if text := size.String(); text != expected {
+			t.Error("Bad text for", int64(size), text)
+		}
+	}
+}
+
+func TestParseOtherUnits(t *testing.T) {
+	for text, expected := range map[string]Bandwidth{"1048576": 1048576, "50M": 50 * 1048576, "50M/s": 50 * 1048576, "1.5kb/S": 1536} {
+		if bandwidth, err := ParseBandwidth(text); err != nil || bandwidth != expected {
+			t.Error("Bad bandwidth for", text, bandwidth, err)
+		}
+	}
+	for text, expected := range map[string]Count{"100": 100, "1k": 1000, "1.5K": 1500, "2m": 2000000} {
+		if count, err := ParseCount(text); err != nil || count != expected {
+			t.Error("Bad count for", text, count, err)
+		}
+	}
+	for _, text := range []string{"1.5", "1kb", "-1"} {
+		if count, err := ParseCount(text); err == nil {
+			t.Error("Should not parse", text, count)
+		}
+	}
+	defer func(n int) { numCPUs = n }(numCPUs)
+	numCPUs = 4
+	for text, expected := range map[string]Cores{"25": 1, "250%": 2.5, "2.5 cores": 2.5, "1 core": 1, "50%": 0.5, "100": 4} {
+		if cores, err := ParseCores(text); err != nil || cores != expected {
+			t.Error("Bad cpu for", text, cores, err)
+		}
+	}
+	for _, text := range []string{"2.5 cpus", "%", "-50%"} {
+		if cores, err := ParseCores(text); err == nil {
+			t.Error("Should not parse", text, cores)
+		}
+	}
+	if text := Cores(2.5).String(); text != "250%" {
+		t.Error("Bad text for cores", text)
+	}
+	for text, expected := range map[string]Duration{"90s": Duration(90 * time.Second), "10m": Duration(10 * time.Minute), "1h30m": Duration(90 * time.Minute), "0": 0} {
+		if d, err := ParseDuration(text); err != nil || d != expected {
+			t.Error("Bad duration for", text, d, err)
+		}
+	}
+	for _, text := range []string{"10", "-1m", "10 minutes"} {
+		if d, err := ParseDuration(text); err == nil {
+			t.Error("Should not parse", text, d)
+		}
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	var g Group
+	if err := json.Unmarshal([]byte(`{"ram": "512M", "cpu": "250%", "pids": 100, "swap": null}`), &g); err != nil {
+		t.Fatal("Could not unmarshal group", err)
+	}
+	if g.RAM != 512*Megabyte || g.CPU != 2.5 || g.Pids != 100 || g.Swap != 0 {
+		t.Error("Bad group", g)
+	}
+	for _, text := range []string{`{"ram": "2X"}`, `{"ram": -1}`, `{"pids": 1.5}`, `{"cpu": true}`} {
+		if err := json.Unmarshal([]byte(text), &g); err == nil {
+			t.Error("Should not unmarshal", text)
+		}
+	}
+	text, _ := json.Marshal(Group{RAM: 100, CPU: 2.5, Pids: 1000, IO: map[string]IOLimit{"sda": {ReadBps: 50 * 1048576}}})
+	var back Group
+	if err := json.Unmarshal(text, &back); err != nil || back.RAM != 100 || back.CPU != 2.5 || back.Pids != 1000 || back.IO["sda"].ReadBps != 50*1048576 {
+		t.Error("Group should be unmarshalled as marshalled", string(text), back, err)
+	}
+	var step Step
+	if err := json.Unmarshal([]byte(`{"after": "1h30m"}`), &step); err != nil || step.After != Duration(90*time.Minute) {
+		t.Error("Bad step", step, err)
+	}
+	if err := json.Unmarshal([]byte(`{"after": 90}`), &step); err == nil {
+		t.Error("Durations should take units", step)
+	}
+}
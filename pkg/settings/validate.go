@@ -0,0 +1,538 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+
+	"github.com/juan-leon/fetter/pkg/cpuset"
+	"github.com/juan-leon/fetter/pkg/devices"
+	"github.com/juan-leon/fetter/pkg/ids"
+	"github.com/juan-leon/fetter/pkg/pattern"
+)
+
+// Problem is an issue found in a configuration
+type Problem struct {
+	Path    []string // keys leading to the offending setting, like rules, r1, group
+	Line    int      // location in the file, if known (starting at 1)
+	Column  int
+	Message string
+	Warning bool // fetter can run anyway
+}
+
+func (p Problem) String() string {
+	severity := "error"
+	if p.Warning {
+		severity = "warning"
+	}
+	if len(p.Path) == 0 {
+		return fmt.Sprintf("%s: %s", severity, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", severity, strings.Join(p.Path, "."), p.Message)
+}
+
+// Validate runs every check on a configuration file and returns all the
+// problems found, sorted by location.  Besides the checks done when loading,
+// it looks for unknown keys, unused groups and triggers, and paths that do not
+// exist or are shared by several rules.  An error is returned only if the file
+// cannot be read.
+func Validate(path string) ([]Problem, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := read(path)
+	if err != nil {
+		return []Problem{{Message: err.Error()}}, nil
+	}
+	problems := append(check(settings), warn(settings)...)
+	if filepath.Ext(path) == ".json" {
+		return problems, nil
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return append(problems, Problem{Message: err.Error()}), nil
+	}
+	for i := range problems {
+		problems[i].Line, problems[i].Column = locate(&root, problems[i].Path)
+	}
+	problems = append(problems, unknownKeys(&root, reflect.TypeOf(Settings{}), nil)...)
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+		return problems[i].Column < problems[j].Column
+	})
+	return problems, nil
+}
+
+// check returns the problems in settings that prevent fetter from running
+func check(settings *Settings) (problems []Problem) {
+	add := func(format string, args ...interface{}) func(path ...string) {
+		return func(path ...string) {
+			problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+	switch settings.Mode {
+	case RunModeAudit, RunModeScanner, RunModeProcConnector:
+	default:
+		add("run mode not supported: %s", settings.Mode)("mode")
+	}
+	switch settings.Audit.Mode {
+	case AuditModeOverride, AuditModePreserve, AuditModeReuse:
+	default:
+		add("audit mode not supported: %s", settings.Audit.Mode)("audit", "mode")
+	}
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(settings.Logging.Level)); err != nil {
+		add("log level not supported: %s", settings.Logging.Level)("logging", "level")
+	}
+	// Groups escalated from, mapped to the rule escalating them
+	escalating := make(map[string]string)
+	for _, name := range settings.RuleNames() {
+		rule := settings.Rules[name]
+		at := func(key string) []string { return []string{"rules", name, key} }
+		if len(rule.Paths) == 0 {
+			add("no paths for rule '%s'", name)(at("paths")...)
+		}
+		switch rule.Action {
+		case ActionExecute, ActionRead, ActionWrite:
+		default:
+			add("action not supported for rule '%s': %s", name, rule.Action)(at("action")...)
+		}
+		if rule.Group == "" && rule.Trigger == "" {
+			add("neither group nor trigger for rule '%s'", name)("rules", name)
+		}
+		if rule.Trigger != "" && rule.Trigger != Kill {
+			if _, ok := settings.Triggers[rule.Trigger]; !ok {
+				add("missing trigger '%s' defined for rule '%s'", rule.Trigger, name)(at("trigger")...)
+			}
+		}
+		if rule.Group != "" {
+			group, _ := SplitGroup(rule.Group)
+			if _, ok := settings.Groups[group]; !ok {
+				add("missing group '%s' defined for rule '%s'", group, name)(at("group")...)
+			} else if err := settings.AssertGroup(rule.Group); err != nil {
+				add("bad group for rule '%s': %s", name, err)(at("group")...)
+			}
+		}
+		problems = append(problems, checkEscalation(settings, name, escalating)...)
+		for _, path := range rule.Paths {
+			p, err := pattern.New(path)
+			if err != nil {
+				add("bad path for rule '%s': %s", name, err)(at("paths")...)
+			} else if p.IsRegex() && rule.Action != ActionExecute {
+				add("bad path for rule '%s': regular expressions are supported for execute actions only", name)(at("paths")...)
+			}
+		}
+		for _, cmdline := range rule.Cmdline {
+			if _, err := pattern.NewCmdline(cmdline); err != nil {
+				add("bad cmdline for rule '%s': %s", name, err)(at("cmdline")...)
+			}
+		}
+		for _, users := range []struct {
+			key   string
+			names []string
+		}{{"users", rule.Users}, {"exclude_users", rule.ExcludeUsers}, {"auid", rule.Auid}} {
+			if _, err := ids.UIDs(users.names); err != nil {
+				add("bad user for rule '%s': %s", name, err)(at(users.key)...)
+			}
+		}
+		if _, err := ids.GIDs(rule.Groups); err != nil {
+			add("bad group for rule '%s': %s", name, err)(at("groups")...)
+		}
+		switch rule.Scope {
+		case "", ScopeProcess, ScopeTree:
+		default:
+			add("scope not supported for rule '%s': %s", name, rule.Scope)(at("scope")...)
+		}
+	}
+	for _, name := range sortedKeys(settings.Groups) {
+		group := settings.Groups[name]
+		for _, trigger := range []struct {
+			key, name string
+		}{{"oom_trigger", group.OOMTrigger}, {"pressure_trigger", group.PressureTrigger}} {
+			if trigger.name == Kill {
+				add("bad trigger for group '%s': %s is for processes", name, Kill)("groups", name, trigger.key)
+			} else if _, ok := settings.Triggers[trigger.name]; trigger.name != "" && !ok {
+				add("missing trigger '%s' defined for group '%s'", trigger.name, name)("groups", name, trigger.key)
+			}
+		}
+		if group.PressureThreshold < 0 || group.PressureThreshold > 100 {
+			add("pressure threshold for group '%s' out of range: %g", name, group.PressureThreshold)("groups", name, "pressure_threshold")
+		}
+		at := func(key ...string) []string { return append([]string{"groups", name}, key...) }
+		problems = append(problems, checkLimits(name, group, at)...)
+		for i, window := range group.Schedule {
+			at := func(key ...string) []string {
+				return append([]string{"groups", name, "schedule", strconv.Itoa(i)}, key...)
+			}
+			if window.From == day {
+				add("bad schedule for group '%s': window starts at %s", name, window.From)(at("from")...)
+			}
+			limits := window.Limits
+			for _, field := range []struct {
+				key string
+				set bool
+			}{
+				{"template", limits.Template},
+				{"schedule", len(limits.Schedule) > 0},
+				{"oom_trigger", limits.OOMTrigger != ""},
+				{"pressure_trigger", limits.PressureTrigger != ""},
+				{"pressure_threshold", limits.PressureThreshold != 0},
+			} {
+				if field.set {
+					add("bad schedule for group '%s': %s is not a limit", name, field.key)(at("limits", field.key)...)
+				}
+			}
+			problems = append(problems, checkLimits(name, limits, func(key ...string) []string {
+				return at(append([]string{"limits"}, key...)...)
+			})...)
+		}
+	}
+	return
+}
+
+// checkLimits returns the problems in the limits of a group (or of a window of
+// its schedule), located by at
+func checkLimits(name string, group Group, at func(key ...string) []string) (problems []Problem) {
+	add := func(format string, args ...interface{}) func(path ...string) {
+		return func(path ...string) {
+			problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+	if group.Swap > 0 && group.RAM == 0 {
+		add("swap for group '%s' needs ram", name)(at("swap")...)
+	}
+	if group.CPUWeight > MaxWeight {
+		add("cpu weight for group '%s' out of range: %d", name, group.CPUWeight)(at("cpu_weight")...)
+	}
+	for _, set := range []struct {
+		key, list string
+		online    func() (string, error)
+	}{{"cpus", group.CPUs, cpuset.OnlineCPUs}, {"mems", group.Mems, cpuset.OnlineMems}} {
+		if set.list == "" {
+			continue
+		}
+		online, err := set.online()
+		if err == nil {
+			err = cpuset.AssertOnline(set.list, online)
+		}
+		if err != nil {
+			add("bad %s for group '%s': %s", set.key, name, err)(at(set.key)...)
+		}
+	}
+	if group.IOWeight > MaxWeight {
+		add("io weight for group '%s' out of range: %d", name, group.IOWeight)(at("io_weight")...)
+	}
+	for _, device := range sortedKeys(group.IO) {
+		if _, _, err := devices.Numbers(device); err != nil && !errors.Is(err, os.ErrNotExist) {
+			add("bad device for group '%s': %s", name, err)(at("io", device)...)
+		}
+	}
+	return
+}
+
+// checkEscalation returns the problems in the escalation steps of a rule.
+// escalating maps the groups escalated from (by rules checked before) to their
+// rules, since a group can escalate in a single way.
+func checkEscalation(settings *Settings, rule string, escalating map[string]string) (problems []Problem) {
+	steps := settings.GetEscalation(rule)
+	if len(steps) == 0 {
+		return
+	}
+	add := func(format string, args ...interface{}) func(path ...string) {
+		return func(path ...string) {
+			problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+	from := settings.GetGroup(rule)
+	if from == "" {
+		add("escalation of rule '%s' needs a group", rule)("rules", rule, "escalate")
+		return
+	}
+	visited := make(map[string]bool)
+	for i, step := range steps {
+		at := func(key ...string) []string {
+			return append([]string{"rules", rule, "escalate", strconv.Itoa(i)}, key...)
+		}
+		group, _ := SplitGroup(from)
+		if from == Kill {
+			add("escalation of rule '%s' goes on after %s", rule, Kill)(at()...)
+			return
+		}
+		if other, ok := escalating[group]; !ok {
+			escalating[group] = rule
+		} else if other != rule {
+			add("group '%s' escalates in rules '%s' and '%s'", group, other, rule)(at()...)
+		}
+		visited[group] = true
+		g := settings.Groups[group]
+		for _, threshold := range []struct {
+			key, limit string
+			value      float64
+			limited    func(g Group) bool
+		}{
+			{"memory", "ram", step.Memory, func(g Group) bool { return g.RAM > 0 }},
+			{"cpu", "cpu", step.CPU, func(g Group) bool { return g.CPU > 0 }},
+		} {
+			if threshold.value < 0 || threshold.value > 100 {
+				add("%s threshold for escalation of rule '%s' out of range: %g", threshold.key, rule, threshold.value)(at(threshold.key)...)
+				continue
+			}
+			if threshold.value > 0 && !threshold.limited(g) {
+				add("%s threshold for escalation of rule '%s' needs %s for group '%s'", threshold.key, rule, threshold.limit, group)(at(threshold.key)...)
+				continue
+			}
+			// Windows of the schedule of the group replace all of its limits
+			for j, w := range g.Schedule {
+				if threshold.value > 0 && !threshold.limited(w.Limits) {
+					add("%s threshold for escalation of rule '%s' needs %s for group '%s' in window %d of its schedule", threshold.key, rule, threshold.limit, group, j)(at(threshold.key)...)
+					break
+				}
+			}
+		}
+		next, _ := SplitGroup(step.Group)
+		_, known := settings.Groups[next]
+		switch {
+		case step.Group == "":
+			add("no group for escalation of rule '%s'", rule)(at()...)
+			return
+		case step.Group == Kill:
+		case !known:
+			add("missing group '%s' defined for escalation of rule '%s'", next, rule)(at("group")...)
+			return
+		case visited[next]:
+			add("escalation of rule '%s' goes back to group '%s'", rule, next)(at("group")...)
+			return
+		default:
+			if err := settings.AssertGroup(step.Group); err != nil {
+				add("bad group for escalation of rule '%s': %s", rule, err)(at("group")...)
+			}
+		}
+		from = step.Group
+	}
+	return
+}
+
+// warn returns the problems in settings that are likely mistakes, but do not
+// prevent fetter from running
+func warn(settings *Settings) (problems []Problem) {
+	add := func(format string, args ...interface{}) func(path ...string) {
+		return func(path ...string) {
+			problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...), Warning: true})
+		}
+	}
+	usedGroups, usedTriggers := make(map[string]bool), make(map[string]bool)
+	// Path and action, mapped to the first rule (the one that wins) with them
+	owners := make(map[string]string)
+	for _, name := range settings.RuleNames() {
+		rule := settings.Rules[name]
+		group, _ := SplitGroup(rule.Group)
+		usedGroups[group] = true
+		usedTriggers[rule.Trigger] = true
+		for _, step := range rule.Escalate {
+			group, _ := SplitGroup(step.Group)
+			usedGroups[group] = true
+		}
+		for _, path := range rule.Paths {
+			p, err := pattern.New(path)
+			if err != nil {
+				continue
+			}
+			if p.IsLiteral() {
+				if _, err := os.Stat(path); err != nil {
+					add("path of rule '%s' does not exist: %s", name, path)("rules", name, "paths")
+				}
+			} else if !p.IsRegex() {
+				if matches, _ := p.Watches(); len(matches) == 0 {
+					add("path of rule '%s' matches no file: %s", name, path)("rules", name, "paths")
+				}
+			}
+			key := rule.Action + " " + p.String()
+			if owner, ok := owners[key]; ok && !settings.Rules[owner].filtered() {
+				add("path of rule '%s' is also in rule '%s', that takes precedence: %s", name, owner, path)("rules", name, "paths")
+			} else if !ok {
+				owners[key] = name
+			}
+		}
+	}
+	for _, name := range settings.IgnoredRules() {
+		add("rule '%s' is ignored in %s mode, that sees executions only", name, settings.Mode)("rules", name, "action")
+	}
+	for _, group := range settings.Groups {
+		usedTriggers[group.OOMTrigger] = true
+		usedTriggers[group.PressureTrigger] = true
+	}
+	for _, name := range sortedKeys(settings.Groups) {
+		if !usedGroups[name] {
+			add("group '%s' is not used by any rule", name)("groups", name)
+		}
+		group := settings.Groups[name]
+		problems = append(problems, warnLimits(name, group, func(key ...string) []string {
+			return append([]string{"groups", name}, key...)
+		})...)
+		for i, window := range group.Schedule {
+			problems = append(problems, warnLimits(name, window.Limits, func(key ...string) []string {
+				return append([]string{"groups", name, "schedule", strconv.Itoa(i), "limits"}, key...)
+			})...)
+		}
+	}
+	for _, name := range sortedKeys(settings.Triggers) {
+		if !usedTriggers[name] {
+			add("trigger '%s' is not used by any rule or group", name)("triggers", name)
+		}
+	}
+	return
+}
+
+// warnLimits returns the likely mistakes in the limits of a group (or of a
+// window of its schedule), located by at
+func warnLimits(name string, group Group, at func(key ...string) []string) (problems []Problem) {
+	add := func(format string, args ...interface{}) func(path ...string) {
+		return func(path ...string) {
+			problems = append(problems, Problem{Path: path, Message: fmt.Sprintf(format, args...), Warning: true})
+		}
+	}
+	if group.CPU > Cores(numCPUs) {
+		add("cpu of group '%s' is over the %d cores of the system: %s", name, numCPUs, group.CPU)(at("cpu")...)
+	}
+	for _, limit := range []struct {
+		key  string
+		size Size
+	}{{"ram_soft", group.RAMSoft}, {"ram_high", group.RAMHigh}} {
+		if limit.size > 0 && group.RAM > 0 && limit.size >= group.RAM {
+			add("%s of group '%s' is not below ram", limit.key, name)(at(limit.key)...)
+		}
+	}
+	for _, device := range sortedKeys(group.IO) {
+		if _, err := os.Stat(device); err != nil {
+			add("device of group '%s' does not exist: %s", name, device)(at("io", device)...)
+		}
+	}
+	return
+}
+
+// filtered tells whether a rule has conditions besides paths
+func (r Rule) filtered() bool {
+	return len(r.Cmdline) > 0 || len(r.Users) > 0 || len(r.Groups) > 0 ||
+		len(r.ExcludeUsers) > 0 || len(r.Auid) > 0
+}
+
+// sortedKeys returns the keys of a map with string keys, sorted
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// locate returns the location of the deepest key in path found in a YAML
+// document
+func locate(root *yaml.Node, path []string) (line, column int) {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+		line, column = node.Line, node.Column
+	}
+	for _, key := range path {
+		if node.Kind == yaml.SequenceNode {
+			// Items of sequences are keyed by their index
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node.Content) {
+				return
+			}
+			node = node.Content[i]
+			line, column = node.Line, node.Column
+			continue
+		}
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		found := false
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				line, column = node.Content[i].Line, node.Content[i].Column
+				node = node.Content[i+1]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return
+		}
+	}
+	return
+}
+
+// unknownKeys returns a problem for every key in a YAML node that does not
+// map to a field of t, as yaml.v2 (used for loading) names them
+func unknownKeys(node *yaml.Node, t reflect.Type, path []string) (problems []Problem) {
+	if node.Kind == yaml.DocumentNode {
+		for _, child := range node.Content {
+			problems = append(problems, unknownKeys(child, t, path)...)
+		}
+		return
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			keyPath := append(append([]string{}, path...), key.Value)
+			field, ok := fields[key.Value]
+			if !ok {
+				problems = append(problems, Problem{
+					Path:    keyPath,
+					Line:    key.Line,
+					Column:  key.Column,
+					Message: fmt.Sprintf("unknown key '%s'", key.Value),
+				})
+				continue
+			}
+			problems = append(problems, unknownKeys(node.Content[i+1], field.Type, keyPath)...)
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyPath := append(append([]string{}, path...), node.Content[i].Value)
+			problems = append(problems, unknownKeys(node.Content[i+1], t.Elem(), keyPath)...)
+		}
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for _, child := range node.Content {
+			problems = append(problems, unknownKeys(child, t.Elem(), path)...)
+		}
+	}
+	return
+}
+
+// yamlFields returns the fields of a struct, indexed by their YAML key: the
+// name in the yaml tag, or else the lowercased field name
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field
+	}
+	return fields
+}
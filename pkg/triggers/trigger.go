@@ -7,14 +7,17 @@ import (
 	"os/user"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/metrics"
 	"github.com/juan-leon/fetter/pkg/settings"
 )
 
 // TriggerRunner instances can run processes based on configured rules
 type TriggerRunner struct {
+	mu       sync.RWMutex
 	triggers map[string]settings.Trigger
 }
 
@@ -28,18 +31,31 @@ func NewTriggerRunner(config *settings.Settings) *TriggerRunner {
 // Run runs the trigger (if any configured for that name) with environment
 // variables defined in data.
 func (tr *TriggerRunner) Run(name string, data *map[string]string) error {
-	if trigger, ok := tr.triggers[name]; ok {
+	tr.mu.RLock()
+	trigger, ok := tr.triggers[name]
+	tr.mu.RUnlock()
+	if ok {
 		go func() { run(&trigger, name, data) }()
 		return nil
 	}
 	return fmt.Errorf("could not find trigger named: %s", name)
 }
 
+// Reload applies the triggers of a new configuration.  Triggers already running
+// are not affected.
+func (tr *TriggerRunner) Reload(config *settings.Settings) {
+	tr.mu.Lock()
+	tr.triggers = config.Triggers
+	tr.mu.Unlock()
+}
+
 func run(trigger *settings.Trigger, name string, data *map[string]string) error {
+	metrics.TriggerRuns.WithLabelValues(name).Inc()
 	cmd := exec.Command(trigger.Run, trigger.Args...)
 	user, err := getUser(trigger.User)
 	if err != nil {
 		log.Logger.Errorf("Could not find user for trigger %s: %s", name, err)
+		metrics.TriggerFailures.WithLabelValues(name).Inc()
 		return err
 	}
 	if sysProcAttr, err := getSysProcAttr(user); err == nil {
@@ -56,6 +72,7 @@ func run(trigger *settings.Trigger, name string, data *map[string]string) error
 			s = s[:128]
 		}
 		log.Logger.Errorw("Trigger execution failed", "name", name, "error", err, "out", s)
+		metrics.TriggerFailures.WithLabelValues(name).Inc()
 		return err
 	}
 	log.Logger.Infof("Trigger '%s' ended with no error", trigger.Run)
@@ -32,6 +32,17 @@ func TestTriggerTrue(t *testing.T) {
 	}
 }
 
+func TestReload(t *testing.T) {
+	tr := NewTriggerRunner(config)
+	tr.Reload(&settings.Settings{Triggers: map[string]settings.Trigger{"t3": {Run: "/bin/true"}}})
+	if err := tr.Run("t1", nil); err == nil {
+		t.Error("t1 should be gone after reload")
+	}
+	if err := tr.Run("t3", nil); err != nil {
+		t.Error("t3 should be there after reload", err)
+	}
+}
+
 func TestRunTrue(t *testing.T) {
 	log.InitLoggerForTests()
 	err := run(&settings.Trigger{Run: "/bin/true"}, "true", nil)
@@ -1,6 +1,30 @@
 package triggers
 
+import (
+	"github.com/juan-leon/fetter/pkg/log"
+	"github.com/juan-leon/fetter/pkg/settings"
+)
+
 // ProcessRunner runs processes based on rule names.
 type ProcessRunner interface {
 	Run(name string, data *map[string]string) error
 }
+
+// DryRun is a ProcessRunner that only logs what it would do
+type DryRun struct{}
+
+// Run logs that a trigger would run
+func (DryRun) Run(name string, data *map[string]string) error {
+	var pid, group string
+	if data != nil {
+		pid, group = (*data)["pid"], (*data)["group"]
+	}
+	if name == settings.Kill {
+		log.Logger.Infof("Dry run: would kill process %s", pid)
+	} else if pid == "" && group != "" {
+		log.Logger.Infof("Dry run: would run trigger %s for group %s", name, group)
+	} else {
+		log.Logger.Infof("Dry run: would run trigger %s for process %s", name, pid)
+	}
+	return nil
+}